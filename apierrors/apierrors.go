@@ -52,3 +52,35 @@ func NewInternalServerError(message string) RestErr {
 		ErrError:   "internal_server_error",
 	}
 }
+
+func NewRequestEntityTooLargeError(message string) RestErr {
+	return restErr{
+		ErrMessage: message,
+		ErrStatus:  http.StatusRequestEntityTooLarge,
+		ErrError:   "request_entity_too_large",
+	}
+}
+
+func NewServiceUnavailableError(message string) RestErr {
+	return restErr{
+		ErrMessage: message,
+		ErrStatus:  http.StatusServiceUnavailable,
+		ErrError:   "service_unavailable",
+	}
+}
+
+func NewGatewayTimeoutError(message string) RestErr {
+	return restErr{
+		ErrMessage: message,
+		ErrStatus:  http.StatusGatewayTimeout,
+		ErrError:   "gateway_timeout",
+	}
+}
+
+func NewConflictError(message string) RestErr {
+	return restErr{
+		ErrMessage: message,
+		ErrStatus:  http.StatusConflict,
+		ErrError:   "conflict",
+	}
+}
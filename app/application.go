@@ -1,20 +1,195 @@
 package app
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/mendezdev/tgo_flattener/config"
 	"github.com/mendezdev/tgo_flattener/flattener"
+	"github.com/mendezdev/tgo_flattener/health"
 	"github.com/mendezdev/tgo_flattener/internal/storage"
 )
 
 type handlers struct {
-	Flat flattener.Handler
+	Flat   flattener.Handler
+	Health health.Handler
+}
+
+// Application contains the http server and the resources
+// that must be released when the app stops
+type Application struct {
+	cfg       config.Config
+	server    *http.Server
+	listener  net.Listener
+	db        *mongo.Client
+	sweeper   *flattener.Sweeper
+	jobs      *flattener.JobQueue
+	callbacks *flattener.CallbackDispatcher
+	serveErr  chan error
+}
+
+func NewApplication(cfg config.Config) *Application {
+	return &Application{
+		cfg:      cfg,
+		serveErr: make(chan error, 1),
+	}
 }
 
-func StartApplication() {
-	db := storage.Connect("mongodb://localhost:27017")
+// StartApplication runs the app with the given config until
+// it receives a SIGINT or SIGTERM and then shuts it down
+func StartApplication(cfg config.Config) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	application := NewApplication(cfg)
+	if err := application.Start(ctx); err != nil {
+		return err
+	}
+	fmt.Printf("listening on %s\n", application.Addr())
+
+	var serveErr error
+	select {
+	case <-ctx.Done():
+		fmt.Println("shutting down...")
+	case serveErr = <-application.serveErr:
+		fmt.Printf("error running the http server: %s\n", serveErr.Error())
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+	defer cancel()
+	if err := application.Shutdown(shutdownCtx); err != nil {
+		return err
+	}
+	return serveErr
+}
+
+// Start connects to the storage and starts serving the http requests in background.
+// The ctx is only used while connecting to the storage
+func (a *Application) Start(ctx context.Context) error {
+	flatStorage, err := a.newStorage(ctx)
+	if err != nil {
+		return err
+	}
+
+	retention := flattener.RetentionPolicy{
+		MaxAge:   a.cfg.Retention.MaxAge,
+		MaxCount: a.cfg.Retention.MaxCount,
+	}
+	if retention.Enabled() {
+		a.sweeper = flattener.NewSweeper(flatStorage, retention, a.cfg.Retention.SweepInterval)
+		a.sweeper.Start()
+	}
+
+	// the callbacks are only enabled with a secret to sign them
+	var flatCallbacks flattener.Callbacks
+	if a.cfg.Callbacks.Secret != "" {
+		a.callbacks = flattener.NewCallbackDispatcher(flatStorage, a.cfg.Callbacks)
+		a.callbacks.Start()
+		flatCallbacks = a.callbacks
+	}
+
+	// the flats are read with the same limit of the server, if it is lower
+	flatsCfg := a.cfg.Flats
+	flatsCfg.MaxBodySize = a.cfg.FlatsBodySize()
+
+	flatGateway := flattener.NewGateway(flatStorage, flatsCfg)
+	a.jobs = flattener.NewJobQueue(flatStorage, flatGateway, flatCallbacks, a.cfg.Jobs)
+	a.jobs.Start()
+
+	checkers := map[string]health.HealthChecker{"storage": flatStorage}
 	h := handlers{
-		Flat: flattener.NewHandler(flattener.NewGateway(flattener.NewStorage(db))),
+		Flat:   flattener.NewHandler(flatGateway, a.jobs, flatCallbacks, flatsCfg),
+		Health: health.NewHandler(checkers, a.cfg.Server.ReadinessTimeout),
+	}
+	a.server = &http.Server{
+		Handler:      routes(h, a.cfg.Server),
+		ReadTimeout:  a.cfg.Server.ReadTimeout,
+		WriteTimeout: a.cfg.Server.WriteTimeout,
+	}
+
+	a.listener, err = net.Listen("tcp", a.cfg.Server.Address)
+	if err != nil {
+		a.release(context.Background())
+		return fmt.Errorf("error listening on %s: %w", a.cfg.Server.Address, err)
+	}
+
+	go func() {
+		if err := a.server.Serve(a.listener); !errors.Is(err, http.ErrServerClosed) {
+			a.serveErr <- err
+		}
+	}()
+
+	return nil
+}
+
+// Addr returns the address where the app is listening, it is useful
+// when the config address has not a fixed port like ":0"
+func (a *Application) Addr() string {
+	return a.listener.Addr().String()
+}
+
+// Shutdown stops receiving new requests, waits for the ones in progress
+// and releases the storage. If ctx is done before, the pending requests are closed
+func (a *Application) Shutdown(ctx context.Context) error {
+	var shutdownErr error
+	if err := a.server.Shutdown(ctx); err != nil {
+		a.server.Close()
+		shutdownErr = fmt.Errorf("error shutting down the http server: %w", err)
 	}
 
-	router := routes(h)
-	router.Run(":8080")
+	if err := a.release(ctx); err != nil && shutdownErr == nil {
+		shutdownErr = err
+	}
+	return shutdownErr
+}
+
+// release stops the background jobs and disconnects the db
+func (a *Application) release(ctx context.Context) error {
+	if a.sweeper != nil {
+		a.sweeper.Stop()
+	}
+	if a.jobs != nil {
+		a.jobs.Stop()
+	}
+	// the callbacks are stopped after the jobs, that can still send them
+	if a.callbacks != nil {
+		a.callbacks.Stop()
+	}
+
+	if a.db != nil {
+		if err := a.db.Disconnect(ctx); err != nil {
+			return fmt.Errorf("error disconnecting from mongodb: %w", err)
+		}
+	}
+	return nil
+}
+
+func (a *Application) newStorage(ctx context.Context) (flattener.Storage, error) {
+	switch a.cfg.Storage.Backend {
+	case config.StorageMemory:
+		fmt.Println("using in memory storage, the flats will be lost when the app stops")
+		return flattener.NewMemoryStorage(), nil
+	default:
+		connectCtx, cancel := context.WithTimeout(ctx, a.cfg.Storage.Timeout)
+		defer cancel()
+
+		db, err := storage.Connect(connectCtx, a.cfg.Storage.MongoURI)
+		if err != nil {
+			return nil, err
+		}
+		a.db = db
+		if err := flattener.CreateIndexes(ctx, db, a.cfg.Storage); err != nil {
+			a.release(context.Background())
+			return nil, err
+		}
+		return flattener.NewStorage(db, a.cfg.Storage), nil
+	}
 }
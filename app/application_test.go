@@ -0,0 +1,168 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendezdev/tgo_flattener/config"
+	"github.com/mendezdev/tgo_flattener/flattener"
+)
+
+func TestApplicationStartAndShutdown(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	cfg := config.Default()
+	cfg.Server.Address = "127.0.0.1:0"
+	cfg.Storage.Backend = config.StorageMemory
+
+	application := NewApplication(cfg)
+	assert.Nil(t, application.Start(context.Background()))
+	url := "http://" + application.Addr()
+
+	resp, err := http.Post(url+"/flats", "application/json", strings.NewReader(`[1,[2,[3]]]`))
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var body map[string]interface{}
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&body))
+	assert.Equal(t, float64(2), body["max_depth"])
+
+	// the by-hash route does not conflict with the id one
+	var flat map[string]interface{}
+	assert.Nil(t, getJSON(url+"/flats/"+body["id"].(string), &flat))
+	assert.Equal(t, body["id"], flat["id"])
+	var byHash map[string]interface{}
+	assert.Nil(t, getJSON(url+"/flats/by-hash/"+flat["hash"].(string), &byHash))
+	assert.Equal(t, flat, byHash)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.Nil(t, application.Shutdown(ctx))
+
+	_, err = http.Get(url + "/ping")
+	assert.NotNil(t, err)
+}
+
+func TestApplicationCallbacks(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	received := make(chan *http.Request, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r
+	}))
+	defer receiver.Close()
+
+	cfg := config.Default()
+	cfg.Server.Address = "127.0.0.1:0"
+	cfg.Storage.Backend = config.StorageMemory
+	cfg.Callbacks.Secret = "s3cr3t"
+	// the receiver is in the loopback
+	cfg.Callbacks.AllowPrivate = true
+
+	application := NewApplication(cfg)
+	assert.Nil(t, application.Start(context.Background()))
+	defer application.Shutdown(context.Background())
+	url := "http://" + application.Addr()
+
+	resp, err := http.Post(url+"/flats?callback_url="+receiver.URL, "application/json", strings.NewReader(`[1,[2]]`))
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var body map[string]interface{}
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&body))
+
+	select {
+	case r := <-received:
+		assert.NotEmpty(t, r.Header.Get(flattener.CallbackSignatureHeader))
+	case <-time.After(5 * time.Second):
+		t.Fatal("the callback was not received")
+	}
+
+	// the deliveries route does not conflict with the id one
+	var deliveries map[string][]map[string]interface{}
+	for i := 0; i < 200; i++ {
+		assert.Nil(t, getJSON(url+"/flats/"+body["id"].(string)+"/deliveries", &deliveries))
+		if len(deliveries["deliveries"]) == 1 && deliveries["deliveries"][0]["status"] == "delivered" {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 1, len(deliveries["deliveries"]))
+	assert.Equal(t, "delivered", deliveries["deliveries"][0]["status"])
+}
+
+func TestApplicationBodyTooLarge(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	cfg := config.Default()
+	cfg.Server.Address = "127.0.0.1:0"
+	cfg.Server.MaxRequestSize = 100
+	cfg.Storage.Backend = config.StorageMemory
+
+	application := NewApplication(cfg)
+	assert.Nil(t, application.Start(context.Background()))
+	defer application.Shutdown(context.Background())
+	url := "http://" + application.Addr()
+
+	testCases := []struct {
+		Path    string
+		Body    string
+		Message string
+	}{
+		{"/flats", "[" + strings.Repeat("1,", 100) + "1]", "the body can not be greater than 100 bytes"},
+		{"/flats?async=true", "[" + strings.Repeat("1,", 100) + "1]", "the body can not be greater than 100 bytes"},
+		{"/flats/batch", "[[" + strings.Repeat("1,", 100) + "1]]", "the body can not be greater than 100 bytes"},
+		{"/flats/documents", `{"a":[` + strings.Repeat("1,", 100) + "1]}", "the body is too large"},
+		{"/flats/unflatten", `{"flatted":[` + strings.Repeat("1,", 100) + `1],"shape":"[*]"}`, "the body is too large"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.Path, func(t *testing.T) {
+			// the MultiReader hides the size, so the body is sent chunked
+			// and it is only limited while it is read
+			req, err := http.NewRequest(http.MethodPost, url+tc.Path, io.MultiReader(strings.NewReader(tc.Body)))
+			assert.Nil(t, err)
+			resp, err := http.DefaultClient.Do(req)
+			assert.Nil(t, err)
+			defer resp.Body.Close()
+
+			assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+			body, err := ioutil.ReadAll(resp.Body)
+			assert.Nil(t, err)
+			assert.Contains(t, string(body), tc.Message)
+		})
+	}
+}
+
+func TestApplicationStartStorageError(t *testing.T) {
+	cfg := config.Default()
+	cfg.Server.Address = "127.0.0.1:0"
+	cfg.Storage.MongoURI = "mongodb://127.0.0.1:1/?serverSelectionTimeoutMS=100"
+	cfg.Storage.Timeout = 500 * time.Millisecond
+
+	application := NewApplication(cfg)
+	err := application.Start(context.Background())
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "mongodb")
+}
+
+// getJSON decodes the body of a 200 response in v
+func getJSON(url string, v interface{}) error {
+	resp, err := http.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
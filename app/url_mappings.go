@@ -1,18 +1,48 @@
 package app
 
 import (
+	"fmt"
+
 	"github.com/gin-gonic/gin"
 
+	"github.com/mendezdev/tgo_flattener/apierrors"
+	"github.com/mendezdev/tgo_flattener/config"
+	"github.com/mendezdev/tgo_flattener/flattener"
 	"github.com/mendezdev/tgo_flattener/ping"
 )
 
-func routes(h handlers) *gin.Engine {
+func routes(h handlers, cfg config.Server) *gin.Engine {
 	router := gin.Default()
+	router.Use(maxRequestSize(cfg.MaxRequestSize))
 
 	router.GET("/ping", ping.Ping)
+	router.GET("/healthz", h.Health.Liveness)
+	router.GET("/readyz", h.Health.Readiness)
 
 	router.POST("/flats", h.Flat.Post)
+	router.POST("/flats/batch", h.Flat.PostBatch)
+	router.POST("/flats/documents", h.Flat.PostDocument)
+	router.POST("/flats/unflatten", h.Flat.PostUnflatten)
 	router.GET("/flats", h.Flat.GetAll)
+	router.GET("/flats/:id", h.Flat.Get)
+	router.GET("/flats/by-hash/:hash", h.Flat.GetByHash)
+	router.DELETE("/flats/:id", h.Flat.Delete)
+	router.GET("/flats/:id/deliveries", h.Flat.GetDeliveries)
+	router.GET("/jobs/:id", h.Flat.GetJob)
 
 	return router
 }
+
+// maxRequestSize rejects the requests with a body bigger than limit.
+// When the size is unknown, reading more than limit fails
+func maxRequestSize(limit int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.ContentLength > limit {
+			apiErr := apierrors.NewRequestEntityTooLargeError(fmt.Sprintf("the body can not be greater than %d bytes", limit))
+			c.AbortWithStatusJSON(apiErr.Status(), apiErr)
+			return
+		}
+		c.Request.Body = flattener.MaxBytesReader(c.Writer, c.Request.Body, limit)
+		c.Next()
+	}
+}
@@ -1,5 +1,351 @@
 package config
 
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// the storage backends that the app can use
 const (
-	FlatsLimit = int64(100)
+	StorageMongo  = "mongo"
+	StorageMemory = "memory"
 )
+
+// envPrefix is the prefix of all the environment variables read by Load
+const envPrefix = "FLATTENER_"
+
+// Config contains all the settings of the app
+type Config struct {
+	Server    Server    `yaml:"server"`
+	Storage   Storage   `yaml:"storage"`
+	Flats     Flats     `yaml:"flats"`
+	Retention Retention `yaml:"retention"`
+	Jobs      Jobs      `yaml:"jobs"`
+	Callbacks Callbacks `yaml:"callbacks"`
+}
+
+// Server contains the settings of the http server.
+// ShutdownTimeout is the time to wait for the requests in progress when the app stops
+// and ReadinessTimeout is the max time to check the dependencies in /readyz
+type Server struct {
+	Address          string        `yaml:"address"`
+	ReadTimeout      time.Duration `yaml:"read_timeout"`
+	WriteTimeout     time.Duration `yaml:"write_timeout"`
+	ShutdownTimeout  time.Duration `yaml:"shutdown_timeout"`
+	ReadinessTimeout time.Duration `yaml:"readiness_timeout"`
+	MaxRequestSize   int64         `yaml:"max_request_size"`
+}
+
+// Storage contains the settings of the storage backend.
+// Timeout is the max time for connecting and for every operation with the db
+type Storage struct {
+	Backend  string        `yaml:"backend"`
+	MongoURI string        `yaml:"mongo_uri"`
+	Database string        `yaml:"database"`
+	Timeout  time.Duration `yaml:"timeout"`
+}
+
+// Flats contains the limits applied to the flats.
+// Limit is the max page size of GET /flats and MaxDepth is the max depth
+// allowed for an array. MaxElements is the max number of values and arrays
+// inside an array and MaxBodySize the max size in bytes of the array read by POST /flats,
+// it can only be lower than the Server.MaxRequestSize of every request, see FlatsBodySize.
+// Zero means no limit for MaxDepth and MaxElements, and only the Server.MaxRequestSize for MaxBodySize.
+// IdempotencyTTL is how long an Idempotency-Key of POST /flats returns the same response.
+// MaxBatchSize is the max number of arrays of POST /flats/batch, zero means no limit,
+// and BatchWorkers is the number of arrays of a batch flatted at the same time
+type Flats struct {
+	Limit          int64         `yaml:"limit"`
+	MaxDepth       int           `yaml:"max_depth"`
+	MaxElements    int           `yaml:"max_elements"`
+	MaxBodySize    int64         `yaml:"max_body_size"`
+	IdempotencyTTL time.Duration `yaml:"idempotency_ttl"`
+	MaxBatchSize   int           `yaml:"max_batch_size"`
+	BatchWorkers   int           `yaml:"batch_workers"`
+}
+
+// Retention contains the rules to delete the old flats, zero disables the rule.
+// SweepInterval is how often the rules are applied
+type Retention struct {
+	MaxAge        time.Duration `yaml:"max_age"`
+	MaxCount      int64         `yaml:"max_count"`
+	SweepInterval time.Duration `yaml:"sweep_interval"`
+}
+
+// Jobs contains the settings of the async flats of POST /flats.
+// Workers is the number of jobs run at the same time and QueueSize
+// the max number of jobs waiting for a worker
+type Jobs struct {
+	Workers   int `yaml:"workers"`
+	QueueSize int `yaml:"queue_size"`
+}
+
+// Callbacks contains the settings of the callback_url of POST /flats. Secret is the key
+// of the HMAC-SHA256 signature of the callbacks, they are disabled when it is empty.
+// Workers is the number of callbacks sent at the same time and QueueSize the max number
+// of callbacks waiting for a worker. A callback is sent up to MaxAttempts times, waiting
+// MinBackoff after the first failure and twice the time after every next one, up to MaxBackoff.
+// Timeout is the max time of every attempt. AllowedHosts are the only hosts of the callback
+// urls when it is not empty. The callbacks to loopback, private and link-local addresses are
+// refused unless AllowPrivate is true, e.g. for receivers in the same network
+type Callbacks struct {
+	Secret       string        `yaml:"secret"`
+	Workers      int           `yaml:"workers"`
+	QueueSize    int           `yaml:"queue_size"`
+	MaxAttempts  int           `yaml:"max_attempts"`
+	MinBackoff   time.Duration `yaml:"min_backoff"`
+	MaxBackoff   time.Duration `yaml:"max_backoff"`
+	Timeout      time.Duration `yaml:"timeout"`
+	AllowedHosts []string      `yaml:"allowed_hosts"`
+	AllowPrivate bool          `yaml:"allow_private"`
+}
+
+// Default returns the settings used when they are not in the file or the environment
+func Default() Config {
+	return Config{
+		Server: Server{
+			Address:          ":8080",
+			ReadTimeout:      30 * time.Second,
+			WriteTimeout:     30 * time.Second,
+			ShutdownTimeout:  30 * time.Second,
+			ReadinessTimeout: 2 * time.Second,
+			MaxRequestSize:   10 << 20,
+		},
+		Storage: Storage{
+			Backend:  StorageMongo,
+			MongoURI: "mongodb://localhost:27017",
+			Database: "flattenerdb",
+			Timeout:  10 * time.Second,
+		},
+		Flats: Flats{
+			Limit:          100,
+			MaxDepth:       1000,
+			MaxElements:    1000000,
+			IdempotencyTTL: 24 * time.Hour,
+			MaxBatchSize:   1000,
+			BatchWorkers:   4,
+		},
+		Retention: Retention{
+			SweepInterval: time.Hour,
+		},
+		Jobs: Jobs{
+			Workers:   2,
+			QueueSize: 100,
+		},
+		Callbacks: Callbacks{
+			Workers:     2,
+			QueueSize:   100,
+			MaxAttempts: 5,
+			MinBackoff:  time.Second,
+			MaxBackoff:  time.Minute,
+			Timeout:     10 * time.Second,
+		},
+	}
+}
+
+// FlatsBodySize returns the max size in bytes of the array read by POST /flats, the
+// flats.max_body_size when it is set and lower than the server.max_request_size, that
+// is applied to every request before, or the server.max_request_size otherwise
+func (c Config) FlatsBodySize() int64 {
+	if c.Flats.MaxBodySize > 0 && c.Flats.MaxBodySize < c.Server.MaxRequestSize {
+		return c.Flats.MaxBodySize
+	}
+	return c.Server.MaxRequestSize
+}
+
+// Load returns the Default settings overwritten by the file in path, if it is not empty,
+// and then by the environment variables. The file can be YAML or JSON.
+// The returned Config is validated
+func Load(path string) (Config, error) {
+	cfg := Default()
+
+	if path != "" {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return cfg, fmt.Errorf("error reading config file: %s", err.Error())
+		}
+		// YAML is a superset of JSON, so the same parser is used for both formats
+		if err := yaml.UnmarshalStrict(content, &cfg); err != nil {
+			return cfg, fmt.Errorf("error parsing config file: %s", err.Error())
+		}
+	}
+
+	if err := loadEnv(&cfg); err != nil {
+		return cfg, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return cfg, err
+	}
+
+	return cfg, nil
+}
+
+// Validate returns an error with the first setting that is not valid
+func (c Config) Validate() error {
+	switch {
+	case c.Server.Address == "":
+		return errors.New("server.address is required")
+	case c.Server.ReadTimeout <= 0:
+		return errors.New("server.read_timeout must be greater than zero")
+	case c.Server.WriteTimeout <= 0:
+		return errors.New("server.write_timeout must be greater than zero")
+	case c.Server.ShutdownTimeout <= 0:
+		return errors.New("server.shutdown_timeout must be greater than zero")
+	case c.Server.ReadinessTimeout <= 0:
+		return errors.New("server.readiness_timeout must be greater than zero")
+	case c.Server.MaxRequestSize <= 0:
+		return errors.New("server.max_request_size must be greater than zero")
+	case c.Storage.Backend != StorageMongo && c.Storage.Backend != StorageMemory:
+		return fmt.Errorf("storage.backend must be %q or %q", StorageMongo, StorageMemory)
+	case c.Storage.Backend == StorageMongo && c.Storage.MongoURI == "":
+		return errors.New("storage.mongo_uri is required")
+	case c.Storage.Backend == StorageMongo && c.Storage.Database == "":
+		return errors.New("storage.database is required")
+	case c.Storage.Timeout <= 0:
+		return errors.New("storage.timeout must be greater than zero")
+	case c.Flats.Limit <= 0:
+		return errors.New("flats.limit must be greater than zero")
+	case c.Flats.MaxDepth < 0:
+		return errors.New("flats.max_depth must be greater or equal than zero")
+	case c.Flats.MaxElements < 0:
+		return errors.New("flats.max_elements must be greater or equal than zero")
+	case c.Flats.MaxBodySize < 0:
+		return errors.New("flats.max_body_size must be greater or equal than zero")
+	case c.Flats.IdempotencyTTL <= 0:
+		return errors.New("flats.idempotency_ttl must be greater than zero")
+	case c.Flats.MaxBatchSize < 0:
+		return errors.New("flats.max_batch_size must be greater or equal than zero")
+	case c.Flats.BatchWorkers <= 0:
+		return errors.New("flats.batch_workers must be greater than zero")
+	case c.Retention.MaxAge < 0:
+		return errors.New("retention.max_age must be greater or equal than zero")
+	case c.Retention.MaxCount < 0:
+		return errors.New("retention.max_count must be greater or equal than zero")
+	case c.Retention.SweepInterval <= 0:
+		return errors.New("retention.sweep_interval must be greater than zero")
+	case c.Jobs.Workers <= 0:
+		return errors.New("jobs.workers must be greater than zero")
+	case c.Jobs.QueueSize <= 0:
+		return errors.New("jobs.queue_size must be greater than zero")
+	case c.Callbacks.Workers <= 0:
+		return errors.New("callbacks.workers must be greater than zero")
+	case c.Callbacks.QueueSize <= 0:
+		return errors.New("callbacks.queue_size must be greater than zero")
+	case c.Callbacks.MaxAttempts <= 0:
+		return errors.New("callbacks.max_attempts must be greater than zero")
+	case c.Callbacks.MinBackoff <= 0:
+		return errors.New("callbacks.min_backoff must be greater than zero")
+	case c.Callbacks.MaxBackoff < c.Callbacks.MinBackoff:
+		return errors.New("callbacks.max_backoff must be greater or equal than callbacks.min_backoff")
+	case c.Callbacks.Timeout <= 0:
+		return errors.New("callbacks.timeout must be greater than zero")
+	case hasEmpty(c.Callbacks.AllowedHosts):
+		return errors.New("callbacks.allowed_hosts can not have empty hosts")
+	}
+	return nil
+}
+
+// loadEnv overwrites the settings with the environment variables that are set.
+// Every setting has a variable with the prefix and the yaml path, e.g: FLATTENER_SERVER_ADDRESS.
+// The lists are separated by commas, e.g: FLATTENER_CALLBACKS_ALLOWED_HOSTS=a.example.com,b.example.com
+func loadEnv(cfg *Config) error {
+	vars := []struct {
+		name string
+		dst  interface{}
+	}{
+		{"SERVER_ADDRESS", &cfg.Server.Address},
+		{"SERVER_READ_TIMEOUT", &cfg.Server.ReadTimeout},
+		{"SERVER_WRITE_TIMEOUT", &cfg.Server.WriteTimeout},
+		{"SERVER_SHUTDOWN_TIMEOUT", &cfg.Server.ShutdownTimeout},
+		{"SERVER_READINESS_TIMEOUT", &cfg.Server.ReadinessTimeout},
+		{"SERVER_MAX_REQUEST_SIZE", &cfg.Server.MaxRequestSize},
+		{"STORAGE_BACKEND", &cfg.Storage.Backend},
+		{"STORAGE_MONGO_URI", &cfg.Storage.MongoURI},
+		{"STORAGE_DATABASE", &cfg.Storage.Database},
+		{"STORAGE_TIMEOUT", &cfg.Storage.Timeout},
+		{"FLATS_LIMIT", &cfg.Flats.Limit},
+		{"FLATS_MAX_DEPTH", &cfg.Flats.MaxDepth},
+		{"FLATS_MAX_ELEMENTS", &cfg.Flats.MaxElements},
+		{"FLATS_MAX_BODY_SIZE", &cfg.Flats.MaxBodySize},
+		{"FLATS_IDEMPOTENCY_TTL", &cfg.Flats.IdempotencyTTL},
+		{"FLATS_MAX_BATCH_SIZE", &cfg.Flats.MaxBatchSize},
+		{"FLATS_BATCH_WORKERS", &cfg.Flats.BatchWorkers},
+		{"RETENTION_MAX_AGE", &cfg.Retention.MaxAge},
+		{"RETENTION_MAX_COUNT", &cfg.Retention.MaxCount},
+		{"RETENTION_SWEEP_INTERVAL", &cfg.Retention.SweepInterval},
+		{"JOBS_WORKERS", &cfg.Jobs.Workers},
+		{"JOBS_QUEUE_SIZE", &cfg.Jobs.QueueSize},
+		{"CALLBACKS_SECRET", &cfg.Callbacks.Secret},
+		{"CALLBACKS_WORKERS", &cfg.Callbacks.Workers},
+		{"CALLBACKS_QUEUE_SIZE", &cfg.Callbacks.QueueSize},
+		{"CALLBACKS_MAX_ATTEMPTS", &cfg.Callbacks.MaxAttempts},
+		{"CALLBACKS_MIN_BACKOFF", &cfg.Callbacks.MinBackoff},
+		{"CALLBACKS_MAX_BACKOFF", &cfg.Callbacks.MaxBackoff},
+		{"CALLBACKS_TIMEOUT", &cfg.Callbacks.Timeout},
+		{"CALLBACKS_ALLOWED_HOSTS", &cfg.Callbacks.AllowedHosts},
+		{"CALLBACKS_ALLOW_PRIVATE", &cfg.Callbacks.AllowPrivate},
+	}
+
+	for _, v := range vars {
+		value, ok := os.LookupEnv(envPrefix + v.name)
+		if !ok {
+			continue
+		}
+
+		var err error
+		switch dst := v.dst.(type) {
+		case *string:
+			*dst = value
+		case *time.Duration:
+			if *dst, err = time.ParseDuration(value); err != nil {
+				return fmt.Errorf("%s%s must be a duration like 30s", envPrefix, v.name)
+			}
+		case *int64:
+			if *dst, err = strconv.ParseInt(value, 10, 64); err != nil {
+				return fmt.Errorf("%s%s must be a number", envPrefix, v.name)
+			}
+		case *int:
+			if *dst, err = strconv.Atoi(value); err != nil {
+				return fmt.Errorf("%s%s must be a number", envPrefix, v.name)
+			}
+		case *bool:
+			if *dst, err = strconv.ParseBool(value); err != nil {
+				return fmt.Errorf("%s%s must be true or false", envPrefix, v.name)
+			}
+		case *[]string:
+			*dst = splitList(value)
+		}
+	}
+
+	return nil
+}
+
+// splitList returns the items of a list separated by commas, without the spaces around them
+func splitList(value string) []string {
+	if strings.TrimSpace(value) == "" {
+		return nil
+	}
+	items := strings.Split(value, ",")
+	for i := range items {
+		items[i] = strings.TrimSpace(items[i])
+	}
+	return items
+}
+
+// hasEmpty tells if any of the items is empty
+func hasEmpty(items []string) bool {
+	for _, item := range items {
+		if strings.TrimSpace(item) == "" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,147 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadDefault(t *testing.T) {
+	cfg, err := Load("")
+	assert.Nil(t, err)
+	assert.Equal(t, Default(), cfg)
+}
+
+func TestLoadFile(t *testing.T) {
+	testCases := []struct {
+		Name    string
+		File    string
+		Content string
+	}{
+		{"yaml", "config.yaml", "server:\n  address: \":9090\"\nstorage:\n  backend: memory\n  timeout: 2s\nflats:\n  limit: 20\n"},
+		{"json", "config.json", `{"server": {"address": ":9090"}, "storage": {"backend": "memory", "timeout": "2s"}, "flats": {"limit": 20}}`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			path := writeConfigFile(t, tc.File, tc.Content)
+
+			cfg, err := Load(path)
+			assert.Nil(t, err)
+			assert.Equal(t, ":9090", cfg.Server.Address)
+			assert.Equal(t, StorageMemory, cfg.Storage.Backend)
+			assert.Equal(t, 2*time.Second, cfg.Storage.Timeout)
+			assert.Equal(t, int64(20), cfg.Flats.Limit)
+
+			// the settings not in the file keep the default value
+			assert.Equal(t, Default().Server.ReadTimeout, cfg.Server.ReadTimeout)
+			assert.Equal(t, Default().Flats.MaxDepth, cfg.Flats.MaxDepth)
+		})
+	}
+}
+
+func TestLoadEnvOverwritesFile(t *testing.T) {
+	path := writeConfigFile(t, "config.yaml", "flats:\n  limit: 20\n  max_depth: 5\n")
+	setEnv(t, "FLATTENER_FLATS_LIMIT", "30")
+	setEnv(t, "FLATTENER_RETENTION_MAX_AGE", "24h")
+	setEnv(t, "FLATTENER_STORAGE_BACKEND", StorageMemory)
+	setEnv(t, "FLATTENER_CALLBACKS_SECRET", "s3cr3t")
+	setEnv(t, "FLATTENER_CALLBACKS_ALLOWED_HOSTS", "hooks.example.com, other.example.com")
+	setEnv(t, "FLATTENER_CALLBACKS_ALLOW_PRIVATE", "true")
+
+	cfg, err := Load(path)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(30), cfg.Flats.Limit)
+	assert.Equal(t, 5, cfg.Flats.MaxDepth)
+	assert.Equal(t, 24*time.Hour, cfg.Retention.MaxAge)
+	assert.Equal(t, StorageMemory, cfg.Storage.Backend)
+	assert.Equal(t, "s3cr3t", cfg.Callbacks.Secret)
+	assert.Equal(t, []string{"hooks.example.com", "other.example.com"}, cfg.Callbacks.AllowedHosts)
+	assert.True(t, cfg.Callbacks.AllowPrivate)
+}
+
+func TestFlatsBodySize(t *testing.T) {
+	testCases := []struct {
+		Name           string
+		MaxBodySize    int64
+		MaxRequestSize int64
+		Expected       int64
+	}{
+		{"only_server", 0, 100, 100},
+		{"lower_flats", 50, 100, 50},
+		{"greater_flats", 200, 100, 100},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			cfg := Default()
+			cfg.Flats.MaxBodySize = tc.MaxBodySize
+			cfg.Server.MaxRequestSize = tc.MaxRequestSize
+			assert.Equal(t, tc.Expected, cfg.FlatsBodySize())
+		})
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	testCases := []struct {
+		Name    string
+		Env     string
+		Value   string
+		Content string
+		Err     string
+	}{
+		{"invalid_duration", "FLATTENER_STORAGE_TIMEOUT", "10", "", "FLATTENER_STORAGE_TIMEOUT must be a duration like 30s"},
+		{"invalid_number", "FLATTENER_FLATS_LIMIT", "many", "", "FLATTENER_FLATS_LIMIT must be a number"},
+		{"invalid_backend", "FLATTENER_STORAGE_BACKEND", "postgres", "", `storage.backend must be "mongo" or "memory"`},
+		{"invalid_limit", "FLATTENER_FLATS_LIMIT", "0", "", "flats.limit must be greater than zero"},
+		{"invalid_max_elements", "FLATTENER_FLATS_MAX_ELEMENTS", "-1", "", "flats.max_elements must be greater or equal than zero"},
+		{"invalid_max_body_size", "FLATTENER_FLATS_MAX_BODY_SIZE", "-1", "", "flats.max_body_size must be greater or equal than zero"},
+		{"invalid_idempotency_ttl", "FLATTENER_FLATS_IDEMPOTENCY_TTL", "0s", "", "flats.idempotency_ttl must be greater than zero"},
+		{"invalid_max_batch_size", "FLATTENER_FLATS_MAX_BATCH_SIZE", "-1", "", "flats.max_batch_size must be greater or equal than zero"},
+		{"invalid_batch_workers", "FLATTENER_FLATS_BATCH_WORKERS", "0", "", "flats.batch_workers must be greater than zero"},
+		{"invalid_jobs_workers", "FLATTENER_JOBS_WORKERS", "0", "", "jobs.workers must be greater than zero"},
+		{"invalid_jobs_queue_size", "FLATTENER_JOBS_QUEUE_SIZE", "-1", "", "jobs.queue_size must be greater than zero"},
+		{"invalid_callbacks_max_attempts", "FLATTENER_CALLBACKS_MAX_ATTEMPTS", "0", "", "callbacks.max_attempts must be greater than zero"},
+		{"invalid_callbacks_max_backoff", "", "", "callbacks:\n  min_backoff: 2m\n", "callbacks.max_backoff must be greater or equal than callbacks.min_backoff"},
+		{"invalid_bool", "FLATTENER_CALLBACKS_ALLOW_PRIVATE", "maybe", "", "FLATTENER_CALLBACKS_ALLOW_PRIVATE must be true or false"},
+		{"invalid_callbacks_allowed_hosts", "FLATTENER_CALLBACKS_ALLOWED_HOSTS", "a.example.com,,b.example.com", "", "callbacks.allowed_hosts can not have empty hosts"},
+		{"unknown_setting", "", "", "flats:\n  limits: 20\n", "error parsing config file"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			if tc.Env != "" {
+				setEnv(t, tc.Env, tc.Value)
+			}
+			var path string
+			if tc.Content != "" {
+				path = writeConfigFile(t, "config.yaml", tc.Content)
+			}
+
+			_, err := Load(path)
+			assert.NotNil(t, err)
+			assert.Contains(t, err.Error(), tc.Err)
+		})
+	}
+
+	_, err := Load(filepath.Join(t.TempDir(), "not_exists.yaml"))
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "error reading config file")
+}
+
+func writeConfigFile(t *testing.T, name string, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	assert.Nil(t, ioutil.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func setEnv(t *testing.T, name string, value string) {
+	assert.Nil(t, os.Setenv(name, value))
+	t.Cleanup(func() {
+		os.Unsetenv(name)
+	})
+}
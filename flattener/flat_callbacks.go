@@ -0,0 +1,389 @@
+package flattener
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/mendezdev/tgo_flattener/apierrors"
+	"github.com/mendezdev/tgo_flattener/config"
+)
+
+// the headers of the callbacks, the signature is the HMAC-SHA256 of the timestamp,
+// a dot and the body, so the receivers can reject the old callbacks sent again
+const (
+	CallbackSignatureHeader = "X-Flattener-Signature"
+	CallbackTimestampHeader = "X-Flattener-Timestamp"
+	CallbackDeliveryHeader  = "X-Flattener-Delivery"
+)
+
+// callbackSignaturePrefix is the algorithm written before the signature in its header
+const callbackSignaturePrefix = "sha256="
+
+// maxCallbackResponseSize is the max number of bytes read of a callback response, it is discarded
+const maxCallbackResponseSize = 4 << 10
+
+// privateNetworks are the private and shared ranges that are not checked by the methods of net.IP
+var privateNetworks = parseNetworks("0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7")
+
+// DeliveryStatus is the state of a callback
+type DeliveryStatus string
+
+const (
+	// DeliveryPending is waiting for a worker or for the next attempt
+	DeliveryPending DeliveryStatus = "pending"
+	// DeliveryDelivered was answered with a 2xx by the callback url
+	DeliveryDelivered DeliveryStatus = "delivered"
+	// DeliveryFailed was not delivered after all the attempts, the Delivery has the error
+	DeliveryFailed DeliveryStatus = "failed"
+)
+
+// Delivery is a callback of POST /flats with the FlatResponse of a flat saved in the db.
+// It has every attempt to send it, Error is only set when it failed
+type Delivery struct {
+	ID        string            `json:"id" bson:"_id,omitempty"`
+	FlatID    string            `json:"flat_id" bson:"flat_id"`
+	URL       string            `json:"url" bson:"url"`
+	Status    DeliveryStatus    `json:"status" bson:"status"`
+	Attempts  []DeliveryAttempt `json:"attempts" bson:"attempts"`
+	Error     string            `json:"error,omitempty" bson:"error,omitempty"`
+	CreatedAt time.Time         `json:"created_at" bson:"created_at"`
+	UpdatedAt time.Time         `json:"updated_at" bson:"updated_at"`
+}
+
+// DeliveryAttempt is a request to the callback url. StatusCode is the status of
+// the response and Error is set when there is no response or it is not a 2xx
+type DeliveryAttempt struct {
+	At         time.Time `json:"at" bson:"at"`
+	StatusCode int       `json:"status_code,omitempty" bson:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty" bson:"error,omitempty"`
+}
+
+// DeliveriesResponse represents the client response for GET /flats/:id/deliveries
+type DeliveriesResponse struct {
+	Deliveries []Delivery `json:"deliveries"`
+}
+
+// Callbacks sends the FlatResponse of the flats to the callback urls in background
+type Callbacks interface {
+	// Notify saves a pending Delivery of the FlatResponse to the url and queues it.
+	// The flat is already saved, so the errors are saved in the Delivery or printed
+	Notify(ctx context.Context, url string, fr FlatResponse)
+
+	// GetDeliveries returns the deliveries of the flat with the id from the oldest to the newest
+	GetDeliveries(ctx context.Context, flatID string) ([]Delivery, apierrors.RestErr)
+
+	// CheckURL returns a bad request error when the host of the url is not allowed or it is
+	// a private address. The names are resolved when the callback is sent, so their
+	// addresses are checked then and the attempts to a private one fail
+	CheckURL(rawURL string) apierrors.RestErr
+}
+
+// queuedDelivery is a Delivery waiting for a worker with the body to send
+type queuedDelivery struct {
+	delivery Delivery
+	body     []byte
+}
+
+// CallbackDispatcher is the Callbacks that keeps the pending deliveries in memory and
+// sends them with a pool of workers. Every delivery is sent until the url answers a 2xx
+// or it fails config.Callbacks.MaxAttempts times, waiting an exponential backoff.
+// The redirects are not followed, they are answers that are not a 2xx
+type CallbackDispatcher struct {
+	storage      Storage
+	client       *http.Client
+	secret       []byte
+	workers      int
+	maxAttempts  int
+	minBackoff   time.Duration
+	maxBackoff   time.Duration
+	allowedHosts map[string]bool
+	allowPrivate bool
+	queue        chan queuedDelivery
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func NewCallbackDispatcher(s Storage, cfg config.Callbacks) *CallbackDispatcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	allowedHosts := make(map[string]bool, len(cfg.AllowedHosts))
+	for _, host := range cfg.AllowedHosts {
+		allowedHosts[strings.ToLower(host)] = true
+	}
+	return &CallbackDispatcher{
+		storage:      s,
+		client:       newCallbackClient(cfg),
+		secret:       []byte(cfg.Secret),
+		workers:      cfg.Workers,
+		maxAttempts:  cfg.MaxAttempts,
+		minBackoff:   cfg.MinBackoff,
+		maxBackoff:   cfg.MaxBackoff,
+		allowedHosts: allowedHosts,
+		allowPrivate: cfg.AllowPrivate,
+		queue:        make(chan queuedDelivery, cfg.QueueSize),
+		ctx:          ctx,
+		cancel:       cancel,
+	}
+}
+
+// newCallbackClient returns the client of the callbacks, it does not follow the redirects and,
+// unless the private addresses are allowed, it checks every address resolved before connecting.
+// The proxies of the environment are not used because their address would be the one checked
+func newCallbackClient(cfg config.Callbacks) *http.Client {
+	dialer := &net.Dialer{Timeout: cfg.Timeout}
+	if !cfg.AllowPrivate {
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || isPrivateIP(ip) {
+				return fmt.Errorf("the callback address %s is not allowed", host)
+			}
+			return nil
+		}
+	}
+
+	return &http.Client{
+		Timeout: cfg.Timeout,
+		Transport: &http.Transport{
+			DialContext:           dialer.DialContext,
+			ForceAttemptHTTP2:     true,
+			MaxIdleConns:          100,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ExpectContinueTimeout: time.Second,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// Start runs the workers until Stop is called
+func (d *CallbackDispatcher) Start() {
+	d.wg.Add(d.workers)
+	for w := 0; w < d.workers; w++ {
+		go func() {
+			defer d.wg.Done()
+			for {
+				select {
+				case <-d.ctx.Done():
+					return
+				case qd := <-d.queue:
+					d.deliver(qd)
+				}
+			}
+		}()
+	}
+}
+
+// Stop interrupts the deliveries in progress and marks them and the pending ones as failed,
+// they are only in memory. It must be called after Start and it is safe to call it more than once
+func (d *CallbackDispatcher) Stop() {
+	d.cancel()
+	d.wg.Wait()
+
+	for {
+		select {
+		case qd := <-d.queue:
+			d.fail(qd.delivery, "the app stopped before delivering the callback")
+		default:
+			return
+		}
+	}
+}
+
+func (d *CallbackDispatcher) Notify(ctx context.Context, url string, fr FlatResponse) {
+	body, err := json.Marshal(fr)
+	if err != nil {
+		fmt.Printf("error encoding the callback of flat %s: %s\n", fr.ID, err.Error())
+		return
+	}
+
+	now := time.Now().UTC()
+	delivery := Delivery{
+		FlatID:    fr.ID,
+		URL:       url,
+		Status:    DeliveryPending,
+		Attempts:  []DeliveryAttempt{},
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	id, createErr := d.storage.createDelivery(ctx, delivery)
+	if createErr != nil {
+		fmt.Printf("error saving the callback of flat %s: %s\n", fr.ID, createErr.Message())
+		return
+	}
+	delivery.ID = id
+
+	select {
+	case d.queue <- queuedDelivery{delivery: delivery, body: body}:
+	default:
+		d.fail(delivery, "the callback queue was full")
+	}
+}
+
+func (d *CallbackDispatcher) GetDeliveries(ctx context.Context, flatID string) ([]Delivery, apierrors.RestErr) {
+	deliveries, err := d.storage.getDeliveries(ctx, flatID)
+	if err != nil {
+		return nil, storageError(err, "error getting deliveries from db")
+	}
+	return deliveries, nil
+}
+
+func (d *CallbackDispatcher) CheckURL(rawURL string) apierrors.RestErr {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return apierrors.NewBadRequestError("callback_url must be an absolute http or https url")
+	}
+	host := strings.ToLower(parsed.Hostname())
+	if len(d.allowedHosts) > 0 && !d.allowedHosts[host] {
+		return apierrors.NewBadRequestError(fmt.Sprintf("the host %s of the callback_url is not allowed", host))
+	}
+	if ip := net.ParseIP(host); ip != nil && !d.allowPrivate && isPrivateIP(ip) {
+		return apierrors.NewBadRequestError("the callback_url can not be a private address")
+	}
+	return nil
+}
+
+// deliver sends the delivery until it is delivered, it fails all the attempts or the dispatcher stops.
+// Every attempt is saved as soon as it finishes
+func (d *CallbackDispatcher) deliver(qd queuedDelivery) {
+	delivery := qd.delivery
+	for attempt := 1; ; attempt++ {
+		delivery.Attempts = append(delivery.Attempts, d.send(delivery, qd.body))
+		delivery.UpdatedAt = time.Now().UTC()
+
+		switch {
+		case delivery.Attempts[len(delivery.Attempts)-1].Error == "":
+			delivery.Status = DeliveryDelivered
+			d.update(delivery)
+			return
+		case attempt >= d.maxAttempts:
+			d.fail(delivery, fmt.Sprintf("the callback failed after %d attempts", attempt))
+			return
+		}
+		d.update(delivery)
+
+		timer := time.NewTimer(d.backoff(attempt))
+		select {
+		case <-d.ctx.Done():
+			timer.Stop()
+			d.fail(delivery, "the app stopped before delivering the callback")
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// send POSTs the signed body to the url of the delivery
+func (d *CallbackDispatcher) send(delivery Delivery, body []byte) DeliveryAttempt {
+	attempt := DeliveryAttempt{At: time.Now().UTC()}
+
+	req, err := http.NewRequestWithContext(d.ctx, http.MethodPost, delivery.URL, bytes.NewReader(body))
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	timestamp := strconv.FormatInt(attempt.At.Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(CallbackDeliveryHeader, delivery.ID)
+	req.Header.Set(CallbackTimestampHeader, timestamp)
+	req.Header.Set(CallbackSignatureHeader, callbackSignaturePrefix+SignCallback(d.secret, timestamp, body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxCallbackResponseSize))
+
+	attempt.StatusCode = resp.StatusCode
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		attempt.Error = fmt.Sprintf("the callback url answered %d", resp.StatusCode)
+	}
+	return attempt
+}
+
+// backoff returns the time to wait after the failed attempt, the min backoff
+// is doubled after every attempt up to the max backoff
+func (d *CallbackDispatcher) backoff(attempt int) time.Duration {
+	wait := d.minBackoff
+	for i := 1; i < attempt && wait < d.maxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > d.maxBackoff {
+		return d.maxBackoff
+	}
+	return wait
+}
+
+// fail saves the delivery as failed with the reason
+func (d *CallbackDispatcher) fail(delivery Delivery, reason string) {
+	delivery.Status = DeliveryFailed
+	delivery.Error = reason
+	delivery.UpdatedAt = time.Now().UTC()
+	d.update(delivery)
+}
+
+// update saves the state of the delivery, the errors are only printed because there is no client waiting
+func (d *CallbackDispatcher) update(delivery Delivery) {
+	if err := d.storage.updateDelivery(context.Background(), delivery); err != nil {
+		fmt.Printf("error updating delivery %s to %s: %s\n", delivery.ID, delivery.Status, err.Message())
+	}
+}
+
+// SignCallback returns the hex HMAC-SHA256 of the timestamp and the body with the secret,
+// it is the signature of the CallbackSignatureHeader without the "sha256=" prefix
+func SignCallback(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// isPrivateIP tells if the ip is a loopback, private, shared, link-local, unspecified or multicast address,
+// e.g: 169.254.169.254, where the clouds have the metadata of the instance
+func isPrivateIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() || ip.IsMulticast() {
+		return true
+	}
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseNetworks parses the CIDRs, they are constants so an error is a bug
+func parseNetworks(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks[i] = network
+	}
+	return networks
+}
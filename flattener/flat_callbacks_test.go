@@ -0,0 +1,325 @@
+package flattener
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mendezdev/tgo_flattener/config"
+	"github.com/stretchr/testify/assert"
+)
+
+const testCallbackSecret = "s3cr3t"
+
+// receivedCallback is a request received by the callbackReceiver
+type receivedCallback struct {
+	Header http.Header
+	Body   []byte
+}
+
+// callbackReceiver is a callback url that answers the statuses in order,
+// and 200 after them, and keeps the requests it receives
+type callbackReceiver struct {
+	*httptest.Server
+	mu       sync.Mutex
+	statuses []int
+	received []receivedCallback
+}
+
+func newCallbackReceiver(t *testing.T, statuses ...int) *callbackReceiver {
+	r := &callbackReceiver{statuses: statuses}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := ioutil.ReadAll(req.Body)
+		assert.Nil(t, err)
+
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.received = append(r.received, receivedCallback{Header: req.Header.Clone(), Body: body})
+		status := http.StatusOK
+		if len(r.statuses) > 0 {
+			status, r.statuses = r.statuses[0], r.statuses[1:]
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func (r *callbackReceiver) requests() []receivedCallback {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]receivedCallback(nil), r.received...)
+}
+
+// testCallbacksConfig has small backoffs to run the retries fast
+func testCallbacksConfig() config.Callbacks {
+	cfg := config.Default().Callbacks
+	cfg.Secret = testCallbackSecret
+	cfg.MinBackoff = time.Millisecond
+	cfg.MaxBackoff = 2 * time.Millisecond
+	cfg.Timeout = time.Second
+	// the receivers are in the loopback
+	cfg.AllowPrivate = true
+	return cfg
+}
+
+// waitDeliveries returns the deliveries of the flat when there are count of them
+// and they are not pending, or the last ones after a while
+func waitDeliveries(t *testing.T, callbacks Callbacks, flatID string, count int) []Delivery {
+	var deliveries []Delivery
+	for i := 0; i < 200; i++ {
+		var err error
+		deliveries, err = callbacks.GetDeliveries(context.Background(), flatID)
+		assert.Nil(t, err)
+		if len(deliveries) == count && deliveriesFinished(deliveries) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return deliveries
+}
+
+func deliveriesFinished(deliveries []Delivery) bool {
+	for _, delivery := range deliveries {
+		if delivery.Status == DeliveryPending {
+			return false
+		}
+	}
+	return true
+}
+
+// assertSignedCallback checks the headers of the callback and that its body is the FlatResponse
+func assertSignedCallback(t *testing.T, received receivedCallback, deliveryID string, fr FlatResponse) {
+	assert.Equal(t, "application/json", received.Header.Get("Content-Type"))
+	assert.Equal(t, deliveryID, received.Header.Get(CallbackDeliveryHeader))
+	timestamp := received.Header.Get(CallbackTimestampHeader)
+	assert.NotEmpty(t, timestamp)
+	assert.Equal(t, "sha256="+SignCallback([]byte(testCallbackSecret), timestamp, received.Body), received.Header.Get(CallbackSignatureHeader))
+
+	expected, err := json.Marshal(fr)
+	assert.Nil(t, err)
+	assert.JSONEq(t, string(expected), string(received.Body))
+}
+
+func TestCallbackDispatcherDelivers(t *testing.T) {
+	receiver := newCallbackReceiver(t, http.StatusInternalServerError, http.StatusServiceUnavailable)
+	dispatcher := NewCallbackDispatcher(NewMemoryStorage(), testCallbacksConfig())
+	dispatcher.Start()
+	defer dispatcher.Stop()
+
+	fr := FlatResponse{ID: "60b5a1727c09e9d6a3cefec4", MaxDepth: 1, Data: []interface{}{json.Number("1"), "2"}}
+	dispatcher.Notify(context.Background(), receiver.URL+"/hook", fr)
+
+	deliveries := waitDeliveries(t, dispatcher, fr.ID, 1)
+	assert.Equal(t, 1, len(deliveries))
+	delivery := deliveries[0]
+	assert.Equal(t, DeliveryDelivered, delivery.Status)
+	assert.Equal(t, receiver.URL+"/hook", delivery.URL)
+	assert.Empty(t, delivery.Error)
+
+	// the failed attempts are retried and saved with the status of the response
+	assert.Equal(t, 3, len(delivery.Attempts))
+	for i, status := range []int{http.StatusInternalServerError, http.StatusServiceUnavailable, http.StatusOK} {
+		assert.Equal(t, status, delivery.Attempts[i].StatusCode)
+	}
+	assert.Equal(t, "the callback url answered 500", delivery.Attempts[0].Error)
+	assert.Empty(t, delivery.Attempts[2].Error)
+
+	requests := receiver.requests()
+	assert.Equal(t, 3, len(requests))
+	for _, received := range requests {
+		assertSignedCallback(t, received, delivery.ID, fr)
+	}
+}
+
+func TestCallbackDispatcherFails(t *testing.T) {
+	receiver := newCallbackReceiver(t, http.StatusBadRequest, http.StatusBadRequest)
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	cfg := testCallbacksConfig()
+	cfg.MaxAttempts = 2
+	dispatcher := NewCallbackDispatcher(NewMemoryStorage(), cfg)
+	dispatcher.Start()
+	defer dispatcher.Stop()
+
+	fr := FlatResponse{ID: "60b5a1727c09e9d6a3cefec4", Data: []interface{}{}}
+	dispatcher.Notify(context.Background(), receiver.URL, fr)
+	dispatcher.Notify(context.Background(), closed.URL, fr)
+
+	deliveries := waitDeliveries(t, dispatcher, fr.ID, 2)
+	assert.Equal(t, 2, len(deliveries))
+	for _, delivery := range deliveries {
+		assert.Equal(t, DeliveryFailed, delivery.Status)
+		assert.Equal(t, "the callback failed after 2 attempts", delivery.Error)
+		assert.Equal(t, 2, len(delivery.Attempts))
+		for _, attempt := range delivery.Attempts {
+			assert.NotEmpty(t, attempt.Error)
+			if delivery.URL == closed.URL {
+				assert.Zero(t, attempt.StatusCode)
+			} else {
+				assert.Equal(t, http.StatusBadRequest, attempt.StatusCode)
+			}
+		}
+	}
+	assert.Equal(t, 2, len(receiver.requests()))
+}
+
+func TestCallbackDispatcherQueueFullAndStop(t *testing.T) {
+	receiver := newCallbackReceiver(t, http.StatusInternalServerError)
+	cfg := testCallbacksConfig()
+	cfg.Workers = 1
+	cfg.QueueSize = 1
+	cfg.MinBackoff = time.Hour
+	cfg.MaxBackoff = time.Hour
+	dispatcher := NewCallbackDispatcher(NewMemoryStorage(), cfg)
+
+	// without workers the first callback waits in the queue
+	fr := FlatResponse{ID: "60b5a1727c09e9d6a3cefec4", Data: []interface{}{}}
+	dispatcher.Notify(context.Background(), receiver.URL+"/first", fr)
+	dispatcher.Notify(context.Background(), receiver.URL+"/second", fr)
+
+	deliveries, err := dispatcher.GetDeliveries(context.Background(), fr.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(deliveries))
+	full := deliveries[0]
+	if full.URL != receiver.URL+"/second" {
+		full = deliveries[1]
+	}
+	assert.Equal(t, DeliveryFailed, full.Status)
+	assert.Equal(t, "the callback queue was full", full.Error)
+	assert.Empty(t, full.Attempts)
+
+	// the first attempt fails and the stop interrupts the backoff
+	dispatcher.Start()
+	for i := 0; i < 200 && len(receiver.requests()) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	dispatcher.Stop()
+	dispatcher.Stop()
+
+	deliveries, err = dispatcher.GetDeliveries(context.Background(), fr.ID)
+	assert.Nil(t, err)
+	for _, delivery := range deliveries {
+		assert.Equal(t, DeliveryFailed, delivery.Status)
+		if delivery.ID != full.ID {
+			assert.Equal(t, "the app stopped before delivering the callback", delivery.Error)
+			assert.Equal(t, 1, len(delivery.Attempts))
+		}
+	}
+}
+
+func TestCallbackDispatcherRefusesPrivateAddresses(t *testing.T) {
+	receiver := newCallbackReceiver(t)
+	cfg := testCallbacksConfig()
+	cfg.AllowPrivate = false
+	cfg.MaxAttempts = 1
+	dispatcher := NewCallbackDispatcher(NewMemoryStorage(), cfg)
+	dispatcher.Start()
+	defer dispatcher.Stop()
+
+	// the name is resolved to the loopback when the callback is sent
+	fr := FlatResponse{ID: "60b5a1727c09e9d6a3cefec4", Data: []interface{}{}}
+	hook := strings.Replace(receiver.URL, "127.0.0.1", "localhost", 1)
+	dispatcher.Notify(context.Background(), hook, fr)
+
+	deliveries := waitDeliveries(t, dispatcher, fr.ID, 1)
+	assert.Equal(t, 1, len(deliveries))
+	assert.Equal(t, DeliveryFailed, deliveries[0].Status)
+	assert.Equal(t, 1, len(deliveries[0].Attempts))
+	assert.Contains(t, deliveries[0].Attempts[0].Error, "the callback address")
+	assert.Empty(t, receiver.requests())
+}
+
+func TestCallbackDispatcherDoesNotFollowRedirects(t *testing.T) {
+	target := newCallbackReceiver(t)
+	redirect := httptest.NewServer(http.RedirectHandler(target.URL, http.StatusTemporaryRedirect))
+	defer redirect.Close()
+
+	cfg := testCallbacksConfig()
+	cfg.MaxAttempts = 1
+	dispatcher := NewCallbackDispatcher(NewMemoryStorage(), cfg)
+	dispatcher.Start()
+	defer dispatcher.Stop()
+
+	fr := FlatResponse{ID: "60b5a1727c09e9d6a3cefec4", Data: []interface{}{}}
+	dispatcher.Notify(context.Background(), redirect.URL, fr)
+
+	deliveries := waitDeliveries(t, dispatcher, fr.ID, 1)
+	assert.Equal(t, 1, len(deliveries))
+	assert.Equal(t, DeliveryFailed, deliveries[0].Status)
+	assert.Equal(t, http.StatusTemporaryRedirect, deliveries[0].Attempts[0].StatusCode)
+	assert.Equal(t, "the callback url answered 307", deliveries[0].Attempts[0].Error)
+	assert.Empty(t, target.requests())
+}
+
+func TestCallbackDispatcherCheckURL(t *testing.T) {
+	cfg := testCallbacksConfig()
+	cfg.AllowPrivate = false
+	dispatcher := NewCallbackDispatcher(NewMemoryStorage(), cfg)
+	cfg.AllowedHosts = []string{"Hooks.example.com", "10.0.0.1"}
+	allowlisted := NewCallbackDispatcher(NewMemoryStorage(), cfg)
+
+	testCases := []struct {
+		Name       string
+		Dispatcher *CallbackDispatcher
+		URL        string
+		Message    string
+	}{
+		{"public_name", dispatcher, "https://hooks.example.com/flats", ""},
+		{"public_address", dispatcher, "http://93.184.216.34:8080/flats", ""},
+		{"loopback", dispatcher, "http://127.0.0.1:8080/flats", "the callback_url can not be a private address"},
+		{"loopback_ipv6", dispatcher, "http://[::1]/flats", "the callback_url can not be a private address"},
+		{"mapped_loopback", dispatcher, "http://[::ffff:127.0.0.1]/flats", "the callback_url can not be a private address"},
+		{"private", dispatcher, "http://192.168.1.10/flats", "the callback_url can not be a private address"},
+		{"private_ipv6", dispatcher, "http://[fd00::1]/flats", "the callback_url can not be a private address"},
+		{"metadata", dispatcher, "http://169.254.169.254/latest/meta-data", "the callback_url can not be a private address"},
+		{"unspecified", dispatcher, "http://0.0.0.0/flats", "the callback_url can not be a private address"},
+		{"allowed_host", allowlisted, "https://HOOKS.example.com/flats", ""},
+		{"not_allowed_host", allowlisted, "https://other.example.com/flats", "the host other.example.com of the callback_url is not allowed"},
+		{"allowed_private_host", allowlisted, "http://10.0.0.1/flats", "the callback_url can not be a private address"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			apiErr := tc.Dispatcher.CheckURL(tc.URL)
+			if tc.Message == "" {
+				assert.Nil(t, apiErr)
+				return
+			}
+			assert.NotNil(t, apiErr)
+			assert.Equal(t, http.StatusBadRequest, apiErr.Status())
+			assert.Equal(t, tc.Message, apiErr.Message())
+		})
+	}
+}
+
+func TestCallbackDispatcherBackoff(t *testing.T) {
+	dispatcher := NewCallbackDispatcher(NewMemoryStorage(), config.Callbacks{MinBackoff: time.Second, MaxBackoff: 5 * time.Second})
+
+	testCases := []struct {
+		Attempt int
+		Backoff time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 5 * time.Second},
+		{100, 5 * time.Second},
+	}
+	for _, tc := range testCases {
+		assert.Equal(t, tc.Backoff, dispatcher.backoff(tc.Attempt))
+	}
+}
+
+func TestSignCallback(t *testing.T) {
+	// printf '1622512800.{}' | openssl dgst -sha256 -hmac s3cr3t
+	expected := "673e907adff474a56da31ad103a1cb5642e356ab38945f98ebeeeb58d95a31d6"
+	assert.Equal(t, expected, SignCallback([]byte(testCallbackSecret), "1622512800", []byte("{}")))
+	assert.NotEqual(t, expected, SignCallback([]byte(testCallbackSecret), "1622512801", []byte("{}")))
+}
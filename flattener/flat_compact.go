@@ -0,0 +1,207 @@
+package flattener
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/mendezdev/tgo_flattener/apierrors"
+)
+
+// the layouts used to save the Graph of a FlatInfo
+const (
+	// FormatVertexSecuence saves a VertexSecuence for every node, the FlatInfos
+	// saved without format_version use it
+	FormatVertexSecuence = 1
+	// FormatCompact saves the Graph as a CompactGraph
+	FormatCompact = 2
+)
+
+// the characters of CompactGraph.Structure that are not in a shape, see Graph.Shape
+const (
+	compactObjectOpen  = '{'
+	compactObjectClose = '}'
+)
+
+// CompactGraph is the FormatCompact layout of a Graph.
+// Structure has the nodes in the order of their keys, like Graph.Shape, where every
+// value is a * and every array is written with its brackets. The flatted objects are
+// written with their braces and the names of the nodes inside them are in Names.
+// Values is a JSON array with the values in the same order, so their types are kept
+type CompactGraph struct {
+	Structure string   `bson:"structure"`
+	Values    string   `bson:"values"`
+	Names     []string `bson:"names,omitempty"`
+}
+
+// compactItem is a Vertex waiting in the stack of Graph.Compact.
+// A nil vertex closes the last array or object with the close character
+type compactItem struct {
+	vertex *Vertex
+	close  byte
+	named  bool
+}
+
+// Compact returns the Graph in the FormatCompact layout
+func (g *Graph) Compact() (*CompactGraph, error) {
+	var structure strings.Builder
+	values := make([]interface{}, 0)
+	names := make([]string, 0)
+
+	stack := []compactItem{{vertex: g.Vertices[0]}}
+	for len(stack) > 0 {
+		item := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		if item.vertex == nil {
+			structure.WriteByte(item.close)
+			continue
+		}
+
+		v := item.vertex
+		if item.named {
+			names = append(names, v.Name)
+		}
+		switch {
+		case v.IsObject():
+			structure.WriteByte(compactObjectOpen)
+			stack = append(stack, compactItem{close: compactObjectClose})
+			for i := len(v.Vertices) - 1; i >= 0; i-- {
+				stack = append(stack, compactItem{vertex: v.Vertices[i], named: true})
+			}
+		case v.IsArray():
+			structure.WriteByte(shapeOpen)
+			stack = append(stack, compactItem{close: shapeClose})
+			for i := len(v.Vertices) - 1; i >= 0; i-- {
+				stack = append(stack, compactItem{vertex: v.Vertices[i]})
+			}
+		default:
+			structure.WriteByte(shapeValue)
+			values = append(values, v.Value)
+		}
+	}
+
+	raw, err := json.Marshal(values)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CompactGraph{
+		Structure: structure.String(),
+		Values:    string(raw),
+		Names:     names,
+	}, nil
+}
+
+// BuildGraphFromCompact rebuild the Graph saved in the FormatCompact layout.
+// The keys are given in the order of the Structure, like FlatArray does
+func BuildGraphFromCompact(c *CompactGraph) (*Graph, apierrors.RestErr) {
+	g, err := buildGraphFromCompact(c)
+	if err != nil {
+		return nil, apierrors.NewInternalServerError(fmt.Sprintf("error parsing compact graph: %s", err.Error()))
+	}
+	return g, nil
+}
+
+func buildGraphFromCompact(c *CompactGraph) (*Graph, error) {
+	if c == nil || c.Structure == "" {
+		return nil, errors.New("the graph is empty")
+	}
+	if c.Structure[0] != shapeOpen && c.Structure[0] != compactObjectOpen {
+		return nil, errors.New("the root must be an array or an object")
+	}
+
+	var values []json.RawMessage
+	if err := json.Unmarshal([]byte(c.Values), &values); err != nil {
+		return nil, fmt.Errorf("invalid values: %s", err.Error())
+	}
+
+	g := NewDirectedGraph()
+	var key, nextValue, nextName int
+	// the keys of the arrays and objects that are open
+	stack := make([]int, 0)
+	for i := 0; i < len(c.Structure); i++ {
+		char := c.Structure[i]
+		if i > 0 && len(stack) == 0 {
+			return nil, fmt.Errorf("unexpected %q at position %d", char, i)
+		}
+
+		switch char {
+		case shapeOpen:
+			g.AddArrayVertex(key)
+		case compactObjectOpen:
+			g.AddObjectVertex(key)
+		case shapeValue:
+			if nextValue >= len(values) {
+				return nil, errors.New("there are less values than nodes")
+			}
+			val, err := compactValue(values[nextValue])
+			if err != nil {
+				return nil, err
+			}
+			nextValue++
+			g.AddVertex(key, val)
+		case shapeClose, compactObjectClose:
+			if len(stack) == 0 {
+				return nil, fmt.Errorf("unexpected %q at position %d", char, i)
+			}
+			open := g.Vertices[stack[len(stack)-1]]
+			if open.IsObject() != (char == compactObjectClose) {
+				return nil, fmt.Errorf("unexpected %q at position %d", char, i)
+			}
+			stack = stack[:len(stack)-1]
+			continue
+		default:
+			return nil, fmt.Errorf("invalid character %q at position %d", char, i)
+		}
+
+		if len(stack) > 0 {
+			father := stack[len(stack)-1]
+			if g.Vertices[father].IsObject() {
+				if nextName >= len(c.Names) {
+					return nil, errors.New("there are less names than nodes inside objects")
+				}
+				g.Vertices[key].Name = c.Names[nextName]
+				nextName++
+			}
+			if err := g.AddEdge(father, key); err != nil {
+				return nil, err
+			}
+		}
+		if char != shapeValue {
+			stack = append(stack, key)
+		}
+		key++
+	}
+
+	if len(stack) > 0 {
+		return nil, errors.New("there are arrays or objects without closing")
+	}
+	if nextValue != len(values) || nextName != len(c.Names) {
+		return nil, errors.New("there are more values or names than nodes")
+	}
+	return g, nil
+}
+
+// compactValue returns the value of CompactGraph.Values like DataInfo.toInterface does,
+// the numbers are json.Number and the objects json.RawMessage
+func compactValue(raw json.RawMessage) (interface{}, error) {
+	switch raw[0] {
+	case 'n':
+		return nil, nil
+	case 't', 'f':
+		var b bool
+		err := json.Unmarshal(raw, &b)
+		return b, err
+	case '"':
+		var s string
+		err := json.Unmarshal(raw, &s)
+		return s, err
+	case '{':
+		return raw, nil
+	case '[':
+		return nil, errors.New("an array can not be a value")
+	}
+	return json.Number(raw), nil
+}
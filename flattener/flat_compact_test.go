@@ -0,0 +1,144 @@
+package flattener
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestCompactRoundTrip(t *testing.T) {
+	testCases := []struct {
+		Body     string
+		Document bool
+		Objects  ObjectMode
+	}{
+		{`[]`, false, ""},
+		{`[1,[2,[3,[]]],null,"",true,1.5,12345678901234567890]`, false, ""},
+		{`[1,{"b":[2,{"c":[[3]]}],"a":null},[{}]]`, false, ObjectsLeaf},
+		{`[1,{"b":[2,{"c":[[3]]}],"a":null},[{}],{"d":{"e":1},"f":2}]`, false, ObjectsFlatten},
+		{`{"a":{"b":[1,{"c":"x"}],"d":{}},"e":[[]],"f":null}`, true, ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Body, func(t *testing.T) {
+			input, apiErr := decodeJSON(strings.NewReader(tc.Body), 0)
+			assert.Nil(t, apiErr)
+
+			var fi FlatInfo
+			if tc.Document {
+				fi, apiErr = FlatDocument(input, FlatOptions{})
+			} else {
+				fi, apiErr = FlatArray(input.([]interface{}), FlatOptions{Objects: tc.Objects})
+			}
+			assert.Nil(t, apiErr)
+			assert.Equal(t, FormatCompact, fi.FormatVersion)
+			assert.Nil(t, fi.VertexSecuence)
+
+			// saved and read like in the db
+			raw, err := bson.Marshal(fi)
+			assert.Nil(t, err)
+			var saved FlatInfo
+			assert.Nil(t, bson.Unmarshal(raw, &saved))
+
+			g, apiErr := saved.BuildGraph()
+			assert.Nil(t, apiErr)
+			expected, apiErr := fi.Graph.GetVertexSecuence()
+			assert.Nil(t, apiErr)
+			secuence, apiErr := g.GetVertexSecuence()
+			assert.Nil(t, apiErr)
+			assert.Equal(t, expected, secuence)
+
+			var rebuilt interface{} = g.ToArray()
+			if tc.Document {
+				rebuilt = g.ToDocument()
+			}
+			unflatted, err := json.Marshal(rebuilt)
+			assert.Nil(t, err)
+			assert.JSONEq(t, tc.Body, string(unflatted))
+		})
+	}
+}
+
+func TestCompactIsSmaller(t *testing.T) {
+	input := make([]interface{}, 0)
+	for i := 0; i < 1000; i++ {
+		input = append(input, json.Number("12345"), "value", []interface{}{true, nil})
+	}
+	fi, apiErr := FlatArray(input, FlatOptions{})
+	assert.Nil(t, apiErr)
+
+	compact, err := bson.Marshal(fi)
+	assert.Nil(t, err)
+
+	fi.FormatVersion = FormatVertexSecuence
+	fi.VertexSecuence, apiErr = fi.Graph.GetVertexSecuence()
+	assert.Nil(t, apiErr)
+	fi.Compact = nil
+	legacy, err := bson.Marshal(fi)
+	assert.Nil(t, err)
+
+	// the compact one is close to the size of the JSON array
+	raw, err := json.Marshal(input)
+	assert.Nil(t, err)
+	assert.Less(t, len(compact), 2*len(raw))
+	assert.Less(t, 10*len(compact), len(legacy))
+}
+
+func TestBuildGraphWithFormatVersion(t *testing.T) {
+	input := []interface{}{"a", []interface{}{"b"}}
+	fi, apiErr := FlatArray(input, FlatOptions{})
+	assert.Nil(t, apiErr)
+
+	// the flats saved before the format_version was added have no version
+	vertexSecuence, apiErr := fi.Graph.GetVertexSecuence()
+	assert.Nil(t, apiErr)
+	for _, version := range []int{0, FormatVertexSecuence} {
+		legacy := FlatInfo{FormatVersion: version, VertexSecuence: vertexSecuence}
+		g, apiErr := legacy.BuildGraph()
+		assert.Nil(t, apiErr)
+		assert.Equal(t, input, g.ToArray())
+	}
+
+	g, apiErr := fi.BuildGraph()
+	assert.Nil(t, apiErr)
+	assert.Equal(t, input, g.ToArray())
+
+	_, apiErr = FlatInfo{FormatVersion: 3}.BuildGraph()
+	assert.NotNil(t, apiErr)
+	assert.Equal(t, http.StatusInternalServerError, apiErr.Status())
+	assert.Equal(t, "unknown format_version 3", apiErr.Message())
+}
+
+func TestBuildGraphFromCompactErrors(t *testing.T) {
+	testCases := []struct {
+		Name    string
+		Compact *CompactGraph
+		Message string
+	}{
+		{"nil", nil, "the graph is empty"},
+		{"empty", &CompactGraph{}, "the graph is empty"},
+		{"root", &CompactGraph{Structure: "*", Values: "[1]"}, "the root must be an array or an object"},
+		{"values", &CompactGraph{Structure: "[*]", Values: "[1"}, "invalid values: unexpected end of JSON input"},
+		{"character", &CompactGraph{Structure: "[*x]", Values: "[1]"}, `invalid character 'x' at position 2`},
+		{"close", &CompactGraph{Structure: "[*}", Values: "[1]"}, `unexpected '}' at position 2`},
+		{"after_root", &CompactGraph{Structure: "[][]", Values: "[]"}, `unexpected '[' at position 2`},
+		{"not_closed", &CompactGraph{Structure: "[[*]", Values: "[1]"}, "there are arrays or objects without closing"},
+		{"less_values", &CompactGraph{Structure: "[**]", Values: "[1]"}, "there are less values than nodes"},
+		{"more_values", &CompactGraph{Structure: "[*]", Values: "[1,2]"}, "there are more values or names than nodes"},
+		{"less_names", &CompactGraph{Structure: "{**}", Values: "[1,2]", Names: []string{"a"}}, "there are less names than nodes inside objects"},
+		{"array_value", &CompactGraph{Structure: "[*]", Values: "[[1]]"}, "an array can not be a value"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			_, apiErr := BuildGraphFromCompact(tc.Compact)
+			assert.NotNil(t, apiErr)
+			assert.Equal(t, http.StatusInternalServerError, apiErr.Status())
+			assert.Equal(t, "error parsing compact graph: "+tc.Message, apiErr.Message())
+		})
+	}
+}
@@ -0,0 +1,277 @@
+package flattener
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/mendezdev/tgo_flattener/apierrors"
+)
+
+// errBodyTooLarge is returned by bodyReader when the body is bigger than the limit
+var errBodyTooLarge = errors.New("body too large")
+
+// bodyReader fails with errBodyTooLarge when more than limit bytes are read.
+// The error is returned in every read after that, the json.Decoder ignores
+// the errors of a read while it has data in its buffer
+type bodyReader struct {
+	r         io.Reader
+	remaining int64
+	exceeded  bool
+}
+
+// newBodyReader returns r if limit is zero, there is no limit
+func newBodyReader(r io.Reader, limit int64) io.Reader {
+	if limit <= 0 {
+		return r
+	}
+	return &bodyReader{r: r, remaining: limit}
+}
+
+func (br *bodyReader) Read(p []byte) (int, error) {
+	if br.exceeded {
+		return 0, errBodyTooLarge
+	}
+
+	// reading one more byte tells if the body is bigger than the limit
+	if int64(len(p)) > br.remaining+1 {
+		p = p[:br.remaining+1]
+	}
+	n, err := br.r.Read(p)
+	if int64(n) > br.remaining {
+		n = int(br.remaining)
+		br.remaining = 0
+		br.exceeded = true
+		return n, errBodyTooLarge
+	}
+	br.remaining -= int64(n)
+	return n, err
+}
+
+// maxBytesReader is an http.MaxBytesReader that returns errBodyTooLarge when the body is
+// bigger than the limit, so the handlers know it without the message of the error
+type maxBytesReader struct {
+	body  io.ReadCloser
+	limit int64
+	read  int64
+}
+
+// MaxBytesReader wraps http.MaxBytesReader for the max request size of the server,
+// the handlers that read the body return 413 when it is bigger than the limit
+func MaxBytesReader(w http.ResponseWriter, body io.ReadCloser, limit int64) io.ReadCloser {
+	return &maxBytesReader{body: http.MaxBytesReader(w, body, limit), limit: limit}
+}
+
+// Read returns errBodyTooLarge instead of the error of http.MaxBytesReader, that
+// never returns more than limit bytes and fails when the body has more
+func (r *maxBytesReader) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	r.read += int64(n)
+	if err != nil && err != io.EOF && r.read >= r.limit {
+		return n, errBodyTooLarge
+	}
+	return n, err
+}
+
+func (r *maxBytesReader) Close() error {
+	return r.body.Close()
+}
+
+// decodeFrame is an array or object that is being decoded
+type decodeFrame struct {
+	array  []interface{}
+	object map[string]interface{}
+	key    *string
+}
+
+// value returns the array or the object of the frame
+func (f *decodeFrame) value() interface{} {
+	if f.object != nil {
+		return f.object
+	}
+	return f.array
+}
+
+// add appends the value to the array or sets it in the object with the last key read
+func (f *decodeFrame) add(val interface{}) {
+	if f.object != nil {
+		f.object[*f.key] = val
+		f.key = nil
+		return
+	}
+	f.array = append(f.array, val)
+}
+
+// decodeJSON reads a JSON value token by token with an explicit stack instead of recursion.
+// The numbers are decoded as json.Number. It returns a bad request as soon as a value is
+// nested deeper than maxDepth, zero means no limit. The depth is counted like FlatArray,
+// without the root array or object, but the objects are counted too, so a deep nesting of
+// objects is rejected while it is read even if the max depth of the result only has arrays
+func decodeJSON(r io.Reader, maxDepth int) (interface{}, apierrors.RestErr) {
+	decoder := json.NewDecoder(r)
+	decoder.UseNumber()
+
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, decodeError(err, 0)
+	}
+
+	// the root array or object is not counted
+	depth := 0
+	if token == json.Delim('[') || token == json.Delim('{') {
+		depth = -1
+	}
+	return decodeValue(decoder, token, depth, maxDepth, 0)
+}
+
+// decodeValue reads the rest of the value that starts with token. The depth is the one
+// of the array or object where the value is, every array or object inside it adds one.
+// The bodyLimit is only used for the error message when the body is too large
+func decodeValue(decoder *json.Decoder, token json.Token, depth int, maxDepth int, bodyLimit int64) (interface{}, apierrors.RestErr) {
+	stack := make([]*decodeFrame, 0)
+	for {
+		// complete is false when an array or object was opened or a key was read
+		complete := true
+		var val interface{}
+		switch t := token.(type) {
+		case json.Delim:
+			switch t {
+			case '[', '{':
+				depth++
+				if maxDepth > 0 && depth > maxDepth {
+					return nil, maxDepthError(maxDepth)
+				}
+				if t == '[' {
+					stack = append(stack, &decodeFrame{array: make([]interface{}, 0)})
+				} else {
+					stack = append(stack, &decodeFrame{object: map[string]interface{}{}})
+				}
+				complete = false
+			default:
+				closed := stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+				depth--
+				val = closed.value()
+			}
+		case string:
+			// the strings in an object without a key are the keys
+			if top := len(stack) - 1; top >= 0 && stack[top].object != nil && stack[top].key == nil {
+				key := t
+				stack[top].key = &key
+				complete = false
+			} else {
+				val = t
+			}
+		default:
+			val = t
+		}
+
+		if complete {
+			if len(stack) == 0 {
+				return val, nil
+			}
+			stack[len(stack)-1].add(val)
+		}
+
+		var err error
+		if token, err = decoder.Token(); err != nil {
+			return nil, decodeError(err, bodyLimit)
+		}
+	}
+}
+
+// FlatArrayStream is like FlatArray but the array is read from r token by token.
+// The Graph is built while the array is read, without decoding the whole array first,
+// so the limits of the options are checked as soon as they are exceeded.
+// Only the objects are decoded before adding them to the Graph
+func FlatArrayStream(r io.Reader, opts FlatOptions) (FlatInfo, apierrors.RestErr) {
+	if err := validateArrayOptions(opts); err != nil {
+		return FlatInfo{}, err
+	}
+
+	decoder := json.NewDecoder(newBodyReader(r, opts.MaxBodySize))
+	decoder.UseNumber()
+
+	token, err := decoder.Token()
+	if err != nil {
+		return FlatInfo{}, decodeError(err, opts.MaxBodySize)
+	}
+	if token != json.Delim('[') {
+		return FlatInfo{}, apierrors.NewBadRequestError("error parsing body")
+	}
+
+	b := newGraphBuilder(false, opts)
+
+	// the stack has the nodes of the open arrays, the depth of the values
+	// inside the last one is the size of the stack less the root
+	stack := []int{0}
+	for len(stack) > 0 {
+		token, err := decoder.Token()
+		if err != nil {
+			return FlatInfo{}, decodeError(err, opts.MaxBodySize)
+		}
+
+		father := stack[len(stack)-1]
+		depth := len(stack) - 1
+		switch token {
+		case json.Delim('['):
+			node, err := b.add(father, "", depth+1, make([]interface{}, 0))
+			if err != nil {
+				return FlatInfo{}, err
+			}
+			stack = append(stack, node)
+		case json.Delim(']'):
+			stack = stack[:len(stack)-1]
+		case json.Delim('{'):
+			if opts.Objects != ObjectsLeaf && opts.Objects != ObjectsFlatten {
+				return FlatInfo{}, objectNotAllowedError()
+			}
+			object, err := decodeValue(decoder, token, depth, opts.MaxDepth, opts.MaxBodySize)
+			if err != nil {
+				return FlatInfo{}, err
+			}
+			if err := addObject(b, father, depth, object); err != nil {
+				return FlatInfo{}, err
+			}
+		default:
+			if _, err := b.add(father, "", 0, token); err != nil {
+				return FlatInfo{}, err
+			}
+		}
+	}
+
+	fi, buildErr := b.flatInfo()
+	if buildErr != nil {
+		return FlatInfo{}, buildErr
+	}
+	return arrayFlatInfo(fi, opts), nil
+}
+
+// addObject adds the object to the Graph like buildGraph does. The values
+// inside it are only added when the objects are flatted
+func addObject(b *graphBuilder, father int, depth int, object interface{}) apierrors.RestErr {
+	if b.opts.Objects != ObjectsFlatten {
+		_, err := b.add(father, "", 0, object)
+		return err
+	}
+
+	node, err := b.add(father, "", depth, object)
+	if err != nil {
+		return err
+	}
+	return buildGraph(object, node, depth, true, b.add)
+}
+
+// decodeError returns the error for the clients of an error reading the body.
+// The bodyLimit is only used in the message, zero when it is not known
+func decodeError(err error, bodyLimit int64) apierrors.RestErr {
+	if err == errBodyTooLarge {
+		if bodyLimit <= 0 {
+			return apierrors.NewRequestEntityTooLargeError("the body is too large")
+		}
+		return apierrors.NewRequestEntityTooLargeError(fmt.Sprintf("the body can not be greater than %d bytes", bodyLimit))
+	}
+	return apierrors.NewBadRequestError("error parsing body")
+}
@@ -0,0 +1,191 @@
+package flattener
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeJSON(t *testing.T) {
+	testCases := []string{
+		`[]`,
+		`{}`,
+		`[1,12345678901234567890,-0.5,1.5e300,[],[[]],null,"",true,["a",[null,[]]]]`,
+		`{"a":{"b":[1,{"c":"x"}]},"d":null,"e":[[]]}`,
+		`[{"key":"value","other":["key",{"key":[]}]}]`,
+		`"value"`,
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc, func(t *testing.T) {
+			val, apiErr := decodeJSON(strings.NewReader(tc), 0)
+			assert.Nil(t, apiErr)
+
+			// it is the same value returned by the json decoder
+			decoder := json.NewDecoder(strings.NewReader(tc))
+			decoder.UseNumber()
+			var expected interface{}
+			assert.Nil(t, decoder.Decode(&expected))
+			assert.Equal(t, expected, val)
+		})
+	}
+}
+
+func TestDecodeJSONErrors(t *testing.T) {
+	testCases := []struct {
+		Body     string
+		MaxDepth int
+		Message  string
+	}{
+		{``, 0, "error parsing body"},
+		{`[1,2`, 0, "error parsing body"},
+		{`[1 2]`, 0, "error parsing body"},
+		{`{"a":}`, 0, "error parsing body"},
+		{`[[[1]]]`, 1, "the array exceeds the max depth allowed of 1"},
+		{`{"a":[[1]]}`, 1, "the array exceeds the max depth allowed of 1"},
+		{`[{"a":[[1]]}]`, 1, "the array exceeds the max depth allowed of 1"},
+		{`{"a":{"b":{"c":1}}}`, 1, "the array exceeds the max depth allowed of 1"},
+		{`[{"a":{"b":1}}]`, 1, "the array exceeds the max depth allowed of 1"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Body, func(t *testing.T) {
+			_, apiErr := decodeJSON(strings.NewReader(tc.Body), tc.MaxDepth)
+			assert.NotNil(t, apiErr)
+			assert.Equal(t, http.StatusBadRequest, apiErr.Status())
+			assert.Equal(t, tc.Message, apiErr.Message())
+		})
+	}
+
+	// the depth goes down when the arrays are closed
+	_, apiErr := decodeJSON(strings.NewReader(`[[1],[2],{"a":[3]},[[4]]]`), 2)
+	assert.Nil(t, apiErr)
+}
+
+func TestDecodeJSONDeepArray(t *testing.T) {
+	// the json decoder does not allow more than 10000 levels
+	const depth = 9000
+	body := strings.Repeat("[", depth+1) + "1" + strings.Repeat("]", depth+1)
+
+	_, apiErr := decodeJSON(strings.NewReader(body), 1000)
+	assert.NotNil(t, apiErr)
+	assert.Equal(t, "the array exceeds the max depth allowed of 1000", apiErr.Message())
+
+	val, apiErr := decodeJSON(strings.NewReader(body), 0)
+	assert.Nil(t, apiErr)
+	unflatted, err := json.Marshal(val)
+	assert.Nil(t, err)
+	assert.Equal(t, body, string(unflatted))
+}
+
+func TestFlatDeepArray(t *testing.T) {
+	const depth = 100000
+	input := []interface{}{"1"}
+	for i := 0; i < depth; i++ {
+		input = []interface{}{input}
+	}
+
+	fi, apiErr := FlatArray(input, FlatOptions{})
+	assert.Nil(t, apiErr)
+	assert.Equal(t, depth, fi.MaxDepth)
+	assert.Equal(t, []interface{}{"1"}, fi.Graph.ToFlat())
+	assert.Equal(t, depth, fi.Graph.Paths(-1)[0].Depth)
+	assert.Equal(t, strings.Repeat("[", depth+1)+"*"+strings.Repeat("]", depth+1), fi.Graph.Shape())
+	assert.Equal(t, depth, fi.Stats.SubArrays)
+
+	g, buildErr := fi.BuildGraph()
+	assert.Nil(t, buildErr)
+	assert.Equal(t, input, g.ToArray())
+}
+
+func TestFlatArrayStream(t *testing.T) {
+	depth := 1
+	testCases := []struct {
+		Body string
+		Opts FlatOptions
+	}{
+		{`[]`, FlatOptions{}},
+		{`[1,[2,[3,[]]],null,"",true,12345678901234567890]`, FlatOptions{}},
+		{`[[[[["deep"]]]],"x"]`, FlatOptions{MaxDepth: 4, Depth: &depth}},
+		{`[1,{"b":[2,{"c":[[3]]}],"a":null},[{}]]`, FlatOptions{Objects: ObjectsLeaf}},
+		{`[1,{"b":[2,{"c":[[3]]}],"a":null},[{}]]`, FlatOptions{Objects: ObjectsFlatten}},
+		{`[[{"a":{"b":[[1]]}}]]`, FlatOptions{Objects: ObjectsFlatten, MaxDepth: 5}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Body, func(t *testing.T) {
+			fi, apiErr := FlatArrayStream(strings.NewReader(tc.Body), tc.Opts)
+			assert.Nil(t, apiErr)
+
+			// it is the same FlatInfo built from the whole array
+			input, apiErr := decodeJSON(strings.NewReader(tc.Body), 0)
+			assert.Nil(t, apiErr)
+			expected, apiErr := FlatArray(input.([]interface{}), tc.Opts)
+			assert.Nil(t, apiErr)
+
+			assert.Equal(t, expected.Type, fi.Type)
+			assert.Equal(t, expected.MaxDepth, fi.MaxDepth)
+			assert.Equal(t, expected.FlatDepth, fi.FlatDepth)
+			assert.Equal(t, expected.Stats, fi.Stats)
+			assert.Equal(t, expected.Compact, fi.Compact)
+		})
+	}
+}
+
+func TestFlatArrayStreamErrors(t *testing.T) {
+	depth := -1
+	testCases := []struct {
+		Body    string
+		Opts    FlatOptions
+		Status  int
+		Message string
+	}{
+		{`{"a":[1]}`, FlatOptions{}, http.StatusBadRequest, "error parsing body"},
+		{`[1,[2]`, FlatOptions{}, http.StatusBadRequest, "error parsing body"},
+		{`[1,{"a":1}]`, FlatOptions{}, http.StatusBadRequest, "object is not a valid value inside an array"},
+		{`[1,{"a":1}]`, FlatOptions{Objects: "other"}, http.StatusBadRequest, `invalid objects mode "other"`},
+		{`[1]`, FlatOptions{Depth: &depth}, http.StatusBadRequest, "the depth must be greater or equal than zero"},
+		{`[[[1]]]`, FlatOptions{MaxDepth: 1}, http.StatusBadRequest, "the array exceeds the max depth allowed of 1"},
+		{`[{"a":[[1]]}]`, FlatOptions{MaxDepth: 1, Objects: ObjectsLeaf}, http.StatusBadRequest, "the array exceeds the max depth allowed of 1"},
+		{`[{"a":{"b":{}}}]`, FlatOptions{MaxDepth: 2, Objects: ObjectsLeaf}, http.StatusBadRequest, "the array exceeds the max depth allowed of 2"},
+		{`[{"a":{"b":{}}}]`, FlatOptions{MaxDepth: 2, Objects: ObjectsFlatten}, http.StatusBadRequest, "the array exceeds the max depth allowed of 2"},
+		{`[1,2,[3]]`, FlatOptions{MaxElements: 3}, http.StatusRequestEntityTooLarge, "the array exceeds the max elements allowed of 3"},
+		{`[{"a":[1,2]}]`, FlatOptions{MaxElements: 3, Objects: ObjectsFlatten}, http.StatusRequestEntityTooLarge, "the array exceeds the max elements allowed of 3"},
+		{`[1, 2, 3]`, FlatOptions{MaxBodySize: 8}, http.StatusRequestEntityTooLarge, "the body can not be greater than 8 bytes"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Body, func(t *testing.T) {
+			_, apiErr := FlatArrayStream(strings.NewReader(tc.Body), tc.Opts)
+			assert.NotNil(t, apiErr)
+			assert.Equal(t, tc.Status, apiErr.Status())
+			assert.Equal(t, tc.Message, apiErr.Message())
+		})
+	}
+
+	// the limits are not exceeded
+	_, apiErr := FlatArrayStream(strings.NewReader(`[1, 2]`), FlatOptions{MaxElements: 2, MaxBodySize: 6})
+	assert.Nil(t, apiErr)
+}
+
+func TestMaxBytesReader(t *testing.T) {
+	body := MaxBytesReader(httptest.NewRecorder(), ioutil.NopCloser(strings.NewReader("[1,2,3]")), 5)
+	read, err := ioutil.ReadAll(body)
+	assert.Equal(t, errBodyTooLarge, err)
+	assert.Equal(t, "[1,2,", string(read))
+	assert.Nil(t, body.Close())
+
+	apiErr := decodeError(err, 5)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, apiErr.Status())
+	assert.Equal(t, "the body can not be greater than 5 bytes", apiErr.Message())
+
+	// the body with the size of the limit is read as usual
+	read, err = ioutil.ReadAll(MaxBytesReader(httptest.NewRecorder(), ioutil.NopCloser(strings.NewReader("[1,2,3]")), 7))
+	assert.Nil(t, err)
+	assert.Equal(t, "[1,2,3]", string(read))
+}
@@ -1,35 +1,231 @@
 package flattener
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/mendezdev/tgo_flattener/apierrors"
 )
 
-// FlatResponse represents the client response for POST /flats
+// FlatResponse represents the client response for POST /flats.
+// Shape, Paths and Stats are only returned when they are asked, see Graph.Shape and Graph.Paths.
+// Deduplicated is true when the same array was already saved, then ID is the one of that record.
+// Replayed is true when the response is the one of a previous request with the same Idempotency-Key
 type FlatResponse struct {
-	MaxDepth int           `json:"max_depth"`
-	Data     []interface{} `json:"flatted_data"`
+	ID           string        `json:"id"`
+	MaxDepth     int           `json:"max_depth"`
+	Data         []interface{} `json:"flatted_data"`
+	Shape        string        `json:"shape,omitempty"`
+	Paths        []ValuePath   `json:"paths,omitempty"`
+	Stats        *FlatStats    `json:"stats,omitempty"`
+	Deduplicated bool          `json:"deduplicated,omitempty"`
+	Replayed     bool          `json:"-"`
 }
 
-// FlatResponse represents the client response for GET /flats
+// FlatBatchResponse represents the client response for POST /flats/batch,
+// there is an item for every array of the request in the same order
+type FlatBatchResponse struct {
+	Items []FlatBatchItem `json:"items"`
+}
+
+// FlatBatchItem is the result of an array of POST /flats/batch. Status is the one
+// that POST /flats returns for the array, Result is set when it is 200 and Error otherwise
+type FlatBatchItem struct {
+	Status int               `json:"status"`
+	Result *FlatResponse     `json:"result,omitempty"`
+	Error  apierrors.RestErr `json:"error,omitempty"`
+}
+
+// FlatStreamTrailer is the last line of the NDJSON response of POST /flats,
+// the flatted values are written one per line before it
+type FlatStreamTrailer struct {
+	ID           string      `json:"id"`
+	MaxDepth     int         `json:"max_depth"`
+	Shape        string      `json:"shape,omitempty"`
+	Paths        []ValuePath `json:"paths,omitempty"`
+	Stats        *FlatStats  `json:"stats,omitempty"`
+	Deduplicated bool        `json:"deduplicated,omitempty"`
+}
+
+// FlatValues calls fn with every value of a flatted array in order, they are built while
+// the graph is walked so the whole flatted array is never in memory. It stops with the first
+// error of fn and returns it
+type FlatValues func(fn func(val interface{}) error) error
+
+// FlatStats contains the statistics of the structure of an array, see Graph.Stats.
+// Types counts the values by their type: string, number, bool, null or object.
+// Depths counts the values and sub-arrays in every depth, the index is the depth
+type FlatStats struct {
+	Leaves      int            `json:"leaves" bson:"leaves"`
+	SubArrays   int            `json:"sub_arrays" bson:"sub_arrays"`
+	EmptyArrays int            `json:"empty_arrays" bson:"empty_arrays"`
+	Nulls       int            `json:"nulls" bson:"nulls"`
+	Types       map[string]int `json:"types" bson:"types"`
+	Depths      []int          `json:"depths" bson:"depths"`
+}
+
+// ValuePath is where a value of the flatted array was in the original array.
+// Path has the index in every array from the root, e.g: [1,0,2] and Depth
+// is the number of arrays around the value without counting the root
+type ValuePath struct {
+	Path  []int `json:"path"`
+	Depth int   `json:"depth"`
+}
+
+// UnflatRequest represents the client request for POST /flats/unflatten.
+// Flatted and Shape are the values returned by POST /flats
+type UnflatRequest struct {
+	Flatted []interface{} `json:"flatted"`
+	Shape   string        `json:"shape"`
+}
+
+// UnflatResponse represents the client response for POST /flats/unflatten
+type UnflatResponse struct {
+	Unflatted []interface{} `json:"unflatted"`
+}
+
+// FlatDocumentResponse represents the client response for POST /flats/documents.
+// Data has the path of every value as key, e.g: {"a.b[2].c": 1}.
+// Deduplicated is true when the same document was already saved, like in FlatResponse
+type FlatDocumentResponse struct {
+	ID           string                 `json:"id"`
+	MaxDepth     int                    `json:"max_depth"`
+	Data         map[string]interface{} `json:"flatted_data"`
+	Deduplicated bool                   `json:"deduplicated,omitempty"`
+}
+
+// FlatInfoResponse represents the client response for GET /flats and GET /flats/:id.
+// When Type is FlatTypeArray, Unflatted and Flatted are arrays. When it is FlatTypeDocument,
+// Unflatted is the original document and Flatted is an object with the paths of the values.
+// Stats is only in the arrays saved after the statistics were added and Hash
+// in the records saved after the deduplication was added
 type FlatInfoResponse struct {
-	ID          string        `json:"id"`
-	ProcessedAt time.Time     `json:"processed_at"`
-	Unflatted   []interface{} `json:"unflatted"`
-	Flatted     []interface{} `json:"flatted"`
+	ID          string      `json:"id"`
+	Type        string      `json:"type"`
+	Hash        string      `json:"hash,omitempty"`
+	ProcessedAt time.Time   `json:"processed_at"`
+	Unflatted   interface{} `json:"unflatted"`
+	Flatted     interface{} `json:"flatted"`
+	Stats       *FlatStats  `json:"stats,omitempty"`
 }
 
-// FlatInfo represents the structure to be saved in the db
+// FlatsPage represents the client response for GET /flats.
+// Next is empty when there are no more pages
+type FlatsPage struct {
+	Items []FlatInfoResponse `json:"items"`
+	Next  string             `json:"next,omitempty"`
+}
+
+// FlatsPageTrailer is the last line of the NDJSON response of GET /flats,
+// the items are written one per line before it
+type FlatsPageTrailer struct {
+	Next string `json:"next,omitempty"`
+}
+
+// FlatsQuery contains the filters and the page to get in GET /flats.
+// The nil filters are not applied. The filters of the FlatStats
+// never match the flats without them
+type FlatsQuery struct {
+	Limit     int64
+	Cursor    *FlatsCursor
+	From      *time.Time
+	To        *time.Time
+	MinDepth  *int
+	MaxDepth  *int
+	MinLeaves *int
+	MaxLeaves *int
+	HasNulls  *bool
+}
+
+// FlatsCursor points to the last FlatInfo of a page.
+// The flats are sorted by processed_at and id, so the next page starts after it
+type FlatsCursor struct {
+	ProcessedAt time.Time
+	ID          string
+}
+
+// FlatOptions changes how FlatArray process the array.
+// MaxDepth is the max depth allowed for the array, MaxElements the max number of
+// values and arrays inside it and MaxBodySize the max bytes read by FlatArrayStream,
+// zero means no limit. Objects is what to do with the objects inside the array.
+// Depth is the number of levels to flat, nil flats all of them, see Graph.ToFlatDepth.
+// WithShape, WithPaths and WithStats add the shape, the paths of the values
+// and the statistics to the FlatResponse. IdempotencyKey is the Idempotency-Key
+// of the request, it is only used when the FlatInfo is saved. CallbackURL is where
+// the FlatResponse is sent after it is saved, see Callbacks
+type FlatOptions struct {
+	MaxDepth       int
+	MaxElements    int
+	MaxBodySize    int64
+	Objects        ObjectMode
+	Depth          *int
+	WithShape      bool
+	WithPaths      bool
+	WithStats      bool
+	IdempotencyKey string
+	CallbackURL    string
+}
+
+// ObjectMode tells FlatArray what to do with the objects inside the array
+type ObjectMode string
+
+const (
+	// ObjectsReject returns a bad request, it is the default mode
+	ObjectsReject ObjectMode = "reject"
+	// ObjectsLeaf keeps the object as a value of the flatted array
+	ObjectsLeaf ObjectMode = "leaf"
+	// ObjectsFlatten replaces the object with an object of one level, where
+	// the keys are the paths of the values, e.g: {"a.b[0]": 1}
+	ObjectsFlatten ObjectMode = "flatten"
+)
+
+// the types of input that a FlatInfo can have
+const (
+	FlatTypeArray    = "array"
+	FlatTypeDocument = "document"
+)
+
+// FlatInfo represents the structure to be saved in the db.
+// Type is one of the FlatType constants, it is empty for the arrays saved by older versions.
+// FlatDepth is the number of levels flatted, nil when all of them were flatted.
+// Stats is only calculated for the arrays.
+// FormatVersion is the layout of the saved Graph, VertexSecuence for FormatVertexSecuence
+// and Compact for FormatCompact. It is empty for the flats saved by older versions.
+// Hash identifies the content, two FlatInfos with the same input and options have the
+// same Hash, see contentHash. It is unique in the storage and empty in the older flats.
+// IdempotencyKeys are the keys of the requests that saved or deduplicated the FlatInfo
 type FlatInfo struct {
-	ID             string           `json:"id" bson:"_id,omitempty"`
-	Graph          *Graph           `bson:"-"`
-	VertexSecuence []VertexSecuence `bson:"vertex_secuence"`
-	MaxDepth       int              `bson:"max_depth"`
-	ProcessedAt    time.Time        `bson:"processed_at"`
+	ID              string           `json:"id" bson:"_id,omitempty"`
+	Type            string           `bson:"type,omitempty"`
+	Hash            string           `bson:"hash,omitempty"`
+	Graph           *Graph           `bson:"-"`
+	FormatVersion   int              `bson:"format_version,omitempty"`
+	VertexSecuence  []VertexSecuence `bson:"vertex_secuence,omitempty"`
+	Compact         *CompactGraph    `bson:"compact,omitempty"`
+	MaxDepth        int              `bson:"max_depth"`
+	FlatDepth       *int             `bson:"flat_depth,omitempty"`
+	Stats           *FlatStats       `bson:"stats,omitempty"`
+	ProcessedAt     time.Time        `bson:"processed_at"`
+	IdempotencyKeys []IdempotencyKey `bson:"idempotency_keys,omitempty"`
+}
+
+// IdempotencyKey is the Idempotency-Key of a request to POST /flats.
+// Until ExpiresAt, the requests with the same key get the response of the first one,
+// Deduplicated is the flag returned to it. Options is the fingerprint of the options
+// of that request, see FlatOptions.fingerprint, it is empty in the older keys
+type IdempotencyKey struct {
+	Key          string    `bson:"key"`
+	ExpiresAt    time.Time `bson:"expires_at"`
+	Deduplicated bool      `bson:"deduplicated,omitempty"`
+	Options      string    `bson:"options,omitempty"`
 }
 
 // Graph contains all the information about the array
@@ -37,19 +233,35 @@ type FlatInfo struct {
 type Graph struct {
 	Vertices map[int]*Vertex
 	directed bool
+	edges    map[EdgeSecuence]bool
 }
 
-// Vertex represents the nodes in the Graph and the connection between each other
+// NodeKind tells if a Vertex holds a value of the array, an array itself
+// or an object that was flatted
+type NodeKind int
+
+const (
+	ValueNode NodeKind = iota
+	ArrayNode
+	ObjectNode
+)
+
+// Vertex represents the nodes in the Graph and the connection between each other.
+// Vertices keeps the neighbors in the same order they were connected.
+// Name is the key of the Vertex when the father is an ObjectNode
 type Vertex struct {
 	Key      int
+	Kind     NodeKind
+	Name     string
 	Value    interface{}
-	Vertices map[int]*Vertex
+	Vertices []*Vertex
 }
 
 // VertexSecuence contains all the nodes information to restore the flatted array
 // with the EdgeSecuence
 type VertexSecuence struct {
 	Key      int      `bson:"key"`
+	Name     string   `bson:"name,omitempty"`
 	DataInfo DataInfo `bson:"data"`
 	Edges    []int    `json:"edges"`
 }
@@ -60,26 +272,67 @@ type EdgeSecuence struct {
 	To   int `bson:"to"`
 }
 
-// DataInfo represents the information of the value of the array node
+// DataInfo represents the information of the value of the array node.
+// DataType is one of the DataType constants and DataValue is the value
+// encoded as string, so it can be restored without losing precision
 type DataInfo struct {
 	DataType  string `bson:"type"`
 	DataValue string `bson:"value"`
 }
 
+// the types that a DataInfo can have
+const (
+	DataTypeNull    = "null"
+	DataTypeBool    = "bool"
+	DataTypeInteger = "integer"
+	DataTypeNumber  = "number"
+	DataTypeString  = "string"
+	DataTypeArray   = "array"
+	// DataTypeObject is an object kept as a value, the DataValue is the object as JSON
+	DataTypeObject = "object"
+	// DataTypeObjectNode is an object that was flatted, its keys are the names of the edges
+	DataTypeObjectNode = "object_node"
+
+	// saved by older versions with the go type of the value, an empty type
+	// was used for nulls and arrays
+	legacyDataTypeFloat = "float64"
+	legacyDataTypeEmpty = ""
+)
+
+// the characters of a shape returned by Graph.Shape
+const (
+	shapeValue = '*'
+	shapeOpen  = '['
+	shapeClose = ']'
+)
+
 /* CONSTRUCTORS */
 
 func NewVertex(key int, value interface{}) *Vertex {
 	return &Vertex{
 		Key:      key,
 		Value:    value,
-		Vertices: map[int]*Vertex{},
+		Vertices: make([]*Vertex, 0),
 	}
 }
 
+func NewArrayVertex(key int) *Vertex {
+	v := NewVertex(key, nil)
+	v.Kind = ArrayNode
+	return v
+}
+
+func NewObjectVertex(key int) *Vertex {
+	v := NewVertex(key, nil)
+	v.Kind = ObjectNode
+	return v
+}
+
 func NewDirectedGraph() *Graph {
 	return &Graph{
 		Vertices: map[int]*Vertex{},
 		directed: true,
+		edges:    map[EdgeSecuence]bool{},
 	}
 }
 
@@ -87,93 +340,400 @@ func NewDirectedGraph() *Graph {
 
 // ToArray will build the array with the information in the Graph
 func (g *Graph) ToArray() []interface{} {
-	res := make([]interface{}, 0)
-	for _, v := range g.Vertices[0].Vertices {
-		vtxRes := v.ToArray()
-		res = append(res, vtxRes)
-	}
+	root := g.Vertices[0]
+	res := make([]interface{}, len(root.Vertices))
+	fillContainers([]containerItem{{vertex: root, value: res}})
 	return res
 }
 
 // ToArray is called by Graph to build the array
 func (v *Vertex) ToArray() interface{} {
-	if len(v.Vertices) <= 0 {
-		return v.Value
+	val, isContainer := v.newValue()
+	if isContainer {
+		fillContainers([]containerItem{{vertex: v, value: val}})
 	}
+	return val
+}
 
-	res := make([]interface{}, 0)
-	for _, neighbor := range v.Vertices {
-		val := neighbor.ToArray()
-		res = append(res, val)
+// containerItem is an array or object built by ToArray that
+// must be filled with the values of the neighbors of the Vertex
+type containerItem struct {
+	vertex *Vertex
+	value  interface{}
+}
+
+// newValue returns the value of the Vertex for ToArray. The arrays and objects are
+// returned with the size of the neighbors and true, so they are filled later
+func (v *Vertex) newValue() (interface{}, bool) {
+	switch {
+	case v.IsObject():
+		return make(map[string]interface{}, len(v.Vertices)), true
+	case v.IsArray():
+		return make([]interface{}, len(v.Vertices)), true
+	}
+	return v.Value, false
+}
+
+// fillContainers fills the arrays and objects in the stack and the ones inside them.
+// It uses an explicit stack instead of recursion, so deep arrays can not overflow it.
+// The arrays are filled by index, so it is safe to fill them after being added to the father
+func fillContainers(stack []containerItem) {
+	for len(stack) > 0 {
+		item := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		for i, neighbor := range item.vertex.Vertices {
+			val, isContainer := neighbor.newValue()
+			switch container := item.value.(type) {
+			case []interface{}:
+				container[i] = val
+			case map[string]interface{}:
+				container[neighbor.Name] = val
+			}
+			if isContainer {
+				stack = append(stack, containerItem{vertex: neighbor, value: val})
+			}
+		}
 	}
+}
 
+// ToDocument will build the document with the information in the Graph,
+// the root can be an object or an array
+func (g *Graph) ToDocument() interface{} {
+	return g.Vertices[0].ToArray()
+}
+
+// ToFlatDocument will return the values of the document with their paths as keys
+func (g *Graph) ToFlatDocument() map[string]interface{} {
+	res := make(map[string]interface{})
+	g.Vertices[0].flatObject("", res)
 	return res
 }
 
 // ToFlat will return the flatted array with the Graph information
 func (g *Graph) ToFlat() []interface{} {
-	res := make([]interface{}, 0)
-	for _, v := range g.Vertices[0].Vertices {
-		vtxRes := v.ToFlat()
-		d, ok := vtxRes.([]interface{})
-		if ok {
-			res = append(res, d...)
-		} else {
-			res = append(res, vtxRes)
-		}
-	}
-	return res
+	return g.Vertices[0].flatDepth(-1)
 }
 
 // ToFlat is called by Graph to build the flaated array
 func (v *Vertex) ToFlat() interface{} {
-	if len(v.Vertices) <= 0 {
-		return v.Value
+	switch {
+	case v.IsObject():
+		res := make(map[string]interface{})
+		v.flatObject("", res)
+		return res
+	case v.IsArray():
+		return v.flatDepth(-1)
 	}
+	return v.Value
+}
 
-	res := make([]interface{}, 0)
-	for _, neighbor := range v.Vertices {
-		val := neighbor.ToFlat()
-		d, ok := val.([]interface{})
-		if ok {
-			res = append(res, d...)
-		} else {
-			res = append(res, val)
+// ToFlatDepth will return the array flatted only until the given depth, the deeper
+// arrays are kept as values like Array.prototype.flat in JavaScript.
+// e.g: [1,[2,[3]]] with depth 1 is [1,2,[3]]. A negative depth flats all the levels
+func (g *Graph) ToFlatDepth(depth int) []interface{} {
+	return g.Vertices[0].flatDepth(depth)
+}
+
+// depthItem is a Vertex waiting in the stack of a traversal, with the depth
+// that can still be visited below it
+type depthItem struct {
+	vertex *Vertex
+	depth  int
+}
+
+// pushNeighbors adds the neighbors of the Vertex to the stack in reverse order,
+// so they are taken from the stack in the same order they are in the array
+func pushNeighbors(stack []depthItem, v *Vertex, depth int) []depthItem {
+	for i := len(v.Vertices) - 1; i >= 0; i-- {
+		stack = append(stack, depthItem{vertex: v.Vertices[i], depth: depth})
+	}
+	return stack
+}
+
+// flatDepth is called by Graph, it returns the neighbors of the Vertex
+// with the arrays spread until the depth, a negative one has no limit
+func (v *Vertex) flatDepth(depth int) []interface{} {
+	res := make([]interface{}, 0, len(v.Vertices))
+	v.walkFlatDepth(depth, func(val interface{}) error {
+		res = append(res, val)
+		return nil
+	})
+	return res
+}
+
+// WalkFlatDepth calls fn with every value of ToFlatDepth in the same order, without
+// building the flatted array. It stops with the first error of fn and returns it
+func (g *Graph) WalkFlatDepth(depth int, fn func(val interface{}) error) error {
+	return g.Vertices[0].walkFlatDepth(depth, fn)
+}
+
+// walkFlatDepth is called by flatDepth and WalkFlatDepth, it visits the values
+// of the flatted neighbors of the Vertex one by one
+func (v *Vertex) walkFlatDepth(depth int, fn func(val interface{}) error) error {
+	stack := pushNeighbors(nil, v, depth)
+	for len(stack) > 0 {
+		item := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		var err error
+		switch {
+		case item.vertex.IsArray() && item.depth != 0:
+			stack = pushNeighbors(stack, item.vertex, item.depth-1)
+		case item.vertex.IsArray():
+			err = fn(item.vertex.ToArray())
+		default:
+			err = fn(item.vertex.ToFlat())
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Paths returns where every value of ToFlatDepth was in the array, in the same order.
+// The path is built with the position of the edges from the root to the value.
+// The stack has the arrays that are being visited, so the path of a value is
+// the position of the next neighbor of every one of them
+func (g *Graph) Paths(depth int) []ValuePath {
+	type pathFrame struct {
+		vertex *Vertex
+		next   int
+	}
+
+	res := make([]ValuePath, 0)
+	stack := []pathFrame{{vertex: g.Vertices[0]}}
+	for len(stack) > 0 {
+		top := &stack[len(stack)-1]
+		if top.next == len(top.vertex.Vertices) {
+			stack = stack[:len(stack)-1]
+			if len(stack) > 0 {
+				stack[len(stack)-1].next++
+			}
+			continue
+		}
+
+		neighbor := top.vertex.Vertices[top.next]
+		if neighbor.IsArray() && (depth < 0 || len(stack) <= depth) {
+			stack = append(stack, pathFrame{vertex: neighbor})
+			continue
+		}
+
+		path := make([]int, len(stack))
+		for i, frame := range stack {
+			path[i] = frame.next
 		}
+		res = append(res, ValuePath{Path: path, Depth: len(path) - 1})
+		top.next++
 	}
 	return res
 }
 
+// Stats returns the statistics of the array. The objects are counted as a
+// single value and the root array is not counted as a sub-array
+func (g *Graph) Stats() *FlatStats {
+	stats := &FlatStats{
+		Types:  map[string]int{},
+		Depths: make([]int, 0),
+	}
+
+	stack := pushNeighbors(nil, g.Vertices[0], 0)
+	for len(stack) > 0 {
+		item := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		// here the depth is the one of the item, it grows going down
+		for len(stats.Depths) <= item.depth {
+			stats.Depths = append(stats.Depths, 0)
+		}
+		stats.Depths[item.depth]++
+
+		if item.vertex.IsArray() {
+			stats.SubArrays++
+			if len(item.vertex.Vertices) == 0 {
+				stats.EmptyArrays++
+			}
+			stack = pushNeighbors(stack, item.vertex, item.depth+1)
+			continue
+		}
+
+		stats.Leaves++
+		valueType := item.vertex.valueType()
+		if valueType == DataTypeNull {
+			stats.Nulls++
+		}
+		stats.Types[valueType]++
+	}
+	return stats
+}
+
+// valueType returns the type of the value for the FlatStats
+func (v *Vertex) valueType() string {
+	if v.IsObject() {
+		return DataTypeObject
+	}
+
+	switch v.Value.(type) {
+	case nil:
+		return DataTypeNull
+	case bool:
+		return DataTypeBool
+	case string:
+		return DataTypeString
+	case map[string]interface{}, json.RawMessage:
+		return DataTypeObject
+	default:
+		return DataTypeNumber
+	}
+}
+
+// Shape returns the structure of the array as a string, where every value of the
+// flatted array is a * and every array is written with its brackets,
+// e.g: [1,[2,[]],3] has the shape [*[*[]]*]. The objects are a single value
+func (g *Graph) Shape() string {
+	return g.ShapeDepth(-1)
+}
+
+// ShapeDepth is like Shape for the array returned by ToFlatDepth, the arrays
+// deeper than depth are a single value. A negative depth is the same as Shape
+func (g *Graph) ShapeDepth(depth int) string {
+	var b strings.Builder
+	b.WriteByte(shapeOpen)
+
+	// a nil vertex in the stack closes an array
+	stack := pushNeighbors(nil, g.Vertices[0], depth)
+	for len(stack) > 0 {
+		item := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		switch {
+		case item.vertex == nil:
+			b.WriteByte(shapeClose)
+		case item.vertex.IsArray() && item.depth != 0:
+			b.WriteByte(shapeOpen)
+			stack = append(stack, depthItem{})
+			stack = pushNeighbors(stack, item.vertex, item.depth-1)
+		default:
+			b.WriteByte(shapeValue)
+		}
+	}
+
+	b.WriteByte(shapeClose)
+	return b.String()
+}
+
+// flatObject adds to res the values inside the Vertex with their paths as keys.
+// The names of the objects are joined with dots and the arrays add the index, e.g: a.b[0],
+// see objectKeyPath for the names that can not be joined.
+// The empty arrays and objects are kept as values, so the path is not lost
+func (v *Vertex) flatObject(path string, res map[string]interface{}) {
+	type pathItem struct {
+		vertex *Vertex
+		path   string
+	}
+
+	stack := []pathItem{{vertex: v, path: path}}
+	for len(stack) > 0 {
+		item := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		for i, neighbor := range item.vertex.Vertices {
+			neighborPath := fmt.Sprintf("%s[%d]", item.path, i)
+			if item.vertex.IsObject() {
+				neighborPath = objectKeyPath(item.path, neighbor.Name)
+			}
+
+			switch {
+			case (neighbor.IsObject() || neighbor.IsArray()) && len(neighbor.Vertices) > 0:
+				stack = append(stack, pathItem{vertex: neighbor, path: neighborPath})
+			case neighbor.IsObject():
+				res[neighborPath] = map[string]interface{}{}
+			case neighbor.IsArray():
+				res[neighborPath] = []interface{}{}
+			default:
+				res[neighborPath] = neighbor.Value
+			}
+		}
+	}
+}
+
+// pathSpecialChars are the characters of the paths of flatObject
+const pathSpecialChars = `.[]"\`
+
+// objectKeyPath returns the path of the key of the object in path. The empty keys and the ones
+// with pathSpecialChars are written quoted between brackets, e.g: {"a.b":1} is ["a.b"],
+// so they never collide with the path of a nested object like {"a":{"b":1}}
+func objectKeyPath(path string, key string) string {
+	if key == "" || strings.ContainsAny(key, pathSpecialChars) {
+		var b strings.Builder
+		encoder := json.NewEncoder(&b)
+		encoder.SetEscapeHTML(false)
+		encoder.Encode(key)
+		return path + "[" + strings.TrimSuffix(b.String(), "\n") + "]"
+	}
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
 // GetVertexSecuence build the secuence necesary to be saved in db to be use
-// to rebuild the Graph and the array
-func (g *Graph) GetVertexSecuence() []VertexSecuence {
-	vtxSecuence := make([]VertexSecuence, 0)
-	for _, v := range g.Vertices {
-		vtxSecuence = append(vtxSecuence, v.GetVertexSecuence())
+// to rebuild the Graph and the array. The secuence is sorted by key
+func (g *Graph) GetVertexSecuence() ([]VertexSecuence, apierrors.RestErr) {
+	vtxSecuence := make([]VertexSecuence, 0, len(g.Vertices))
+	for _, k := range g.sortedKeys() {
+		vs, err := g.Vertices[k].GetVertexSecuence()
+		if err != nil {
+			return nil, err
+		}
+		vtxSecuence = append(vtxSecuence, vs)
 	}
-	return vtxSecuence
+	return vtxSecuence, nil
 }
 
-// GetVertexSecuence is called by Graph
-func (v *Vertex) GetVertexSecuence() VertexSecuence {
-	var dt, dv string
-	var err error
-	if v.Value != nil {
-		dt, dv, err = getTypeAndValueStringFromInterface(v.Value)
+func (g *Graph) sortedKeys() []int {
+	keys := make([]int, 0, len(g.Vertices))
+	for k := range g.Vertices {
+		keys = append(keys, k)
 	}
-	// TODO: return apierrors?
-	if err != nil {
-		panic(err)
+	sort.Ints(keys)
+	return keys
+}
+
+// IsArray returns true when the Vertex is an array, even an empty one.
+// The value nodes with neighbors are arrays saved by older versions
+func (v *Vertex) IsArray() bool {
+	return v.Kind == ArrayNode || (v.Kind == ValueNode && len(v.Vertices) > 0)
+}
+
+// IsObject returns true when the Vertex is a flatted object, even an empty one
+func (v *Vertex) IsObject() bool {
+	return v.Kind == ObjectNode
+}
+
+// GetVertexSecuence is called by Graph, it returns an error when the value has a type
+// that can not be saved
+func (v *Vertex) GetVertexSecuence() (VertexSecuence, apierrors.RestErr) {
+	di := DataInfo{DataType: DataTypeArray}
+	if v.IsObject() {
+		di = DataInfo{DataType: DataTypeObjectNode}
+	} else if !v.IsArray() {
+		var err error
+		if di, err = newDataInfo(v.Value); err != nil {
+			return VertexSecuence{}, apierrors.NewInternalServerError(fmt.Sprintf("error saving the value of vertex %d: %s", v.Key, err.Error()))
+		}
 	}
 	vs := VertexSecuence{
 		Key:      v.Key,
-		DataInfo: DataInfo{DataType: dt, DataValue: dv},
-		Edges:    make([]int, 0),
+		Name:     v.Name,
+		DataInfo: di,
+		Edges:    make([]int, 0, len(v.Vertices)),
 	}
 	for _, neighbor := range v.Vertices {
 		vs.Edges = append(vs.Edges, neighbor.Key)
 	}
-	return vs
+	return vs, nil
 }
 
 // AddVertex creates a new Vertex and added to the Graph
@@ -182,25 +742,34 @@ func (g *Graph) AddVertex(key int, val interface{}) {
 	g.Vertices[key] = v
 }
 
+// AddArrayVertex creates a new Vertex for an array and added to the Graph
+func (g *Graph) AddArrayVertex(key int) {
+	g.Vertices[key] = NewArrayVertex(key)
+}
+
+// AddObjectVertex creates a new Vertex for a flatted object and added to the Graph
+func (g *Graph) AddObjectVertex(key int) {
+	g.Vertices[key] = NewObjectVertex(key)
+}
+
 // AddEdge connect to Vertex
 func (g *Graph) AddEdge(k1, k2 int) error {
 	v1 := g.Vertices[k1]
 	v2 := g.Vertices[k2]
 
-	// TODO: return apierrors ?
 	if v1 == nil || v2 == nil {
 		return errors.New("not all vertices exists")
 	}
 
 	// is already connected
-	if _, ok := v1.Vertices[v2.Key]; ok {
+	if g.edges[EdgeSecuence{From: v1.Key, To: v2.Key}] {
 		return nil
 	}
 
 	// check if is undirected
-	v1.Vertices[v2.Key] = v2
-	if !g.directed && v1.Key != v2.Key {
-		v2.Vertices[v1.Key] = v1
+	g.connect(v1, v2)
+	if !g.directed && v1.Key != v2.Key && !g.edges[EdgeSecuence{From: v2.Key, To: v1.Key}] {
+		g.connect(v2, v1)
 	}
 
 	// add the vertices to the graph vertex map
@@ -209,18 +778,37 @@ func (g *Graph) AddEdge(k1, k2 int) error {
 	return nil
 }
 
-// toInterface rebuild the original value of in the array
+// connect appends v2 to the neighbors of v1 keeping the insertion order
+func (g *Graph) connect(v1, v2 *Vertex) {
+	v1.Vertices = append(v1.Vertices, v2)
+	g.edges[EdgeSecuence{From: v1.Key, To: v2.Key}] = true
+}
+
+// toInterface rebuild the original value of in the array.
+// Numbers are restored as json.Number so they are written exactly as they were received
 func (di DataInfo) toInterface() (interface{}, error) {
 	var convertedValue interface{}
 	var err error
 
 	switch di.DataType {
-	case "float64":
-		convertedValue, err = strconv.ParseFloat(di.DataValue, 64)
-	case "bool":
-		convertedValue, err = strconv.ParseBool(di.DataValue)
-	case "": // in a v2, this should be improved by checking 'nil' or 'array' like an special data type and value
+	case DataTypeNull, DataTypeArray, DataTypeObjectNode, legacyDataTypeEmpty:
 		convertedValue = nil
+	case DataTypeBool:
+		convertedValue, err = strconv.ParseBool(di.DataValue)
+	case DataTypeInteger, DataTypeNumber:
+		if !isValidNumber(di.DataValue) {
+			err = fmt.Errorf("invalid number %q", di.DataValue)
+		} else {
+			convertedValue = json.Number(di.DataValue)
+		}
+	case DataTypeObject:
+		if !json.Valid([]byte(di.DataValue)) {
+			err = fmt.Errorf("invalid object %q", di.DataValue)
+		} else {
+			convertedValue = json.RawMessage(di.DataValue)
+		}
+	case legacyDataTypeFloat:
+		convertedValue, err = strconv.ParseFloat(di.DataValue, 64)
 	default:
 		convertedValue = di.DataValue
 	}
@@ -232,84 +820,384 @@ func (di DataInfo) toInterface() (interface{}, error) {
 
 /* FUNCTIONS */
 
-// FlatArray it receive an input array an recursive will find
+// Encode returns the cursor as an opaque token for the clients
+func (fc FlatsCursor) Encode() string {
+	raw := fmt.Sprintf("%d_%s", fc.ProcessedAt.UnixNano(), fc.ID)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// DecodeFlatsCursor parse the token returned by FlatsCursor.Encode
+func DecodeFlatsCursor(token string) (*FlatsCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+
+	parts := strings.SplitN(string(raw), "_", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, errors.New("invalid cursor")
+	}
+
+	nanos, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+
+	return &FlatsCursor{
+		ProcessedAt: time.Unix(0, nanos).UTC(),
+		ID:          parts[1],
+	}, nil
+}
+
+// FlatArray it receive an input array and will find
 // the max depth of the array and will build a Graph. This info is wrapped
-// in a FlatInfo
-func FlatArray(input []interface{}) (FlatInfo, apierrors.RestErr) {
-	g := NewDirectedGraph()
+// in a FlatInfo. The objects are processed with the opts.Objects mode and
+// only the arrays are counted in the depth
+func FlatArray(input []interface{}, opts FlatOptions) (FlatInfo, apierrors.RestErr) {
+	if err := validateArrayOptions(opts); err != nil {
+		return FlatInfo{}, err
+	}
 
-	var node int
-	var maxDepth int
-	g.AddVertex(node, nil)
+	fi, err := flatValue(input, opts)
+	if err != nil {
+		return FlatInfo{}, err
+	}
+	return arrayFlatInfo(fi, opts), nil
+}
 
-	// this callback func  will create the nodes and added the connections
-	// to build the Graph. Also will track the max depth
-	cb := func(father int, depth int, val interface{}) (int, apierrors.RestErr) {
-		if depth > maxDepth {
-			maxDepth = depth
-		}
+// validateArrayOptions returns a bad request if the options of FlatArray are not valid
+func validateArrayOptions(opts FlatOptions) apierrors.RestErr {
+	switch opts.Objects {
+	case "", ObjectsReject, ObjectsLeaf, ObjectsFlatten:
+	default:
+		return apierrors.NewBadRequestError(fmt.Sprintf("invalid objects mode %q", opts.Objects))
+	}
 
-		var data interface{}
-		if _, ok := val.([]interface{}); !ok {
-			switch val.(type) {
-			case map[string]interface{}:
-				return 0, apierrors.NewBadRequestError("object is not a valid value inside an array")
-			}
-			data = val
-		}
+	if opts.Depth != nil && *opts.Depth < 0 {
+		return apierrors.NewBadRequestError("the depth must be greater or equal than zero")
+	}
+	return nil
+}
 
-		// every this cb is execute, it means that it is in a node value inside the array
-		// so add a vertex (node) to the Graph and the connection with father-son relation
-		// e.g: after added 1 to node, this is the father for the next iteration and the "father"
-		// is the node in the before iteration
-		node++
-		g.AddVertex(node, data)
-		if err := g.AddEdge(father, node); err != nil {
-			return 0, apierrors.NewInternalServerError(err.Error())
-		}
+// arrayFlatInfo adds to the FlatInfo of an array the fields that are only for arrays
+func arrayFlatInfo(fi FlatInfo, opts FlatOptions) FlatInfo {
+	fi.Type = FlatTypeArray
+	fi.Stats = fi.Graph.Stats()
+	if opts.Depth != nil {
+		depth := *opts.Depth
+		fi.FlatDepth = &depth
+	}
+	fi.Hash = contentHash(fi)
+	return fi
+}
 
-		return node, nil
+// FlatDocument is like FlatArray but the input can be an object too.
+// All the objects inside are flatted, so the Graph can be returned as
+// an object with the paths of the values as keys. The depth is counted in the same way
+func FlatDocument(input interface{}, opts FlatOptions) (FlatInfo, apierrors.RestErr) {
+	switch input.(type) {
+	case map[string]interface{}, []interface{}:
+	default:
+		return FlatInfo{}, apierrors.NewBadRequestError("the document must be an object or an array")
 	}
 
+	opts.Objects = ObjectsFlatten
+	fi, err := flatValue(input, opts)
+	if err != nil {
+		return FlatInfo{}, err
+	}
+	fi.Type = FlatTypeDocument
+	fi.Hash = contentHash(fi)
+	return fi, nil
+}
+
+// flatValue builds the Graph of an array or an object, that is the zero node
+func flatValue(input interface{}, opts FlatOptions) (FlatInfo, apierrors.RestErr) {
+	_, isObject := input.(map[string]interface{})
+	b := newGraphBuilder(isObject, opts)
+
 	// start from zero node by default
-	if err := buildGraphRecursive(input, 0, 0, cb); err != nil {
+	if err := buildGraph(input, 0, 0, opts.Objects == ObjectsFlatten, b.add); err != nil {
 		return FlatInfo{}, err
 	}
+	return b.flatInfo()
+}
+
+// contentHash returns the hex SHA-256 of the content of a FlatInfo built by flatValue.
+// The CompactGraph is a canonical encoding of the input, the keys of the objects are
+// sorted and the numbers are kept as they were sent, so the same input always has the
+// same hash. The type and the flatted depth are added because they change the result
+func contentHash(fi FlatInfo) string {
+	var depth interface{}
+	if fi.FlatDepth != nil {
+		depth = *fi.FlatDepth
+	}
+	// a JSON array keeps every part apart from the others
+	content, _ := json.Marshal([]interface{}{fi.Type, depth, fi.Compact.Structure, fi.Compact.Values, fi.Compact.Names})
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// fingerprint returns the hex SHA-256 of the options that change the FlatResponse, so
+// two requests with the same Idempotency-Key can be compared. The limits come from the
+// config and the callback_url is not in the response, so they are not part of it
+func (opts FlatOptions) fingerprint() string {
+	var depth interface{}
+	if opts.Depth != nil {
+		depth = *opts.Depth
+	}
+	content, _ := json.Marshal([]interface{}{opts.Objects, depth, opts.WithShape, opts.WithPaths, opts.WithStats})
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// graphBuilder creates the nodes of a Graph and their connections in the same
+// order the values are found. It also tracks the max depth and the number of elements
+type graphBuilder struct {
+	graph    *Graph
+	opts     FlatOptions
+	node     int
+	maxDepth int
+}
+
+// newGraphBuilder returns a graphBuilder with the zero node, an object or an array
+func newGraphBuilder(isObject bool, opts FlatOptions) *graphBuilder {
+	g := NewDirectedGraph()
+	if isObject {
+		g.AddObjectVertex(0)
+	} else {
+		g.AddArrayVertex(0)
+	}
+	return &graphBuilder{graph: g, opts: opts}
+}
+
+// add is the graphCallback that creates the node of the value and connects it with
+// the father. An empty []interface{} creates an array node where the values are added later
+func (b *graphBuilder) add(father int, name string, depth int, val interface{}) (int, apierrors.RestErr) {
+	if b.opts.MaxDepth > 0 && depth > b.opts.MaxDepth {
+		return 0, maxDepthError(b.opts.MaxDepth)
+	}
+	if b.opts.MaxElements > 0 && b.node >= b.opts.MaxElements {
+		return 0, maxElementsError(b.opts.MaxElements)
+	}
+	if depth > b.maxDepth {
+		b.maxDepth = depth
+	}
+
+	// every time this is executed, it means that it is in a node value inside the array
+	// so add a vertex (node) to the Graph and the connection with father-son relation
+	// e.g: after added 1 to node, this is the father for the next iteration and the "father"
+	// is the node in the before iteration
+	_, isObject := val.(map[string]interface{})
+	_, isArray := val.([]interface{})
+	switch {
+	case isArray:
+		b.node++
+		b.graph.AddArrayVertex(b.node)
+	case isObject && b.opts.Objects == ObjectsFlatten:
+		b.node++
+		b.graph.AddObjectVertex(b.node)
+	case isObject && b.opts.Objects != ObjectsLeaf:
+		return 0, objectNotAllowedError()
+	default:
+		if _, err := newDataInfo(val); err != nil {
+			return 0, apierrors.NewBadRequestError(err.Error())
+		}
+		b.node++
+		b.graph.AddVertex(b.node, val)
+	}
+	b.graph.Vertices[b.node].Name = name
+	if err := b.graph.AddEdge(father, b.node); err != nil {
+		return 0, apierrors.NewInternalServerError(err.Error())
+	}
+
+	return b.node, nil
+}
+
+// flatInfo returns the FlatInfo with the Graph built, it is saved in the FormatCompact layout
+func (b *graphBuilder) flatInfo() (FlatInfo, apierrors.RestErr) {
+	compact, err := b.graph.Compact()
+	if err != nil {
+		return FlatInfo{}, apierrors.NewInternalServerError(fmt.Sprintf("error compacting the graph: %s", err.Error()))
+	}
 
 	return FlatInfo{
-		Graph:          g,
-		VertexSecuence: g.GetVertexSecuence(),
-		MaxDepth:       maxDepth,
-		ProcessedAt:    time.Now().UTC(),
+		Graph:         b.graph,
+		FormatVersion: FormatCompact,
+		Compact:       compact,
+		MaxDepth:      b.maxDepth,
+		ProcessedAt:   time.Now().UTC(),
 	}, nil
 }
 
-func buildGraphRecursive(data []interface{}, father int, depth int, cb func(int, int, interface{}) (int, apierrors.RestErr)) apierrors.RestErr {
-	for _, v := range data {
-		var d int
+// graphCallback is called with every value found by buildGraph and returns its node.
+// The name is the key of the value when the father is an object
+type graphCallback func(father int, name string, depth int, val interface{}) (int, apierrors.RestErr)
+
+// graphItem is a value waiting in the stack of buildGraph. The depth is
+// the one of the array or object where the value is
+type graphItem struct {
+	value  interface{}
+	name   string
+	father int
+	depth  int
+}
 
-		// if it is an array, add one to depth
-		// call the function again to go more in depth and pass the info
-		// to the next iteration
-		parsed, ok := v.([]interface{})
-		if ok {
-			d = depth + 1
+// buildGraph calls cb with every value inside data, that can be an array or an object.
+// The values are connected to the father node and depth is the one of data.
+// It goes inside the arrays and, if expandObjects is true, inside the objects too.
+// The values are visited in the same order they are in data, with an explicit stack
+// instead of recursion. The keys of the objects are visited sorted, so the Graph is always the same
+func buildGraph(data interface{}, father int, depth int, expandObjects bool, cb graphCallback) apierrors.RestErr {
+	stack := pushGraphItems(nil, data, father, depth)
+	for len(stack) > 0 {
+		item := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		// if it is an array, add one to depth and its values are pushed to visit them
+		// after it. The objects keep the depth of the array where they are
+		var d int
+		_, isArray := item.value.([]interface{})
+		_, isObject := item.value.(map[string]interface{})
+		expand := isArray || (isObject && expandObjects)
+		switch {
+		case isArray:
+			d = item.depth + 1
+		case expand:
+			d = item.depth
 		}
 
-		// current will be the father for the next iteration and actual father is for the current
-		current, err := cb(father, d, v)
+		// current will be the father of the values inside it
+		current, err := cb(item.father, item.name, d, item.value)
 		if err != nil {
 			return err
 		}
-		if ok {
-			if err := buildGraphRecursive(parsed, current, d, cb); err != nil {
-				return err
-			}
+		if expand {
+			stack = pushGraphItems(stack, item.value, current, d)
 		}
 	}
 	return nil
 }
 
+// pushGraphItems adds the values of the array or object to the stack in reverse order,
+// so they are taken from the stack in order
+func pushGraphItems(stack []graphItem, data interface{}, father int, depth int) []graphItem {
+	switch parsed := data.(type) {
+	case []interface{}:
+		for i := len(parsed) - 1; i >= 0; i-- {
+			stack = append(stack, graphItem{value: parsed[i], father: father, depth: depth})
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(parsed))
+		for k := range parsed {
+			keys = append(keys, k)
+		}
+		sort.Sort(sort.Reverse(sort.StringSlice(keys)))
+		for _, k := range keys {
+			stack = append(stack, graphItem{value: parsed[k], name: k, father: father, depth: depth})
+		}
+	}
+	return stack
+}
+
+// maxDepthError is returned when an array is deeper than the max depth allowed
+func maxDepthError(maxDepth int) apierrors.RestErr {
+	return apierrors.NewBadRequestError(fmt.Sprintf("the array exceeds the max depth allowed of %d", maxDepth))
+}
+
+// maxElementsError is returned when an array has more elements than allowed
+func maxElementsError(maxElements int) apierrors.RestErr {
+	return apierrors.NewRequestEntityTooLargeError(fmt.Sprintf("the array exceeds the max elements allowed of %d", maxElements))
+}
+
+// objectNotAllowedError is returned when there is an object inside an array and the objects are rejected
+func objectNotAllowedError() apierrors.RestErr {
+	return apierrors.NewBadRequestError("object is not a valid value inside an array")
+}
+
+// Unflat rebuilds the original array from the flatted array and its shape,
+// see Graph.Shape. The values of the flatted array are placed in order
+// where the shape has a *, so the shape must have one * for every value.
+// It returns a bad request as soon as an array is deeper than maxDepth, zero means no limit
+func Unflat(flatted []interface{}, shape string, maxDepth int) ([]interface{}, apierrors.RestErr) {
+	if shape == "" || shape[0] != shapeOpen {
+		return nil, apierrors.NewBadRequestError("the shape must start with [")
+	}
+
+	var res []interface{}
+	var next int
+	stack := make([][]interface{}, 0)
+	for i := 0; i < len(shape); i++ {
+		if res != nil {
+			return nil, apierrors.NewBadRequestError(fmt.Sprintf("unexpected %q at position %d of the shape", shape[i], i))
+		}
+
+		switch shape[i] {
+		case shapeOpen:
+			// the root array is not counted, like in FlatArray
+			if maxDepth > 0 && len(stack) > maxDepth {
+				return nil, maxDepthError(maxDepth)
+			}
+			stack = append(stack, make([]interface{}, 0))
+		case shapeClose:
+			if len(stack) == 0 {
+				return nil, apierrors.NewBadRequestError(fmt.Sprintf("unexpected %q at position %d of the shape", shape[i], i))
+			}
+			closed := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if len(stack) == 0 {
+				res = closed
+				continue
+			}
+			stack[len(stack)-1] = append(stack[len(stack)-1], closed)
+		case shapeValue:
+			if len(stack) == 0 {
+				return nil, apierrors.NewBadRequestError(fmt.Sprintf("unexpected %q at position %d of the shape", shape[i], i))
+			}
+			if next >= len(flatted) {
+				return nil, apierrors.NewBadRequestError("the shape has more values than the flatted array")
+			}
+			stack[len(stack)-1] = append(stack[len(stack)-1], flatted[next])
+			next++
+		default:
+			return nil, apierrors.NewBadRequestError(fmt.Sprintf("invalid character %q at position %d of the shape", shape[i], i))
+		}
+	}
+
+	if res == nil {
+		return nil, apierrors.NewBadRequestError("the shape has arrays without closing")
+	}
+	if next < len(flatted) {
+		return nil, apierrors.NewBadRequestError("the flatted array has more values than the shape")
+	}
+	return res, nil
+}
+
+// BuildGraph rebuild the Graph saved in db with the layout of the FormatVersion
+func (fi FlatInfo) BuildGraph() (*Graph, apierrors.RestErr) {
+	switch fi.FormatVersion {
+	case 0, FormatVertexSecuence:
+		return BuildGraphFromVertexSecuence(fi.VertexSecuence)
+	case FormatCompact:
+		return BuildGraphFromCompact(fi.Compact)
+	}
+	return nil, apierrors.NewInternalServerError(fmt.Sprintf("unknown format_version %d", fi.FormatVersion))
+}
+
+// idempotencyKey returns the key that is not expired at now
+func (fi FlatInfo) idempotencyKey(key string, now time.Time) (IdempotencyKey, bool) {
+	for _, ik := range fi.IdempotencyKeys {
+		if ik.Key == key && ik.ExpiresAt.After(now) {
+			return ik, true
+		}
+	}
+	return IdempotencyKey{}, false
+}
+
+// BuildGraphFromVertexSecuence rebuild the Graph saved in db.
+// FlatArray gives the keys in the same order the values are in the array, so the edges
+// are connected sorted by key. This also fixes the documents saved before the
+// neighbors were ordered, where the edges were saved in random order
 func BuildGraphFromVertexSecuence(vertexSecuence []VertexSecuence) (*Graph, apierrors.RestErr) {
 	g := NewDirectedGraph()
 
@@ -319,12 +1207,20 @@ func BuildGraphFromVertexSecuence(vertexSecuence []VertexSecuence) (*Graph, apie
 		if err != nil {
 			return nil, apierrors.NewInternalServerError("error parsing data_info")
 		}
-		g.AddVertex(vs.Key, parsedValue)
+		switch vs.DataInfo.DataType {
+		case DataTypeArray:
+			g.AddArrayVertex(vs.Key)
+		case DataTypeObjectNode:
+			g.AddObjectVertex(vs.Key)
+		default:
+			g.AddVertex(vs.Key, parsedValue)
+		}
+		g.Vertices[vs.Key].Name = vs.Name
 	}
 
 	// creating all the edge connections
 	for _, vs := range vertexSecuence {
-		for _, e := range vs.Edges {
+		for _, e := range sortedEdges(vs.Edges) {
 			if err := g.AddEdge(vs.Key, e); err != nil {
 				return nil, apierrors.NewInternalServerError(err.Error())
 			}
@@ -334,12 +1230,106 @@ func BuildGraphFromVertexSecuence(vertexSecuence []VertexSecuence) (*Graph, apie
 	return g, nil
 }
 
-func getTypeAndValueStringFromInterface(val interface{}) (dt string, dv string, err error) {
-	if val == nil {
-		err = errors.New("cannot get type and value from nil interface")
-		return
+// sortedEdges returns a sorted copy of the edges without changing the original slice
+func sortedEdges(edges []int) []int {
+	sorted := make([]int, len(edges))
+	copy(sorted, edges)
+	sort.Ints(sorted)
+	return sorted
+}
+
+// newDataInfo returns the DataInfo with the type and the value as string of a value of the array.
+// Numbers should be decoded as json.Number to keep the precision of big numbers
+func newDataInfo(val interface{}) (DataInfo, error) {
+	switch v := val.(type) {
+	case nil:
+		return DataInfo{DataType: DataTypeNull}, nil
+	case bool:
+		return DataInfo{DataType: DataTypeBool, DataValue: strconv.FormatBool(v)}, nil
+	case string:
+		return DataInfo{DataType: DataTypeString, DataValue: v}, nil
+	case json.Number:
+		if !isValidNumber(v.String()) {
+			return DataInfo{}, fmt.Errorf("invalid number %q", v.String())
+		}
+		if strings.ContainsAny(v.String(), ".eE") {
+			return DataInfo{DataType: DataTypeNumber, DataValue: v.String()}, nil
+		}
+		return DataInfo{DataType: DataTypeInteger, DataValue: v.String()}, nil
+	case float64:
+		return DataInfo{DataType: DataTypeNumber, DataValue: strconv.FormatFloat(v, 'f', -1, 64)}, nil
+	case int:
+		return DataInfo{DataType: DataTypeInteger, DataValue: strconv.Itoa(v)}, nil
+	case int64:
+		return DataInfo{DataType: DataTypeInteger, DataValue: strconv.FormatInt(v, 10)}, nil
+	case map[string]interface{}:
+		raw, err := json.Marshal(v)
+		if err != nil {
+			return DataInfo{}, fmt.Errorf("invalid object: %s", err.Error())
+		}
+		return DataInfo{DataType: DataTypeObject, DataValue: string(raw)}, nil
+	case json.RawMessage:
+		// the objects of a rebuilt Graph, see DataInfo.toInterface
+		if !json.Valid(v) {
+			return DataInfo{}, errors.New("invalid object")
+		}
+		return DataInfo{DataType: DataTypeObject, DataValue: string(v)}, nil
+	default:
+		return DataInfo{}, fmt.Errorf("%T is not a valid value inside an array", val)
+	}
+}
+
+// isValidNumber reports whether s is a valid JSON number literal
+func isValidNumber(s string) bool {
+	if s == "" {
+		return false
+	}
+
+	// optional sign
+	if s[0] == '-' {
+		s = s[1:]
+		if s == "" {
+			return false
+		}
+	}
+
+	// integer part, without leading zeros
+	switch {
+	case s[0] == '0':
+		s = s[1:]
+	case '1' <= s[0] && s[0] <= '9':
+		s = skipDigits(s[1:])
+	default:
+		return false
 	}
-	dt = fmt.Sprintf("%T", val)
-	dv = fmt.Sprintf("%v", val)
-	return
+
+	// fraction part
+	if len(s) >= 2 && s[0] == '.' && isDigit(s[1]) {
+		s = skipDigits(s[2:])
+	}
+
+	// exponent part
+	if len(s) >= 2 && (s[0] == 'e' || s[0] == 'E') {
+		s = s[1:]
+		if s[0] == '+' || s[0] == '-' {
+			s = s[1:]
+		}
+		if s == "" || !isDigit(s[0]) {
+			return false
+		}
+		s = skipDigits(s)
+	}
+
+	return s == ""
+}
+
+func skipDigits(s string) string {
+	for s != "" && isDigit(s[0]) {
+		s = s[1:]
+	}
+	return s
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
 }
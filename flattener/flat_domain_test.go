@@ -3,6 +3,9 @@ package flattener
 import (
 	"encoding/json"
 	"errors"
+	"net/http"
+	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -37,7 +40,7 @@ func TestVertexToArrayInvolvedInArrayValue(t *testing.T) {
 	mockValue := "first_lv2"
 	vtxLvl1 := NewVertex(1, "first_lvl")
 	vtxLvl2 := NewVertex(2, mockValue)
-	vtxLvl1.Vertices[vtxLvl1.Key] = vtxLvl2
+	vtxLvl1.Vertices = append(vtxLvl1.Vertices, vtxLvl2)
 	result := vtxLvl1.ToArray()
 
 	assert.NotNil(t, result)
@@ -103,9 +106,9 @@ func TestAddEdgeOK(t *testing.T) {
 
 	assert.Len(t, g.Vertices[0].Vertices, 1)
 	assert.Len(t, g.Vertices[1].Vertices, 2)
-	assert.Equal(t, g.Vertices[0].Vertices[1].Key, 1)
-	assert.Equal(t, g.Vertices[1].Vertices[2].Key, 2)
-	assert.Equal(t, g.Vertices[1].Vertices[3].Key, 3)
+	assert.Equal(t, g.Vertices[0].Vertices[0].Key, 1)
+	assert.Equal(t, g.Vertices[1].Vertices[0].Key, 2)
+	assert.Equal(t, g.Vertices[1].Vertices[1].Key, 3)
 }
 
 func TestAddEdgeNotExistVerticesError(t *testing.T) {
@@ -152,6 +155,10 @@ func TestToInterfaceBool(t *testing.T) {
 		{"parsed_float", DataInfo{"float64", "22"}, float64(22), nil},
 		{"parsed_float_with_decimal", DataInfo{"float64", "1.99"}, 1.99, nil},
 		{"parsed_error", DataInfo{"float64", "false"}, nil, errors.New("error parsing flat_data")},
+		{"parsed_integer", DataInfo{DataTypeInteger, "12345678901234567890"}, json.Number("12345678901234567890"), nil},
+		{"parsed_number", DataInfo{DataTypeNumber, "1.5e300"}, json.Number("1.5e300"), nil},
+		{"parsed_string", DataInfo{DataTypeString, "22"}, "22", nil},
+		{"parsed_number_error", DataInfo{DataTypeNumber, "1e"}, nil, errors.New("error parsing flat_data")},
 	}
 
 	for _, tc := range testCases {
@@ -172,10 +179,10 @@ func TestToInterfaceBool(t *testing.T) {
 
 func TestBuildGraphFromVertexSecuenceOK(t *testing.T) {
 	vtxSecuences := make([]VertexSecuence, 0)
-	vtx0 := VertexSecuence{0, DataInfo{}, []int{1}}
-	vtx1 := VertexSecuence{1, DataInfo{}, []int{2, 3}}
-	vtx2 := VertexSecuence{2, DataInfo{"string", "value2"}, []int{}}
-	vtx3 := VertexSecuence{3, DataInfo{"string", "value2"}, []int{}}
+	vtx0 := VertexSecuence{Key: 0, DataInfo: DataInfo{}, Edges: []int{1}}
+	vtx1 := VertexSecuence{Key: 1, DataInfo: DataInfo{}, Edges: []int{2, 3}}
+	vtx2 := VertexSecuence{Key: 2, DataInfo: DataInfo{"string", "value2"}, Edges: []int{}}
+	vtx3 := VertexSecuence{Key: 3, DataInfo: DataInfo{"string", "value2"}, Edges: []int{}}
 	vtxSecuences = append(vtxSecuences, vtx0, vtx1, vtx2, vtx3)
 
 	g, err := BuildGraphFromVertexSecuence(vtxSecuences)
@@ -189,13 +196,69 @@ func TestBuildGraphFromVertexSecuenceOK(t *testing.T) {
 	assert.Len(t, g.Vertices[3].Vertices, 0)
 }
 
+func TestBuildGraphFromVertexSecuenceUnorderedEdges(t *testing.T) {
+	// saved before the edges were ordered: [["value2","value3"],"value4"]
+	vtxSecuences := make([]VertexSecuence, 0)
+	vtx0 := VertexSecuence{Key: 0, DataInfo: DataInfo{}, Edges: []int{4, 1}}
+	vtx1 := VertexSecuence{Key: 1, DataInfo: DataInfo{}, Edges: []int{3, 2}}
+	vtx2 := VertexSecuence{Key: 2, DataInfo: DataInfo{"string", "value2"}, Edges: []int{}}
+	vtx3 := VertexSecuence{Key: 3, DataInfo: DataInfo{"string", "value3"}, Edges: []int{}}
+	vtx4 := VertexSecuence{Key: 4, DataInfo: DataInfo{"string", "value4"}, Edges: []int{}}
+	vtxSecuences = append(vtxSecuences, vtx3, vtx0, vtx4, vtx1, vtx2)
+
+	g, err := BuildGraphFromVertexSecuence(vtxSecuences)
+	assert.Nil(t, err)
+	assert.NotNil(t, g)
+
+	expected := []interface{}{[]interface{}{"value2", "value3"}, "value4"}
+	assert.Equal(t, expected, g.ToArray())
+	assert.Equal(t, []interface{}{"value2", "value3", "value4"}, g.ToFlat())
+
+	// the original secuence was not modified
+	assert.Equal(t, []int{4, 1}, vtx0.Edges)
+}
+
+func TestFlatArrayKeepsOrder(t *testing.T) {
+	input, err := buildDepthLevel3()
+	assert.Nil(t, err)
+
+	fi, apiErr := FlatArray(input, FlatOptions{})
+	assert.Nil(t, apiErr)
+
+	expected := []interface{}{float64(1), float64(2), false, "test", float64(8), float64(3), float64(7), "some"}
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, expected, fi.Graph.ToFlat())
+		assert.Equal(t, input, fi.Graph.ToArray())
+	}
+
+	// the secuence is sorted by key and both layouts rebuild the same array
+	vertexSecuence, apiErr := fi.Graph.GetVertexSecuence()
+	assert.Nil(t, apiErr)
+	for i, vs := range vertexSecuence {
+		assert.Equal(t, i, vs.Key)
+	}
+	legacy, buildErr := BuildGraphFromVertexSecuence(vertexSecuence)
+	assert.Nil(t, buildErr)
+	g, buildErr := fi.BuildGraph()
+	assert.Nil(t, buildErr)
+	assert.Equal(t, legacy.ToArray(), g.ToArray())
+
+	unflatted, jsonErr := json.Marshal(g.ToArray())
+	assert.Nil(t, jsonErr)
+	assert.Equal(t, `[1,2,[[false,"test",[8]],3,7],["some"]]`, string(unflatted))
+
+	flatted, jsonErr := json.Marshal(g.ToFlat())
+	assert.Nil(t, jsonErr)
+	assert.Equal(t, `[1,2,false,"test",8,3,7,"some"]`, string(flatted))
+}
+
 func TestBuildGraphFromVertexSecuenceErrorParsing(t *testing.T) {
 	vtxSecuences := make([]VertexSecuence, 0)
-	vtx0 := VertexSecuence{0, DataInfo{}, []int{1}}
-	vtx1 := VertexSecuence{1, DataInfo{}, []int{2, 3}}
-	vtx2 := VertexSecuence{2, DataInfo{"string", "value2"}, []int{}}
+	vtx0 := VertexSecuence{Key: 0, DataInfo: DataInfo{}, Edges: []int{1}}
+	vtx1 := VertexSecuence{Key: 1, DataInfo: DataInfo{}, Edges: []int{2, 3}}
+	vtx2 := VertexSecuence{Key: 2, DataInfo: DataInfo{"string", "value2"}, Edges: []int{}}
 	// this contains the error type
-	vtx3 := VertexSecuence{3, DataInfo{"float64", "value2"}, []int{}}
+	vtx3 := VertexSecuence{Key: 3, DataInfo: DataInfo{"float64", "value2"}, Edges: []int{}}
 	vtxSecuences = append(vtxSecuences, vtx0, vtx1, vtx2, vtx3)
 
 	g, err := BuildGraphFromVertexSecuence(vtxSecuences)
@@ -206,11 +269,11 @@ func TestBuildGraphFromVertexSecuenceErrorParsing(t *testing.T) {
 
 func TestBuildGraphFromVertexSecuenceErrorAddingEdge(t *testing.T) {
 	vtxSecuences := make([]VertexSecuence, 0)
-	vtx0 := VertexSecuence{0, DataInfo{}, []int{1}}
+	vtx0 := VertexSecuence{Key: 0, DataInfo: DataInfo{}, Edges: []int{1}}
 	// this is the bad edge, contains a node that not exists
-	vtx1 := VertexSecuence{1, DataInfo{}, []int{2, 4}}
-	vtx2 := VertexSecuence{2, DataInfo{"string", "value2"}, []int{}}
-	vtx3 := VertexSecuence{3, DataInfo{"string", "value2"}, []int{}}
+	vtx1 := VertexSecuence{Key: 1, DataInfo: DataInfo{}, Edges: []int{2, 4}}
+	vtx2 := VertexSecuence{Key: 2, DataInfo: DataInfo{"string", "value2"}, Edges: []int{}}
+	vtx3 := VertexSecuence{Key: 3, DataInfo: DataInfo{"string", "value2"}, Edges: []int{}}
 	vtxSecuences = append(vtxSecuences, vtx0, vtx1, vtx2, vtx3)
 
 	g, err := BuildGraphFromVertexSecuence(vtxSecuences)
@@ -219,29 +282,424 @@ func TestBuildGraphFromVertexSecuenceErrorAddingEdge(t *testing.T) {
 	assert.Equal(t, "not all vertices exists", err.Message())
 }
 
-func TestGetTypeAndValueStringFromInterface(t *testing.T) {
-	_, _, err := getTypeAndValueStringFromInterface(nil)
-	assert.NotNil(t, err)
-	assert.Equal(t, "cannot get type and value from nil interface", err.Error())
-
+func TestNewDataInfo(t *testing.T) {
 	testCases := []struct {
 		Name      string
 		DataType  string
 		DataValue string
 		Value     interface{}
 	}{
-		{"parsing_string", "string", "test", "test"},
-		{"parsing_float64", "float64", "25", float64(25)},
-		{"parsing_float64_with_decimal", "float64", "1.99", 1.99},
-		{"parsing_bool", "bool", "false", false},
+		{"parsing_null", DataTypeNull, "", nil},
+		{"parsing_string", DataTypeString, "test", "test"},
+		{"parsing_empty_string", DataTypeString, "", ""},
+		{"parsing_float64", DataTypeNumber, "25", float64(25)},
+		{"parsing_float64_with_decimal", DataTypeNumber, "1.99", 1.99},
+		{"parsing_big_float64", DataTypeNumber, "1000000000000000000000", 1e21},
+		{"parsing_int", DataTypeInteger, "7", 7},
+		{"parsing_json_integer", DataTypeInteger, "12345678901234567890", json.Number("12345678901234567890")},
+		{"parsing_json_number", DataTypeNumber, "1.5e300", json.Number("1.5e300")},
+		{"parsing_bool", DataTypeBool, "false", false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			di, err := newDataInfo(tc.Value)
+			assert.Nil(t, err)
+			assert.Equal(t, tc.DataType, di.DataType)
+			assert.Equal(t, tc.DataValue, di.DataValue)
+		})
+	}
+
+	_, err := newDataInfo(json.Number("1.2.3"))
+	assert.NotNil(t, err)
+	assert.Equal(t, `invalid number "1.2.3"`, err.Error())
+
+	_, err = newDataInfo(struct{}{})
+	assert.NotNil(t, err)
+	assert.Equal(t, "struct {} is not a valid value inside an array", err.Error())
+}
+
+func TestGetVertexSecuenceError(t *testing.T) {
+	g := NewDirectedGraph()
+	g.AddArrayVertex(0)
+	g.AddVertex(1, struct{}{})
+	assert.Nil(t, g.AddEdge(0, 1))
+
+	_, apiErr := g.GetVertexSecuence()
+	assert.NotNil(t, apiErr)
+	assert.Equal(t, http.StatusInternalServerError, apiErr.Status())
+	assert.Equal(t, "error saving the value of vertex 1: struct {} is not a valid value inside an array", apiErr.Message())
+}
+
+func TestFlatArrayRoundTrip(t *testing.T) {
+	body := `[1,12345678901234567890,-0.5,1.5e300,1000000000000000000000,[],[[]],null,"",true,["a",[null,[]]]]`
+	decoder := json.NewDecoder(strings.NewReader(body))
+	decoder.UseNumber()
+	var input []interface{}
+	assert.Nil(t, decoder.Decode(&input))
+
+	fi, apiErr := FlatArray(input, FlatOptions{})
+	assert.Nil(t, apiErr)
+	assert.Equal(t, 3, fi.MaxDepth)
+
+	g, buildErr := fi.BuildGraph()
+	assert.Nil(t, buildErr)
+
+	unflatted, err := json.Marshal(g.ToArray())
+	assert.Nil(t, err)
+	assert.Equal(t, body, string(unflatted))
+
+	flatted, err := json.Marshal(g.ToFlat())
+	assert.Nil(t, err)
+	assert.Equal(t, `[1,12345678901234567890,-0.5,1.5e300,1000000000000000000000,null,"",true,"a",null]`, string(flatted))
+}
+
+func TestFlatArrayObjects(t *testing.T) {
+	body := `[1,{"b":[2,{"c":null}],"a":{"x":12345678901234567890,"y":[],"z":{}}},[{}]]`
+
+	testCases := []struct {
+		Name     string
+		Mode     ObjectMode
+		MaxDepth int
+		Flatted  string
+	}{
+		{"leaf", ObjectsLeaf, 1, `[1,{"a":{"x":12345678901234567890,"y":[],"z":{}},"b":[2,{"c":null}]},{}]`},
+		{"flatten", ObjectsFlatten, 1, `[1,{"a.x":12345678901234567890,"a.y":[],"a.z":{},"b[0]":2,"b[1].c":null},{}]`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			decoder := json.NewDecoder(strings.NewReader(body))
+			decoder.UseNumber()
+			var input []interface{}
+			assert.Nil(t, decoder.Decode(&input))
+
+			fi, apiErr := FlatArray(input, FlatOptions{Objects: tc.Mode})
+			assert.Nil(t, apiErr)
+			assert.Equal(t, tc.MaxDepth, fi.MaxDepth)
+
+			g, buildErr := fi.BuildGraph()
+			assert.Nil(t, buildErr)
+
+			// the keys of the objects are written sorted
+			unflatted, err := json.Marshal(g.ToArray())
+			assert.Nil(t, err)
+			assert.Equal(t, `[1,{"a":{"x":12345678901234567890,"y":[],"z":{}},"b":[2,{"c":null}]},[{}]]`, string(unflatted))
+
+			flatted, err := json.Marshal(g.ToFlat())
+			assert.Nil(t, err)
+			assert.Equal(t, tc.Flatted, string(flatted))
+
+			flattedBeforeSave, err := json.Marshal(fi.Graph.ToFlat())
+			assert.Nil(t, err)
+			assert.Equal(t, tc.Flatted, string(flattedBeforeSave))
+		})
+	}
+}
+
+func TestFlatArrayObjectsErrors(t *testing.T) {
+	input := []interface{}{"test", map[string]interface{}{"key": "value"}}
+
+	_, apiErr := FlatArray(input, FlatOptions{})
+	assert.NotNil(t, apiErr)
+	assert.Equal(t, "object is not a valid value inside an array", apiErr.Message())
+
+	_, apiErr = FlatArray(input, FlatOptions{Objects: ObjectsReject})
+	assert.NotNil(t, apiErr)
+	assert.Equal(t, "object is not a valid value inside an array", apiErr.Message())
+
+	_, apiErr = FlatArray(input, FlatOptions{Objects: "other"})
+	assert.NotNil(t, apiErr)
+	assert.Equal(t, `invalid objects mode "other"`, apiErr.Message())
+
+	// the arrays inside a flatted object are counted in the depth
+	input = []interface{}{map[string]interface{}{"a": []interface{}{[]interface{}{1}}}}
+	_, apiErr = FlatArray(input, FlatOptions{Objects: ObjectsFlatten, MaxDepth: 1})
+	assert.NotNil(t, apiErr)
+	assert.Equal(t, "the array exceeds the max depth allowed of 1", apiErr.Message())
+}
+
+func TestFlatDocument(t *testing.T) {
+	testCases := []struct {
+		Name     string
+		Body     string
+		MaxDepth int
+		Flatted  string
+	}{
+		{"object", `{"a":{"b":[1,2,{"c":"x"}]},"d":null,"e":[[]]}`, 2, `{"a.b[0]":1,"a.b[1]":2,"a.b[2].c":"x","d":null,"e[0]":[]}`},
+		{"array", `[1,{"a":[true]},[12345678901234567890]]`, 1, `{"[0]":1,"[1].a[0]":true,"[2][0]":12345678901234567890}`},
+		{"empty_object", `{}`, 0, `{}`},
+		{"key_paths", `{"":[true],"a":{"b":2},"a.b":1}`, 1, `{"[\"\"][0]":true,"[\"a.b\"]":1,"a.b":2}`},
 	}
 
 	for _, tc := range testCases {
 		t.Run(tc.Name, func(t *testing.T) {
-			dt, dv, err := getTypeAndValueStringFromInterface(tc.Value)
+			decoder := json.NewDecoder(strings.NewReader(tc.Body))
+			decoder.UseNumber()
+			var input interface{}
+			assert.Nil(t, decoder.Decode(&input))
+
+			fi, apiErr := FlatDocument(input, FlatOptions{})
+			assert.Nil(t, apiErr)
+			assert.Equal(t, FlatTypeDocument, fi.Type)
+			assert.Equal(t, tc.MaxDepth, fi.MaxDepth)
+
+			g, buildErr := fi.BuildGraph()
+			assert.Nil(t, buildErr)
+
+			document, err := json.Marshal(g.ToDocument())
+			assert.Nil(t, err)
+			assert.Equal(t, tc.Body, string(document))
+
+			flatted, err := json.Marshal(g.ToFlatDocument())
+			assert.Nil(t, err)
+			assert.Equal(t, tc.Flatted, string(flatted))
+		})
+	}
+}
+
+func TestFlatArrayObjectKeysPaths(t *testing.T) {
+	// the keys with the characters of the paths would collide with the nested ones
+	body := `[{"a.b":1,"a":{"b":2},"":3,"c[0]":4,"c":[5],"d":{"\"":6,"<>":7}}]`
+	decoder := json.NewDecoder(strings.NewReader(body))
+	decoder.UseNumber()
+	var input []interface{}
+	assert.Nil(t, decoder.Decode(&input))
+
+	fi, apiErr := FlatArray(input, FlatOptions{Objects: ObjectsFlatten})
+	assert.Nil(t, apiErr)
+
+	expected := []interface{}{map[string]interface{}{
+		`["a.b"]`:  json.Number("1"),
+		`a.b`:      json.Number("2"),
+		`[""]`:     json.Number("3"),
+		`["c[0]"]`: json.Number("4"),
+		`c[0]`:     json.Number("5"),
+		`d["\""]`:  json.Number("6"),
+		`d.<>`:     json.Number("7"),
+	}}
+	assert.Equal(t, expected, fi.Graph.ToFlat())
+}
+
+func TestFlatDocumentErrors(t *testing.T) {
+	_, apiErr := FlatDocument("value", FlatOptions{})
+	assert.NotNil(t, apiErr)
+	assert.Equal(t, "the document must be an object or an array", apiErr.Message())
+
+	input := map[string]interface{}{"a": []interface{}{[]interface{}{1}}}
+	_, apiErr = FlatDocument(input, FlatOptions{MaxDepth: 1})
+	assert.NotNil(t, apiErr)
+	assert.Equal(t, "the array exceeds the max depth allowed of 1", apiErr.Message())
+}
+
+func TestShapeAndUnflat(t *testing.T) {
+	testCases := []struct {
+		Body  string
+		Shape string
+	}{
+		{`[]`, `[]`},
+		{`[1,2,3]`, `[***]`},
+		{`[1,[2,[]],3]`, `[*[*[]]*]`},
+		{`[[[]],[null,[[""]]],{"a":[1]}]`, `[[[]][*[[*]]]*]`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Shape, func(t *testing.T) {
+			decoder := json.NewDecoder(strings.NewReader(tc.Body))
+			decoder.UseNumber()
+			var input []interface{}
+			assert.Nil(t, decoder.Decode(&input))
+
+			fi, apiErr := FlatArray(input, FlatOptions{Objects: ObjectsLeaf})
+			assert.Nil(t, apiErr)
+			assert.Equal(t, tc.Shape, fi.Graph.Shape())
+
+			unflatted, apiErr := Unflat(fi.Graph.ToFlat(), fi.Graph.Shape(), 0)
+			assert.Nil(t, apiErr)
+			assert.Equal(t, input, unflatted)
+		})
+	}
+}
+
+func TestUnflatErrors(t *testing.T) {
+	testCases := []struct {
+		Shape   string
+		Flatted []interface{}
+		Message string
+	}{
+		{"", nil, "the shape must start with ["},
+		{"*", []interface{}{1}, "the shape must start with ["},
+		{"[**]", []interface{}{1}, "the shape has more values than the flatted array"},
+		{"[*]", []interface{}{1, 2}, "the flatted array has more values than the shape"},
+		{"[*[*]", []interface{}{1, 2}, "the shape has arrays without closing"},
+		{"[*]]", []interface{}{1}, `unexpected ']' at position 3 of the shape`},
+		{"[*][*]", []interface{}{1, 2}, `unexpected '[' at position 3 of the shape`},
+		{"[*,*]", []interface{}{1, 2}, `invalid character ',' at position 2 of the shape`},
+		{"[[[[[*]]]]]", []interface{}{1}, "the array exceeds the max depth allowed of 3"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Shape, func(t *testing.T) {
+			_, apiErr := Unflat(tc.Flatted, tc.Shape, 3)
+			assert.NotNil(t, apiErr)
+			assert.Equal(t, http.StatusBadRequest, apiErr.Status())
+			assert.Equal(t, tc.Message, apiErr.Message())
+		})
+	}
+
+	// the arrays until the max depth are allowed
+	unflatted, apiErr := Unflat([]interface{}{1}, "[[[[*]]]]", 3)
+	assert.Nil(t, apiErr)
+	assert.Equal(t, []interface{}{[]interface{}{[]interface{}{[]interface{}{1}}}}, unflatted)
+}
+
+func TestToFlatDepth(t *testing.T) {
+	input, err := buildDepthLevel3()
+	assert.Nil(t, err)
+
+	testCases := []struct {
+		Depth   int
+		Flatted string
+		Shape   string
+	}{
+		{0, `[1,2,[[false,"test",[8]],3,7],["some"]]`, `[****]`},
+		{1, `[1,2,[false,"test",[8]],3,7,"some"]`, `[**[***][*]]`},
+		{2, `[1,2,false,"test",[8],3,7,"some"]`, `[**[[***]**][*]]`},
+		{3, `[1,2,false,"test",8,3,7,"some"]`, `[**[[**[*]]**][*]]`},
+		{10, `[1,2,false,"test",8,3,7,"some"]`, `[**[[**[*]]**][*]]`},
+		{-1, `[1,2,false,"test",8,3,7,"some"]`, `[**[[**[*]]**][*]]`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(strconv.Itoa(tc.Depth), func(t *testing.T) {
+			depth := tc.Depth
+			fi, apiErr := FlatArray(input, FlatOptions{Depth: &depth})
+			if tc.Depth < 0 {
+				assert.NotNil(t, apiErr)
+				assert.Equal(t, "the depth must be greater or equal than zero", apiErr.Message())
+				fi, apiErr = FlatArray(input, FlatOptions{})
+			}
+			assert.Nil(t, apiErr)
+			assert.Equal(t, 3, fi.MaxDepth)
+
+			flatted, err := json.Marshal(fi.Graph.ToFlatDepth(tc.Depth))
 			assert.Nil(t, err)
-			assert.Equal(t, tc.DataType, dt)
-			assert.Equal(t, tc.DataValue, dv)
+			assert.Equal(t, tc.Flatted, string(flatted))
+			assert.Equal(t, tc.Shape, fi.Graph.ShapeDepth(tc.Depth))
+
+			walked := make([]interface{}, 0)
+			assert.Nil(t, fi.Graph.WalkFlatDepth(tc.Depth, func(val interface{}) error {
+				walked = append(walked, val)
+				return nil
+			}))
+			assert.Equal(t, fi.Graph.ToFlatDepth(tc.Depth), walked)
+
+			unflatted, apiErr := Unflat(fi.Graph.ToFlatDepth(tc.Depth), fi.Graph.ShapeDepth(tc.Depth), 0)
+			assert.Nil(t, apiErr)
+			assert.Equal(t, input, unflatted)
 		})
 	}
 }
+
+func TestGraphPaths(t *testing.T) {
+	input, err := buildDepthLevel3()
+	assert.Nil(t, err)
+
+	fi, apiErr := FlatArray(input, FlatOptions{})
+	assert.Nil(t, apiErr)
+
+	// [1,2,[[false,"test",[8]],3,7],["some"]]
+	expected := []ValuePath{
+		{Path: []int{0}, Depth: 0},
+		{Path: []int{1}, Depth: 0},
+		{Path: []int{2, 0, 0}, Depth: 2},
+		{Path: []int{2, 0, 1}, Depth: 2},
+		{Path: []int{2, 0, 2, 0}, Depth: 3},
+		{Path: []int{2, 1}, Depth: 1},
+		{Path: []int{2, 2}, Depth: 1},
+		{Path: []int{3, 0}, Depth: 1},
+	}
+	assert.Equal(t, expected, fi.Graph.Paths(-1))
+	assert.Len(t, fi.Graph.ToFlat(), len(expected))
+
+	// with a depth the arrays that are not flatted have their own path
+	expected = []ValuePath{
+		{Path: []int{0}, Depth: 0},
+		{Path: []int{1}, Depth: 0},
+		{Path: []int{2, 0}, Depth: 1},
+		{Path: []int{2, 1}, Depth: 1},
+		{Path: []int{2, 2}, Depth: 1},
+		{Path: []int{3, 0}, Depth: 1},
+	}
+	assert.Equal(t, expected, fi.Graph.Paths(1))
+	assert.Len(t, fi.Graph.ToFlatDepth(1), len(expected))
+
+	// the empty arrays have no values
+	fi, apiErr = FlatArray([]interface{}{[]interface{}{}, "a"}, FlatOptions{})
+	assert.Nil(t, apiErr)
+	assert.Equal(t, []ValuePath{{Path: []int{1}, Depth: 0}}, fi.Graph.Paths(-1))
+}
+
+func TestGraphStats(t *testing.T) {
+	body := `[1,"a",[null,[],[true,[1.5]]],{"k":[null]},[[]],null]`
+	decoder := json.NewDecoder(strings.NewReader(body))
+	decoder.UseNumber()
+	var input []interface{}
+	assert.Nil(t, decoder.Decode(&input))
+
+	expected := &FlatStats{
+		Leaves:      7,
+		SubArrays:   6,
+		EmptyArrays: 2,
+		Nulls:       2,
+		Types:       map[string]int{"number": 2, "string": 1, "bool": 1, "null": 2, "object": 1},
+		Depths:      []int{6, 4, 2, 1},
+	}
+
+	for _, mode := range []ObjectMode{ObjectsLeaf, ObjectsFlatten} {
+		fi, apiErr := FlatArray(input, FlatOptions{Objects: mode})
+		assert.Nil(t, apiErr)
+		assert.Equal(t, expected, fi.Stats)
+	}
+
+	fi, apiErr := FlatArray([]interface{}{}, FlatOptions{})
+	assert.Nil(t, apiErr)
+	assert.Equal(t, &FlatStats{Types: map[string]int{}, Depths: []int{}}, fi.Stats)
+
+	// the documents have no stats
+	fi, apiErr = FlatDocument(map[string]interface{}{"a": 1}, FlatOptions{})
+	assert.Nil(t, apiErr)
+	assert.Nil(t, fi.Stats)
+}
+
+func TestContentHash(t *testing.T) {
+	hash := func(input string, opts FlatOptions) string {
+		fi, apiErr := FlatArrayStream(strings.NewReader(input), opts)
+		assert.Nil(t, apiErr)
+		return fi.Hash
+	}
+	leaf := FlatOptions{Objects: ObjectsLeaf}
+	one := 1
+
+	base := hash(`[1,[{"a":1,"b":[2]}]]`, leaf)
+	assert.Len(t, base, 64)
+
+	// the order of the keys and the spaces are not part of the content
+	assert.Equal(t, base, hash(`[ 1, [ {"b": [2], "a": 1} ] ]`, leaf))
+	fi, apiErr := FlatArray([]interface{}{json.Number("1"), []interface{}{map[string]interface{}{"a": json.Number("1"), "b": []interface{}{json.Number("2")}}}}, leaf)
+	assert.Nil(t, apiErr)
+	assert.Equal(t, base, fi.Hash)
+
+	// the values, the structure and the options that change the result are
+	assert.NotEqual(t, base, hash(`[1.0,[{"a":1,"b":[2]}]]`, leaf))
+	assert.NotEqual(t, base, hash(`[[1],{"a":1,"b":[2]}]`, leaf))
+	assert.NotEqual(t, base, hash(`[1,[{"a":1,"b":[2]}]]`, FlatOptions{Objects: ObjectsFlatten}))
+	assert.NotEqual(t, base, hash(`[1,[{"a":1,"b":[2]}]]`, FlatOptions{Objects: ObjectsLeaf, Depth: &one}))
+
+	// the options that do not change the result are not
+	assert.Equal(t, hash(`[1,[2]]`, FlatOptions{}), hash(`[1,[2]]`, FlatOptions{Objects: ObjectsLeaf, WithShape: true, MaxDepth: 5}))
+
+	doc, apiErr := FlatDocument([]interface{}{json.Number("1"), []interface{}{json.Number("2")}}, FlatOptions{})
+	assert.Nil(t, apiErr)
+	assert.NotEqual(t, hash(`[1,[2]]`, FlatOptions{Objects: ObjectsFlatten}), doc.Hash)
+}
@@ -1,72 +1,488 @@
 package flattener
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
 	"github.com/mendezdev/tgo_flattener/apierrors"
+	"github.com/mendezdev/tgo_flattener/config"
 )
 
 //go:generate mockgen -destination=mock_gateway.go -package=flattener -source=flat_gateway.go Gateway
 
 type Gateway interface {
-	// FlatResponse will try to flat an array of mixed simple values an will save a FlatInfo
-	// returns a FlatResponse with the flatted array and the max depth
-	FlatResponse([]interface{}) (FlatResponse, apierrors.RestErr)
+	// FlatStreamResponse will flat an array of mixed simple values read from the reader and
+	// will save a FlatInfo, it returns a FlatResponse with the flatted array and the max depth.
+	// The array is flatted while it is read, so the limits are checked before reading the whole
+	// array. The limits of the options are always the ones in the config.
+	// If the same array was saved with the same options, nothing is saved and
+	// the FlatResponse has the id of that FlatInfo and Deduplicated in true.
+	// With an IdempotencyKey in the options, the requests with the same key return
+	// the response of the first one until the key expires, with Replayed in true.
+	// The same key with another array or options returns a conflict error
+	FlatStreamResponse(context.Context, io.Reader, FlatOptions) (FlatResponse, apierrors.RestErr)
+
+	// FlatStreamValues is like FlatStreamResponse but the FlatResponse has no Data, the
+	// returned FlatValues walks the saved graph to get the flatted values one by one
+	FlatStreamValues(context.Context, io.Reader, FlatOptions) (FlatResponse, FlatValues, apierrors.RestErr)
+
+	// FlatBatchResponse is like FlatStreamResponse for every array in the batch. The arrays
+	// are flatted at the same time by the batch workers of the config and saved together.
+	// The errors of an array are in its item, the other ones are saved anyway.
+	// The Idempotency-Key is not used
+	FlatBatchResponse(context.Context, []json.RawMessage, FlatOptions) (FlatBatchResponse, apierrors.RestErr)
+
+	// FlatDocumentResponse will flat any JSON object or array and will save a FlatInfo.
+	// Returns a FlatDocumentResponse with the path of every value and the max depth.
+	// The documents already saved are deduplicated like in FlatStreamResponse
+	FlatDocumentResponse(ctx context.Context, input interface{}) (FlatDocumentResponse, apierrors.RestErr)
+
+	// Unflatten will rebuild the original array with the flatted array and the shape
+	// returned by FlatStreamResponse. Nothing is saved
+	Unflatten(UnflatRequest) (UnflatResponse, apierrors.RestErr)
 
-	// GetFlats will return a FlatInfoResponse that contains ->
+	// GetFlats will return a page of FlatInfoResponse filtered by the FlatsQuery.
+	// Every FlatInfoResponse contains ->
 	// id: auto-generated by the db;
 	// processed_at: is the date when the process was made;
 	// flatted: the original array flatted;
 	// unflatted: the original request array;
-	GetFlats() ([]FlatInfoResponse, apierrors.RestErr)
+	// The page contains the token to get the next page, if there is one
+	GetFlats(context.Context, FlatsQuery) (FlatsPage, apierrors.RestErr)
+
+	// StreamFlats is like GetFlats but calls fn with every FlatInfoResponse as soon as
+	// it is read from the storage. It returns the token of the next page, if there is one
+	StreamFlats(ctx context.Context, query FlatsQuery, fn func(FlatInfoResponse) error) (string, apierrors.RestErr)
+
+	// GetFlat will return the FlatInfoResponse with the given id or
+	// a not found error if it not exists
+	GetFlat(ctx context.Context, id string) (FlatInfoResponse, apierrors.RestErr)
+
+	// GetFlatByHash will return the FlatInfoResponse with the given content hash or
+	// a not found error if it not exists
+	GetFlatByHash(ctx context.Context, hash string) (FlatInfoResponse, apierrors.RestErr)
+
+	// DeleteFlat will delete the FlatInfo with the given id or
+	// return a not found error if it not exists
+	DeleteFlat(ctx context.Context, id string) apierrors.RestErr
 }
 
 type gateway struct {
 	storage Storage
+	cfg     config.Flats
 }
 
-func NewGateway(s Storage) Gateway {
-	return &gateway{storage: s}
+func NewGateway(s Storage, cfg config.Flats) Gateway {
+	return &gateway{storage: s, cfg: cfg}
 }
 
-func (s *gateway) FlatResponse(input []interface{}) (FlatResponse, apierrors.RestErr) {
+func (s *gateway) FlatStreamResponse(ctx context.Context, input io.Reader, opts FlatOptions) (FlatResponse, apierrors.RestErr) {
+	opts = s.withLimits(opts)
+	flatInfo, err := FlatArrayStream(input, opts)
+	if err != nil {
+		return FlatResponse{}, err
+	}
+	return s.saveFlat(ctx, flatInfo, opts)
+}
+
+func (s *gateway) FlatStreamValues(ctx context.Context, input io.Reader, opts FlatOptions) (FlatResponse, FlatValues, apierrors.RestErr) {
+	opts = s.withLimits(opts)
+	flatInfo, err := FlatArrayStream(input, opts)
+	if err != nil {
+		return FlatResponse{}, nil, err
+	}
+	saved, saveErr := s.save(ctx, flatInfo, opts)
+	if saveErr != nil {
+		return FlatResponse{}, nil, saveErr
+	}
+
+	flatDepth := flatInfoDepth(flatInfo)
+	values := func(fn func(val interface{}) error) error {
+		return flatInfo.Graph.WalkFlatDepth(flatDepth, fn)
+	}
+	return newFlatResponseInfo(flatInfo, saved, opts), values, nil
+}
+
+// withLimits returns the options with the limits of the config
+func (s *gateway) withLimits(opts FlatOptions) FlatOptions {
+	opts.MaxDepth = s.cfg.MaxDepth
+	opts.MaxElements = s.cfg.MaxElements
+	opts.MaxBodySize = s.cfg.MaxBodySize
+	return opts
+}
+
+// saveFlat saves the FlatInfo of an array and returns the FlatResponse with the fields asked in the options
+func (s *gateway) saveFlat(ctx context.Context, flatInfo FlatInfo, opts FlatOptions) (FlatResponse, apierrors.RestErr) {
+	saved, saveErr := s.save(ctx, flatInfo, opts)
+	if saveErr != nil {
+		return FlatResponse{}, saveErr
+	}
+	return newFlatResponse(flatInfo, saved, opts), nil
+}
+
+// newFlatResponse returns the FlatResponse of the saved FlatInfo with the fields asked in the options
+func newFlatResponse(flatInfo FlatInfo, saved saveResult, opts FlatOptions) FlatResponse {
+	fr := newFlatResponseInfo(flatInfo, saved, opts)
+	fr.Data = flatInfo.Graph.ToFlatDepth(flatInfoDepth(flatInfo))
+	return fr
+}
+
+// newFlatResponseInfo is newFlatResponse without the Data
+func newFlatResponseInfo(flatInfo FlatInfo, saved saveResult, opts FlatOptions) FlatResponse {
 	var fr FlatResponse
 
-	flatInfo, err := FlatArray(input)
+	flatDepth := flatInfoDepth(flatInfo)
+	fr.ID = saved.id
+	fr.Deduplicated = saved.deduplicated
+	fr.Replayed = saved.replayed
+	fr.MaxDepth = flatInfo.MaxDepth
+	if opts.WithShape {
+		fr.Shape = flatInfo.Graph.ShapeDepth(flatDepth)
+	}
+	if opts.WithPaths {
+		fr.Paths = flatInfo.Graph.Paths(flatDepth)
+	}
+	if opts.WithStats {
+		fr.Stats = flatInfo.Stats
+	}
+
+	return fr
+}
+
+func (s *gateway) FlatBatchResponse(ctx context.Context, inputs []json.RawMessage, opts FlatOptions) (FlatBatchResponse, apierrors.RestErr) {
+	if len(inputs) == 0 {
+		return FlatBatchResponse{}, apierrors.NewBadRequestError("the batch can not be empty")
+	}
+	if s.cfg.MaxBatchSize > 0 && len(inputs) > s.cfg.MaxBatchSize {
+		return FlatBatchResponse{}, apierrors.NewRequestEntityTooLargeError(fmt.Sprintf("the batch can not have more than %d arrays", s.cfg.MaxBatchSize))
+	}
+
+	opts = s.withLimits(opts)
+	opts.IdempotencyKey = ""
+	flats, errs := s.flatBatch(ctx, inputs, opts)
+
+	// only the flatted arrays are saved, pending has their index in the batch
+	pending := make([]int, 0, len(flats))
+	toCreate := make([]FlatInfo, 0, len(flats))
+	for i, err := range errs {
+		if err == nil {
+			pending = append(pending, i)
+			toCreate = append(toCreate, flats[i])
+		}
+	}
+
+	items := make([]FlatBatchItem, len(inputs))
+	ids, createErrs := s.storage.createMany(ctx, toCreate)
+	for j, i := range pending {
+		id, deduplicated, err := s.created(ctx, flats[i], ids[j], createErrs[j])
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		fr := newFlatResponse(flats[i], saveResult{id: id, deduplicated: deduplicated}, opts)
+		items[i] = FlatBatchItem{Status: http.StatusOK, Result: &fr}
+	}
+
+	for i, err := range errs {
+		if err != nil {
+			items[i] = FlatBatchItem{Status: err.Status(), Error: err}
+		}
+	}
+	return FlatBatchResponse{Items: items}, nil
+}
+
+// flatBatch flats the arrays with a pool of batch workers, every worker takes the next
+// array until all of them are flatted. It returns the FlatInfo or the error of every array
+func (s *gateway) flatBatch(ctx context.Context, inputs []json.RawMessage, opts FlatOptions) ([]FlatInfo, []apierrors.RestErr) {
+	flats := make([]FlatInfo, len(inputs))
+	errs := make([]apierrors.RestErr, len(inputs))
+
+	workers := s.cfg.BatchWorkers
+	if workers > len(inputs) {
+		workers = len(inputs)
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	// every index is written by only one worker
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				if err := contextError(ctx); err != nil {
+					errs[i] = err
+					continue
+				}
+				flats[i], errs[i] = FlatArrayStream(bytes.NewReader(inputs[i]), opts)
+			}
+		}()
+	}
+
+	for i := range inputs {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	return flats, errs
+}
+
+// saveResult is the FlatInfo used for a response, see save
+type saveResult struct {
+	id           string
+	deduplicated bool
+	replayed     bool
+}
+
+// save is like create when the IdempotencyKey of the options is empty. Otherwise, if the key was
+// used before and it is not expired, the FlatInfo saved with it is used. The FlatInfos with the same
+// hash have the same content, and the key has the fingerprint of the options, so the response is the
+// same as the first one or it is a conflict. If the key is new it is saved with the FlatInfo, or with
+// the one with the same hash, and it expires after the idempotency ttl
+func (s *gateway) save(ctx context.Context, flatInfo FlatInfo, opts FlatOptions) (saveResult, apierrors.RestErr) {
+	key := opts.IdempotencyKey
+	if key == "" {
+		id, deduplicated, err := s.create(ctx, flatInfo)
+		return saveResult{id: id, deduplicated: deduplicated}, err
+	}
+
+	fingerprint := opts.fingerprint()
+	saved, err := s.storage.getByIdempotencyKey(ctx, key)
+	if err == nil {
+		ik, _ := saved.idempotencyKey(key, time.Now().UTC())
+		if saved.Hash != flatInfo.Hash || (ik.Options != "" && ik.Options != fingerprint) {
+			return saveResult{}, apierrors.NewConflictError(fmt.Sprintf("the Idempotency-Key %s was already used with a different request", key))
+		}
+		return saveResult{id: saved.ID, deduplicated: ik.Deduplicated, replayed: true}, nil
+	}
+	if err.Status() != http.StatusNotFound {
+		return saveResult{}, storageError(err, "error getting the flat_info of the Idempotency-Key")
+	}
+
+	ik := IdempotencyKey{Key: key, ExpiresAt: time.Now().UTC().Add(s.cfg.IdempotencyTTL), Options: fingerprint}
+	flatInfo.IdempotencyKeys = []IdempotencyKey{ik}
+	id, deduplicated, createErr := s.create(ctx, flatInfo)
+	if createErr != nil {
+		return saveResult{}, createErr
+	}
+
+	// the key is added to the saved one, it is not found if it was deleted after the create
+	if deduplicated {
+		ik.Deduplicated = true
+		if keyErr := s.storage.addIdempotencyKey(ctx, id, ik); keyErr != nil && keyErr.Status() != http.StatusNotFound {
+			return saveResult{}, storageError(keyErr, "error saving the Idempotency-Key")
+		}
+	}
+	return saveResult{id: id, deduplicated: deduplicated}, nil
+}
+
+// create saves the FlatInfo or, if there is one with the same hash, returns its id
+// and true. The saved one has the same content, so its result is the same
+func (s *gateway) create(ctx context.Context, flatInfo FlatInfo) (string, bool, apierrors.RestErr) {
+	id, err := s.storage.create(ctx, flatInfo)
+	return s.created(ctx, flatInfo, id, err)
+}
+
+// created returns the result of create with the id and the error of saving the FlatInfo
+func (s *gateway) created(ctx context.Context, flatInfo FlatInfo, id string, err apierrors.RestErr) (string, bool, apierrors.RestErr) {
+	if err == nil {
+		return id, false, nil
+	}
+	if err.Status() != http.StatusConflict {
+		return "", false, storageError(err, "error saving the flat_info")
+	}
+
+	saved, getErr := s.storage.getByHash(ctx, flatInfo.Hash)
+	if getErr == nil {
+		return saved.ID, true, nil
+	}
+	if getErr.Status() != http.StatusNotFound {
+		return "", false, storageError(getErr, "error getting the flat_info with the same hash")
+	}
+
+	// it was deleted after the conflict, so it can be saved now
+	if id, err = s.storage.create(ctx, flatInfo); err != nil {
+		return "", false, storageError(err, "error saving the flat_info")
+	}
+	return id, false, nil
+}
+
+func (s *gateway) FlatDocumentResponse(ctx context.Context, input interface{}) (FlatDocumentResponse, apierrors.RestErr) {
+	var fr FlatDocumentResponse
+
+	flatInfo, err := FlatDocument(input, s.withLimits(FlatOptions{}))
 	if err != nil {
 		return fr, err
 	}
 
-	if dbErr := s.storage.create(flatInfo); dbErr != nil {
-		return fr, apierrors.NewInternalServerError("error saving the flat_info")
+	id, deduplicated, dbErr := s.create(ctx, flatInfo)
+	if dbErr != nil {
+		return fr, dbErr
 	}
 
+	fr.ID = id
 	fr.MaxDepth = flatInfo.MaxDepth
-	fr.Data = flatInfo.Graph.ToFlat()
+	fr.Data = flatInfo.Graph.ToFlatDocument()
+	fr.Deduplicated = deduplicated
 
 	return fr, nil
 }
 
-func (s *gateway) GetFlats() ([]FlatInfoResponse, apierrors.RestErr) {
-	flats, err := s.storage.getAll()
+func (s *gateway) Unflatten(req UnflatRequest) (UnflatResponse, apierrors.RestErr) {
+	unflatted, err := Unflat(req.Flatted, req.Shape, s.cfg.MaxDepth)
+	if err != nil {
+		return UnflatResponse{}, err
+	}
+	return UnflatResponse{Unflatted: unflatted}, nil
+}
+
+func (s *gateway) GetFlats(ctx context.Context, query FlatsQuery) (FlatsPage, apierrors.RestErr) {
+	page := FlatsPage{Items: make([]FlatInfoResponse, 0)}
+
+	// asking for one more to know if there is a next page
+	limit := query.Limit
+	query.Limit++
+	flats, err := s.storage.getAll(ctx, query)
 	if err != nil {
-		return nil, apierrors.NewInternalServerError("error getting flat_info from db")
+		return page, storageError(err, "error getting flat_info from db")
+	}
+
+	if int64(len(flats)) > limit {
+		flats = flats[:limit]
+		last := flats[len(flats)-1]
+		page.Next = FlatsCursor{ProcessedAt: last.ProcessedAt, ID: last.ID}.Encode()
 	}
 
-	res := make([]FlatInfoResponse, 0)
 	for _, f := range flats {
-		g, buildErr := BuildGraphFromVertexSecuence(f.VertexSecuence)
+		fir, buildErr := newFlatInfoResponse(f)
+		if buildErr != nil {
+			return FlatsPage{}, buildErr
+		}
+		page.Items = append(page.Items, fir)
+	}
+
+	return page, nil
+}
+
+func (s *gateway) StreamFlats(ctx context.Context, query FlatsQuery, fn func(FlatInfoResponse) error) (string, apierrors.RestErr) {
+	// asking for one more to know if there is a next page
+	limit := query.Limit
+	query.Limit++
+
+	var count int64
+	var last FlatInfo
+	var next string
+	var streamErr apierrors.RestErr
+	err := s.storage.iterate(ctx, query, func(f FlatInfo) apierrors.RestErr {
+		count++
+		if count > limit {
+			next = FlatsCursor{ProcessedAt: last.ProcessedAt, ID: last.ID}.Encode()
+			return nil
+		}
+
+		fir, buildErr := newFlatInfoResponse(f)
 		if buildErr != nil {
-			return nil, buildErr
+			streamErr = buildErr
+			return buildErr
+		}
+		if fnErr := fn(fir); fnErr != nil {
+			streamErr = apierrors.NewInternalServerError(fmt.Sprintf("error writing flat_info: %s", fnErr.Error()))
+			return streamErr
 		}
-		unflatted := g.ToArray()
-		flatted := g.ToFlat()
-		fir := FlatInfoResponse{
+		last = f
+		return nil
+	})
+	if streamErr != nil {
+		return "", streamErr
+	}
+	if err != nil {
+		return "", storageError(err, "error getting flat_info from db")
+	}
+
+	return next, nil
+}
+
+func (s *gateway) GetFlat(ctx context.Context, id string) (FlatInfoResponse, apierrors.RestErr) {
+	f, err := s.storage.get(ctx, id)
+	if err != nil {
+		return FlatInfoResponse{}, storageError(err, "error getting flat_info from db")
+	}
+
+	return newFlatInfoResponse(f)
+}
+
+func (s *gateway) GetFlatByHash(ctx context.Context, hash string) (FlatInfoResponse, apierrors.RestErr) {
+	f, err := s.storage.getByHash(ctx, hash)
+	if err != nil {
+		return FlatInfoResponse{}, storageError(err, "error getting flat_info from db")
+	}
+
+	return newFlatInfoResponse(f)
+}
+
+func (s *gateway) DeleteFlat(ctx context.Context, id string) apierrors.RestErr {
+	if err := s.storage.delete(ctx, id); err != nil {
+		return storageError(err, "error deleting flat_info from db")
+	}
+	return nil
+}
+
+// newFlatInfoResponse rebuild the Graph saved in the FlatInfo to
+// get the flatted and unflatted arrays, or documents
+func newFlatInfoResponse(f FlatInfo) (FlatInfoResponse, apierrors.RestErr) {
+	g, buildErr := f.BuildGraph()
+	if buildErr != nil {
+		return FlatInfoResponse{}, buildErr
+	}
+
+	if f.Type == FlatTypeDocument {
+		return FlatInfoResponse{
 			ID:          f.ID,
+			Type:        FlatTypeDocument,
+			Hash:        f.Hash,
 			ProcessedAt: f.ProcessedAt,
-			Unflatted:   unflatted,
-			Flatted:     flatted,
-		}
-		res = append(res, fir)
+			Unflatted:   g.ToDocument(),
+			Flatted:     g.ToFlatDocument(),
+		}, nil
+	}
+
+	return FlatInfoResponse{
+		ID:          f.ID,
+		Type:        FlatTypeArray,
+		Hash:        f.Hash,
+		ProcessedAt: f.ProcessedAt,
+		Unflatted:   g.ToArray(),
+		Flatted:     g.ToFlatDepth(flatInfoDepth(f)),
+		Stats:       f.Stats,
+	}, nil
+}
+
+// flatInfoDepth returns the depth for Graph.ToFlatDepth, -1 if all the levels were flatted
+func flatInfoDepth(f FlatInfo) int {
+	if f.FlatDepth == nil {
+		return -1
 	}
+	return *f.FlatDepth
+}
 
-	return res, nil
+// storageError keeps the client errors returned by the storage, like a not found,
+// and the timeouts. The internal ones are replaced with the given message
+func storageError(err apierrors.RestErr, message string) apierrors.RestErr {
+	switch {
+	case err.Status() < http.StatusInternalServerError,
+		err.Status() == http.StatusServiceUnavailable,
+		err.Status() == http.StatusGatewayTimeout:
+		return err
+	}
+	return apierrors.NewInternalServerError(message)
 }
@@ -1,13 +1,18 @@
 package flattener
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/golang/mock/gomock"
 	"github.com/mendezdev/tgo_flattener/apierrors"
+	"github.com/mendezdev/tgo_flattener/config"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -16,11 +21,11 @@ func TestFlatResponse_OK(t *testing.T) {
 	defer mockCtrl.Finish()
 
 	mockStorage := NewMockStorage(mockCtrl)
-	gwt := NewGateway(mockStorage)
+	gwt := NewGateway(mockStorage, config.Default().Flats)
 
 	mockStorage.
 		EXPECT().
-		create(gomock.Any()).Return(nil).
+		create(gomock.Any(), gomock.Any()).Return("qwery12345", nil).
 		Times(7)
 
 	testCases := []struct {
@@ -44,10 +49,11 @@ func TestFlatResponse_OK(t *testing.T) {
 			assert.Nil(t, err)
 			assert.NotNil(t, useCase)
 
-			fr, apiErr := gwt.FlatResponse(useCase)
+			fr, apiErr := flatResponse(gwt, useCase, FlatOptions{})
 			assert.Nil(t, apiErr)
 
 			assert.NotNil(t, fr)
+			assert.Equal(t, "qwery12345", fr.ID)
 			assert.Equal(t, tc.MaxDepth, fr.MaxDepth)
 			assert.Equal(t, tc.Len, len(fr.Data))
 		})
@@ -59,62 +65,642 @@ func TestFlatResponseErrorByObjectInNode(t *testing.T) {
 	defer mockCtrl.Finish()
 
 	mockStorage := NewMockStorage(mockCtrl)
-	gwt := NewGateway(mockStorage)
+	gwt := NewGateway(mockStorage, config.Default().Flats)
 
 	mockStorage.
 		EXPECT().
-		create(gomock.Any()).Return(nil).
+		create(gomock.Any(), gomock.Any()).
 		Times(0)
 	input, err := buildArrayWithObject()
 	assert.Nil(t, err)
 	assert.NotNil(t, input)
 
-	_, apiErr := gwt.FlatResponse(input)
+	_, apiErr := flatResponse(gwt, input, FlatOptions{})
 	assert.NotNil(t, apiErr)
 	assert.Equal(t, http.StatusBadRequest, apiErr.Status())
 	assert.Equal(t, "object is not a valid value inside an array", apiErr.Message())
 }
 
+func TestFlatResponseErrorByMaxDepth(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockStorage := NewMockStorage(mockCtrl)
+	gwt := NewGateway(mockStorage, config.Flats{Limit: 100, MaxDepth: 3})
+
+	mockStorage.
+		EXPECT().
+		create(gomock.Any(), gomock.Any()).Return("qwery12345", nil).
+		Times(1)
+
+	input, err := buildDepthLevel3()
+	assert.Nil(t, err)
+	_, apiErr := flatResponse(gwt, input, FlatOptions{})
+	assert.Nil(t, apiErr)
+
+	input, err = buildDepthLevel4()
+	assert.Nil(t, err)
+	_, apiErr = flatResponse(gwt, input, FlatOptions{})
+	assert.NotNil(t, apiErr)
+	assert.Equal(t, http.StatusBadRequest, apiErr.Status())
+	assert.Equal(t, "the array exceeds the max depth allowed of 3", apiErr.Message())
+}
+
+func TestFlatStreamResponse(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockStorage := NewMockStorage(mockCtrl)
+	gwt := NewGateway(mockStorage, config.Flats{Limit: 100, MaxDepth: 2, MaxElements: 5})
+
+	mockStorage.
+		EXPECT().
+		create(gomock.Any(), gomock.Any()).Return("qwery12345", nil).
+		Times(1)
+
+	fr, apiErr := gwt.FlatStreamResponse(context.Background(), strings.NewReader(`[1,[2,[3]]]`), FlatOptions{WithStats: true})
+	assert.Nil(t, apiErr)
+	assert.Equal(t, "qwery12345", fr.ID)
+	assert.Equal(t, 2, fr.MaxDepth)
+	assert.Equal(t, []interface{}{json.Number("1"), json.Number("2"), json.Number("3")}, fr.Data)
+	assert.Equal(t, 3, fr.Stats.Leaves)
+
+	// the limits are the ones in the config
+	_, apiErr = gwt.FlatStreamResponse(context.Background(), strings.NewReader(`[1,[2,[[3]]]]`), FlatOptions{MaxDepth: 10})
+	assert.NotNil(t, apiErr)
+	assert.Equal(t, "the array exceeds the max depth allowed of 2", apiErr.Message())
+
+	_, apiErr = gwt.FlatStreamResponse(context.Background(), strings.NewReader(`[1,2,3,4,5,6]`), FlatOptions{})
+	assert.NotNil(t, apiErr)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, apiErr.Status())
+}
+
+func TestFlatStreamValues(t *testing.T) {
+	gwt := NewGateway(NewMemoryStorage(), config.Flats{Limit: 100, MaxDepth: 3})
+
+	depth := 1
+	fr, values, apiErr := gwt.FlatStreamValues(context.Background(), strings.NewReader(`[1,[2,[3]]]`), FlatOptions{Depth: &depth, WithShape: true})
+	assert.Nil(t, apiErr)
+	assert.NotEmpty(t, fr.ID)
+	assert.Equal(t, 2, fr.MaxDepth)
+	assert.Equal(t, "[*[**]]", fr.Shape)
+	assert.Nil(t, fr.Data)
+
+	var data []interface{}
+	assert.Nil(t, values(func(val interface{}) error {
+		data = append(data, val)
+		return nil
+	}))
+	assert.Equal(t, []interface{}{json.Number("1"), json.Number("2"), []interface{}{json.Number("3")}}, data)
+
+	// the walk stops with the first error
+	stop := errors.New("stop")
+	visited := 0
+	assert.Equal(t, stop, values(func(val interface{}) error {
+		visited++
+		return stop
+	}))
+	assert.Equal(t, 1, visited)
+
+	// the same array is deduplicated like in FlatStreamResponse
+	dup, _, apiErr := gwt.FlatStreamValues(context.Background(), strings.NewReader(`[1,[2,[3]]]`), FlatOptions{Depth: &depth, WithShape: true})
+	assert.Nil(t, apiErr)
+	assert.Equal(t, fr.ID, dup.ID)
+	assert.True(t, dup.Deduplicated)
+
+	_, values, apiErr = gwt.FlatStreamValues(context.Background(), strings.NewReader(`[1,[2,[[[3]]]]]`), FlatOptions{})
+	assert.NotNil(t, apiErr)
+	assert.Nil(t, values)
+	assert.Equal(t, "the array exceeds the max depth allowed of 3", apiErr.Message())
+}
+
 func TestFlatResponseDatabaseError(t *testing.T) {
 	mockCtrl := gomock.NewController(t)
 	defer mockCtrl.Finish()
 
 	mockStorage := NewMockStorage(mockCtrl)
-	gwt := NewGateway(mockStorage)
+	gwt := NewGateway(mockStorage, config.Default().Flats)
 
 	dbErr := apierrors.NewInternalServerError("db error")
 	mockStorage.
 		EXPECT().
-		create(gomock.Any()).Return(dbErr).
+		create(gomock.Any(), gomock.Any()).Return("", dbErr).
 		Times(1)
 
 	input, buildErr := buildDepthLevel0()
 	assert.Nil(t, buildErr)
 	assert.NotNil(t, input)
 
-	_, apiErr := gwt.FlatResponse(input)
+	_, apiErr := flatResponse(gwt, input, FlatOptions{})
 	assert.NotNil(t, apiErr)
 	assert.Equal(t, "error saving the flat_info", apiErr.Message())
 }
 
+func TestFlatResponseDeduplicated(t *testing.T) {
+	gwt := NewGateway(NewMemoryStorage(), config.Default().Flats)
+
+	first, apiErr := gwt.FlatStreamResponse(context.Background(), strings.NewReader(`[1,[2,[3]]]`), FlatOptions{})
+	assert.Nil(t, apiErr)
+	assert.False(t, first.Deduplicated)
+
+	second, apiErr := gwt.FlatStreamResponse(context.Background(), strings.NewReader(`[1, [2, [3]]]`), FlatOptions{WithShape: true})
+	assert.Nil(t, apiErr)
+	assert.True(t, second.Deduplicated)
+	assert.Equal(t, first.ID, second.ID)
+	assert.Equal(t, first.Data, second.Data)
+	assert.Equal(t, "[*[*[*]]]", second.Shape)
+
+	// other depth is another result
+	depth := 1
+	third, apiErr := gwt.FlatStreamResponse(context.Background(), strings.NewReader(`[1,[2,[3]]]`), FlatOptions{Depth: &depth})
+	assert.Nil(t, apiErr)
+	assert.False(t, third.Deduplicated)
+	assert.NotEqual(t, first.ID, third.ID)
+
+	doc := map[string]interface{}{"a": []interface{}{json.Number("1")}}
+	firstDoc, apiErr := gwt.FlatDocumentResponse(context.Background(), doc)
+	assert.Nil(t, apiErr)
+	secondDoc, apiErr := gwt.FlatDocumentResponse(context.Background(), doc)
+	assert.Nil(t, apiErr)
+	assert.False(t, firstDoc.Deduplicated)
+	assert.True(t, secondDoc.Deduplicated)
+	assert.Equal(t, firstDoc.ID, secondDoc.ID)
+
+	flat, apiErr := gwt.GetFlat(context.Background(), first.ID)
+	assert.Nil(t, apiErr)
+	byHash, apiErr := gwt.GetFlatByHash(context.Background(), flat.Hash)
+	assert.Nil(t, apiErr)
+	assert.Equal(t, flat, byHash)
+}
+
+func TestFlatResponseIdempotencyKey(t *testing.T) {
+	gwt := NewGateway(NewMemoryStorage(), config.Default().Flats)
+	withKey := func(key string) FlatOptions {
+		return FlatOptions{IdempotencyKey: key}
+	}
+
+	first, apiErr := flatResponse(gwt, []interface{}{1, []interface{}{2}}, withKey("a"))
+	assert.Nil(t, apiErr)
+	assert.False(t, first.Replayed)
+
+	replay, apiErr := flatResponse(gwt, []interface{}{1, []interface{}{2}}, withKey("a"))
+	assert.Nil(t, apiErr)
+	assert.True(t, replay.Replayed)
+	assert.False(t, replay.Deduplicated)
+	assert.Equal(t, first.ID, replay.ID)
+	assert.Equal(t, first.Data, replay.Data)
+
+	// other array or other options are a different request
+	_, apiErr = flatResponse(gwt, []interface{}{1, []interface{}{3}}, withKey("a"))
+	assert.NotNil(t, apiErr)
+	assert.Equal(t, http.StatusConflict, apiErr.Status())
+	assert.Equal(t, "the Idempotency-Key a was already used with a different request", apiErr.Message())
+
+	depth := 0
+	_, apiErr = flatResponse(gwt, []interface{}{1, []interface{}{2}}, FlatOptions{IdempotencyKey: "a", Depth: &depth})
+	assert.NotNil(t, apiErr)
+	assert.Equal(t, http.StatusConflict, apiErr.Status())
+
+	_, apiErr = flatResponse(gwt, []interface{}{1, []interface{}{2}}, FlatOptions{IdempotencyKey: "a", WithStats: true})
+	assert.NotNil(t, apiErr)
+	assert.Equal(t, http.StatusConflict, apiErr.Status())
+
+	// another key with the same array is deduplicated and replayed as deduplicated
+	for i, replayed := range []bool{false, true} {
+		fr, apiErr := flatResponse(gwt, []interface{}{1, []interface{}{2}}, withKey("b"))
+		assert.Nil(t, apiErr, i)
+		assert.Equal(t, first.ID, fr.ID)
+		assert.True(t, fr.Deduplicated)
+		assert.Equal(t, replayed, fr.Replayed)
+	}
+}
+
+func TestFlatResponseIdempotencyKeyWithoutOptions(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockStorage := NewMockStorage(mockCtrl)
+	gwt := NewGateway(mockStorage, config.Default().Flats)
+
+	// the keys saved before the options fingerprint are replayed with any options
+	fi, apiErr := FlatArray([]interface{}{1}, FlatOptions{})
+	assert.Nil(t, apiErr)
+	fi.ID = "saved1234"
+	fi.IdempotencyKeys = []IdempotencyKey{{Key: "a", ExpiresAt: time.Now().Add(time.Hour)}}
+	mockStorage.EXPECT().getByIdempotencyKey(gomock.Any(), "a").Return(fi, nil)
+
+	fr, apiErr := flatResponse(gwt, []interface{}{1}, FlatOptions{IdempotencyKey: "a", WithStats: true})
+	assert.Nil(t, apiErr)
+	assert.Equal(t, "saved1234", fr.ID)
+	assert.True(t, fr.Replayed)
+}
+
+func TestFlatResponseIdempotencyKeyErrors(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockStorage := NewMockStorage(mockCtrl)
+	gwt := NewGateway(mockStorage, config.Default().Flats)
+
+	gomock.InOrder(
+		mockStorage.EXPECT().getByIdempotencyKey(gomock.Any(), "a").Return(FlatInfo{}, apierrors.NewInternalServerError("database error")),
+		mockStorage.EXPECT().getByIdempotencyKey(gomock.Any(), "a").Return(FlatInfo{}, apierrors.NewNotFoundError("flat_info with idempotency key a not found")),
+		mockStorage.EXPECT().create(gomock.Any(), gomock.Any()).Return("", apierrors.NewConflictError("flat_info with hash x already exists")),
+		mockStorage.EXPECT().getByHash(gomock.Any(), gomock.Any()).Return(FlatInfo{ID: "saved1234"}, nil),
+		mockStorage.EXPECT().addIdempotencyKey(gomock.Any(), "saved1234", gomock.Any()).Return(apierrors.NewInternalServerError("database error")),
+	)
+
+	_, apiErr := flatResponse(gwt, []interface{}{1}, FlatOptions{IdempotencyKey: "a"})
+	assert.NotNil(t, apiErr)
+	assert.Equal(t, "error getting the flat_info of the Idempotency-Key", apiErr.Message())
+
+	_, apiErr = flatResponse(gwt, []interface{}{1}, FlatOptions{IdempotencyKey: "a"})
+	assert.NotNil(t, apiErr)
+	assert.Equal(t, "error saving the Idempotency-Key", apiErr.Message())
+}
+
+func TestFlatResponseConflict(t *testing.T) {
+	testCases := []struct {
+		Name         string
+		SavedErr     apierrors.RestErr
+		Retry        bool
+		ID           string
+		Deduplicated bool
+		Message      string
+	}{
+		{"deduplicated", nil, false, "saved1234", true, ""},
+		{"deleted_after_conflict", apierrors.NewNotFoundError("flat_info with hash x not found"), true, "new1234", false, ""},
+		{"db_error", apierrors.NewInternalServerError("db error"), false, "", false, "error getting the flat_info with the same hash"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+
+			mockStorage := NewMockStorage(mockCtrl)
+			gwt := NewGateway(mockStorage, config.Default().Flats)
+
+			conflict := mockStorage.
+				EXPECT().
+				create(gomock.Any(), gomock.Any()).Return("", apierrors.NewConflictError("flat_info with hash x already exists")).
+				Times(1)
+			getByHash := mockStorage.
+				EXPECT().
+				getByHash(gomock.Any(), gomock.Any()).Return(FlatInfo{ID: "saved1234"}, tc.SavedErr).
+				After(conflict).
+				Times(1)
+			if tc.Retry {
+				mockStorage.
+					EXPECT().
+					create(gomock.Any(), gomock.Any()).Return("new1234", nil).
+					After(getByHash).
+					Times(1)
+			}
+
+			fr, apiErr := flatResponse(gwt, []interface{}{1, 2}, FlatOptions{})
+			if tc.Message != "" {
+				assert.NotNil(t, apiErr)
+				assert.Equal(t, tc.Message, apiErr.Message())
+				return
+			}
+			assert.Nil(t, apiErr)
+			assert.Equal(t, tc.ID, fr.ID)
+			assert.Equal(t, tc.Deduplicated, fr.Deduplicated)
+		})
+	}
+}
+
+func TestFlatBatchResponse(t *testing.T) {
+	cfg := config.Flats{Limit: 100, MaxDepth: 2, MaxBatchSize: 10, BatchWorkers: 3}
+	gwt := NewGateway(NewMemoryStorage(), cfg)
+
+	inputs := []json.RawMessage{
+		json.RawMessage(`[1,[2,[3]]]`),
+		json.RawMessage(`[{"a":1}]`),
+		json.RawMessage(`[[[[1]]]]`),
+		json.RawMessage(`null`),
+		json.RawMessage(`[1, [2, [3]]]`),
+		json.RawMessage(`[12345678901234567890]`),
+	}
+	batch, apiErr := gwt.FlatBatchResponse(context.Background(), inputs, FlatOptions{WithShape: true})
+	assert.Nil(t, apiErr)
+	assert.Len(t, batch.Items, len(inputs))
+
+	expected := []struct {
+		Status  int
+		Message string
+	}{
+		{http.StatusOK, ""},
+		{http.StatusBadRequest, "object is not a valid value inside an array"},
+		{http.StatusBadRequest, "the array exceeds the max depth allowed of 2"},
+		{http.StatusBadRequest, "error parsing body"},
+		{http.StatusOK, ""},
+		{http.StatusOK, ""},
+	}
+	for i, item := range batch.Items {
+		assert.Equal(t, expected[i].Status, item.Status, i)
+		if expected[i].Status != http.StatusOK {
+			assert.Nil(t, item.Result, i)
+			assert.Contains(t, item.Error.Message(), expected[i].Message, i)
+			continue
+		}
+		assert.Nil(t, item.Error, i)
+		assert.NotEmpty(t, item.Result.ID, i)
+	}
+
+	first := batch.Items[0].Result
+	assert.Equal(t, []interface{}{json.Number("1"), json.Number("2"), json.Number("3")}, first.Data)
+	assert.Equal(t, "[*[*[*]]]", first.Shape)
+	assert.False(t, first.Deduplicated)
+
+	// the same array in the batch is deduplicated
+	assert.Equal(t, first.ID, batch.Items[4].Result.ID)
+	assert.True(t, batch.Items[4].Result.Deduplicated)
+	assert.Equal(t, []interface{}{json.Number("12345678901234567890")}, batch.Items[5].Result.Data)
+
+	saved, apiErr := gwt.GetFlat(context.Background(), batch.Items[5].Result.ID)
+	assert.Nil(t, apiErr)
+	assert.Equal(t, FlatTypeArray, saved.Type)
+
+	_, apiErr = gwt.FlatBatchResponse(context.Background(), []json.RawMessage{}, FlatOptions{})
+	assert.NotNil(t, apiErr)
+	assert.Equal(t, http.StatusBadRequest, apiErr.Status())
+	assert.Equal(t, "the batch can not be empty", apiErr.Message())
+
+	tooMany := make([]json.RawMessage, 11)
+	_, apiErr = gwt.FlatBatchResponse(context.Background(), tooMany, FlatOptions{})
+	assert.NotNil(t, apiErr)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, apiErr.Status())
+	assert.Equal(t, "the batch can not have more than 10 arrays", apiErr.Message())
+}
+
+func TestFlatBatchResponseDatabaseError(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockStorage := NewMockStorage(mockCtrl)
+	gwt := NewGateway(mockStorage, config.Default().Flats)
+
+	// the array with an error is not saved
+	mockStorage.
+		EXPECT().
+		createMany(gomock.Any(), gomock.Len(2)).
+		Return([]string{"", "qwery12345"}, []apierrors.RestErr{apierrors.NewInternalServerError("db error"), nil}).
+		Times(1)
+
+	inputs := []json.RawMessage{json.RawMessage(`[1]`), json.RawMessage(`[1,`), json.RawMessage(`[2]`)}
+	batch, apiErr := gwt.FlatBatchResponse(context.Background(), inputs, FlatOptions{})
+	assert.Nil(t, apiErr)
+
+	assert.Equal(t, http.StatusInternalServerError, batch.Items[0].Status)
+	assert.Equal(t, "error saving the flat_info", batch.Items[0].Error.Message())
+	assert.Equal(t, http.StatusBadRequest, batch.Items[1].Status)
+	assert.Equal(t, http.StatusOK, batch.Items[2].Status)
+	assert.Equal(t, "qwery12345", batch.Items[2].Result.ID)
+}
+
+func TestFlatDocumentResponse(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockStorage := NewMockStorage(mockCtrl)
+	gwt := NewGateway(mockStorage, config.Default().Flats)
+
+	var saved FlatInfo
+	mockStorage.
+		EXPECT().
+		create(gomock.Any(), gomock.Any()).
+		DoAndReturn(func(_ context.Context, fi FlatInfo) (string, apierrors.RestErr) {
+			saved = fi
+			return "qwery12345", nil
+		}).
+		Times(1)
+
+	input := map[string]interface{}{"a": []interface{}{"x", map[string]interface{}{"b": nil}}}
+	fr, apiErr := gwt.FlatDocumentResponse(context.Background(), input)
+	assert.Nil(t, apiErr)
+	assert.Equal(t, "qwery12345", fr.ID)
+	assert.Equal(t, 1, fr.MaxDepth)
+	assert.Equal(t, map[string]interface{}{"a[0]": "x", "a[1].b": nil}, fr.Data)
+
+	// the saved document is returned with both shapes
+	mockStorage.
+		EXPECT().
+		get(gomock.Any(), "qwery12345").
+		Return(saved, nil).
+		Times(1)
+
+	flat, apiErr := gwt.GetFlat(context.Background(), "qwery12345")
+	assert.Nil(t, apiErr)
+	assert.Equal(t, FlatTypeDocument, flat.Type)
+	assert.Equal(t, input, flat.Unflatted)
+	assert.Equal(t, fr.Data, flat.Flatted)
+
+	_, apiErr = gwt.FlatDocumentResponse(context.Background(), "value")
+	assert.NotNil(t, apiErr)
+	assert.Equal(t, http.StatusBadRequest, apiErr.Status())
+}
+
+func TestFlatResponseWithShape(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockStorage := NewMockStorage(mockCtrl)
+	gwt := NewGateway(mockStorage, config.Default().Flats)
+
+	mockStorage.
+		EXPECT().
+		create(gomock.Any(), gomock.Any()).Return("qwery12345", nil).
+		Times(2)
+
+	input, err := buildDepthLevel3()
+	assert.Nil(t, err)
+
+	fr, apiErr := flatResponse(gwt, input, FlatOptions{})
+	assert.Nil(t, apiErr)
+	assert.Empty(t, fr.Shape)
+
+	fr, apiErr = flatResponse(gwt, input, FlatOptions{WithShape: true})
+	assert.Nil(t, apiErr)
+	assert.Equal(t, "[**[[**[*]]**][*]]", fr.Shape)
+
+	// the response can be unflatted without the storage
+	unflat, apiErr := gwt.Unflatten(UnflatRequest{Flatted: fr.Data, Shape: fr.Shape})
+	assert.Nil(t, apiErr)
+	unflatted, err := json.Marshal(unflat.Unflatted)
+	assert.Nil(t, err)
+	assert.Equal(t, `[1,2,[[false,"test",[8]],3,7],["some"]]`, string(unflatted))
+
+	_, apiErr = gwt.Unflatten(UnflatRequest{Flatted: fr.Data, Shape: "[*]"})
+	assert.NotNil(t, apiErr)
+	assert.Equal(t, http.StatusBadRequest, apiErr.Status())
+
+	// the shape is a string, so its depth is only limited by the config
+	_, apiErr = gwt.Unflatten(UnflatRequest{Flatted: []interface{}{}, Shape: strings.Repeat("[", 2500000)})
+	assert.NotNil(t, apiErr)
+	assert.Equal(t, http.StatusBadRequest, apiErr.Status())
+	assert.Equal(t, "the array exceeds the max depth allowed of 1000", apiErr.Message())
+}
+
+func TestFlatResponseWithDepth(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockStorage := NewMockStorage(mockCtrl)
+	gwt := NewGateway(mockStorage, config.Default().Flats)
+
+	var saved FlatInfo
+	mockStorage.
+		EXPECT().
+		create(gomock.Any(), gomock.Any()).
+		DoAndReturn(func(_ context.Context, fi FlatInfo) (string, apierrors.RestErr) {
+			saved = fi
+			return "qwery12345", nil
+		}).
+		Times(1)
+
+	input, err := buildDepthLevel3()
+	assert.Nil(t, err)
+
+	depth := 1
+	fr, apiErr := flatResponse(gwt, input, FlatOptions{Depth: &depth, WithShape: true})
+	assert.Nil(t, apiErr)
+	assert.Equal(t, 3, fr.MaxDepth)
+	assert.Equal(t, "[**[***][*]]", fr.Shape)
+	assert.Len(t, fr.Data, 6)
+	assert.Empty(t, fr.Paths)
+	assert.Equal(t, 1, *saved.FlatDepth)
+
+	// the saved flat is returned with the same depth
+	mockStorage.
+		EXPECT().
+		get(gomock.Any(), "qwery12345").
+		Return(saved, nil).
+		Times(1)
+
+	flat, apiErr := gwt.GetFlat(context.Background(), "qwery12345")
+	assert.Nil(t, apiErr)
+	flatted, err := json.Marshal(flat.Flatted)
+	assert.Nil(t, err)
+	assert.Equal(t, `[1,2,[false,"test",[8]],3,7,"some"]`, string(flatted))
+}
+
+func TestFlatResponseWithPaths(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockStorage := NewMockStorage(mockCtrl)
+	gwt := NewGateway(mockStorage, config.Default().Flats)
+
+	mockStorage.
+		EXPECT().
+		create(gomock.Any(), gomock.Any()).Return("qwery12345", nil).
+		Times(1)
+
+	input := []interface{}{"a", []interface{}{"b", []interface{}{"c"}}}
+	fr, apiErr := flatResponse(gwt, input, FlatOptions{WithPaths: true})
+	assert.Nil(t, apiErr)
+	assert.Equal(t, []interface{}{"a", "b", "c"}, fr.Data)
+	assert.Equal(t, []ValuePath{
+		{Path: []int{0}, Depth: 0},
+		{Path: []int{1, 0}, Depth: 1},
+		{Path: []int{1, 1, 0}, Depth: 2},
+	}, fr.Paths)
+}
+
+func TestFlatResponseWithStats(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockStorage := NewMockStorage(mockCtrl)
+	gwt := NewGateway(mockStorage, config.Default().Flats)
+
+	var saved FlatInfo
+	mockStorage.
+		EXPECT().
+		create(gomock.Any(), gomock.Any()).
+		DoAndReturn(func(_ context.Context, fi FlatInfo) (string, apierrors.RestErr) {
+			saved = fi
+			return "qwery12345", nil
+		}).
+		Times(2)
+
+	input := []interface{}{"a", nil, []interface{}{}}
+	fr, apiErr := flatResponse(gwt, input, FlatOptions{})
+	assert.Nil(t, apiErr)
+	assert.Nil(t, fr.Stats)
+
+	// the stats are always saved
+	assert.NotNil(t, saved.Stats)
+
+	fr, apiErr = flatResponse(gwt, input, FlatOptions{WithStats: true})
+	assert.Nil(t, apiErr)
+	assert.Equal(t, &FlatStats{
+		Leaves:      2,
+		SubArrays:   1,
+		EmptyArrays: 1,
+		Nulls:       1,
+		Types:       map[string]int{"string": 1, "null": 1},
+		Depths:      []int{3},
+	}, fr.Stats)
+
+	mockStorage.
+		EXPECT().
+		get(gomock.Any(), "qwery12345").
+		Return(saved, nil).
+		Times(1)
+
+	flat, apiErr := gwt.GetFlat(context.Background(), "qwery12345")
+	assert.Nil(t, apiErr)
+	assert.Equal(t, fr.Stats, flat.Stats)
+}
+
 func TestGetFlatsOk(t *testing.T) {
 	mockCtrl := gomock.NewController(t)
 	defer mockCtrl.Finish()
 
 	mockStorage := NewMockStorage(mockCtrl)
-	gwt := NewGateway(mockStorage)
+	gwt := NewGateway(mockStorage, config.Default().Flats)
 
 	mockFlatInfo := getMockFlatInfo()
 	mockStorage.
 		EXPECT().
-		getAll().
+		getAll(gomock.Any(), FlatsQuery{Limit: 11}).
 		Return(mockFlatInfo, nil).
 		Times(1)
 
-	flats, apiErr := gwt.GetFlats()
+	flats, apiErr := gwt.GetFlats(context.Background(), FlatsQuery{Limit: 10})
 	assert.Nil(t, apiErr)
 	assert.NotNil(t, flats)
-	assert.Len(t, flats, 1)
+	assert.Len(t, flats.Items, 1)
+	assert.Empty(t, flats.Next)
+}
+
+func TestGetFlatsNextPage(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockStorage := NewMockStorage(mockCtrl)
+	gwt := NewGateway(mockStorage, config.Default().Flats)
+
+	mockFlatInfo := append(getMockFlatInfo(), getMockFlatInfo()...)
+	mockFlatInfo[1].ID = "qwery67890"
+	mockStorage.
+		EXPECT().
+		getAll(gomock.Any(), FlatsQuery{Limit: 2}).
+		Return(mockFlatInfo, nil).
+		Times(1)
+
+	flats, apiErr := gwt.GetFlats(context.Background(), FlatsQuery{Limit: 1})
+	assert.Nil(t, apiErr)
+	assert.Len(t, flats.Items, 1)
+	assert.Equal(t, mockFlatInfo[0].ID, flats.Items[0].ID)
+
+	cursor, err := DecodeFlatsCursor(flats.Next)
+	assert.Nil(t, err)
+	assert.Equal(t, mockFlatInfo[0].ID, cursor.ID)
+	assert.True(t, mockFlatInfo[0].ProcessedAt.Equal(cursor.ProcessedAt))
 }
 
 func TestGetFlatsDbError(t *testing.T) {
@@ -122,21 +708,210 @@ func TestGetFlatsDbError(t *testing.T) {
 	defer mockCtrl.Finish()
 
 	mockStorage := NewMockStorage(mockCtrl)
-	gwt := NewGateway(mockStorage)
+	gwt := NewGateway(mockStorage, config.Default().Flats)
 
 	dbErr := apierrors.NewInternalServerError("database error")
 	mockStorage.
 		EXPECT().
-		getAll().
+		getAll(gomock.Any(), gomock.Any()).
 		Return(nil, dbErr).
 		Times(1)
 
-	flats, apiErr := gwt.GetFlats()
+	flats, apiErr := gwt.GetFlats(context.Background(), FlatsQuery{Limit: 10})
 	assert.NotNil(t, apiErr)
-	assert.Nil(t, flats)
+	assert.Empty(t, flats.Items)
 	assert.Equal(t, "error getting flat_info from db", apiErr.Message())
 }
 
+func TestStreamFlats(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockStorage := NewMockStorage(mockCtrl)
+	gwt := NewGateway(mockStorage, config.Default().Flats)
+
+	mockFlatInfo := append(getMockFlatInfo(), getMockFlatInfo()...)
+	mockFlatInfo[1].ID = "qwery67890"
+	iterateFlats := func(flats []FlatInfo) func(context.Context, FlatsQuery, func(FlatInfo) apierrors.RestErr) apierrors.RestErr {
+		return func(_ context.Context, _ FlatsQuery, fn func(FlatInfo) apierrors.RestErr) apierrors.RestErr {
+			for _, f := range flats {
+				if err := fn(f); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+	mockStorage.
+		EXPECT().
+		iterate(gomock.Any(), FlatsQuery{Limit: 2}, gomock.Any()).
+		DoAndReturn(iterateFlats(mockFlatInfo)).
+		Times(1)
+	mockStorage.
+		EXPECT().
+		iterate(gomock.Any(), FlatsQuery{Limit: 3}, gomock.Any()).
+		DoAndReturn(iterateFlats(mockFlatInfo)).
+		Times(1)
+
+	// the last one is only used to know that there is a next page
+	items := make([]FlatInfoResponse, 0)
+	next, apiErr := gwt.StreamFlats(context.Background(), FlatsQuery{Limit: 1}, func(fir FlatInfoResponse) error {
+		items = append(items, fir)
+		return nil
+	})
+	assert.Nil(t, apiErr)
+	assert.Len(t, items, 1)
+	assert.Equal(t, mockFlatInfo[0].ID, items[0].ID)
+	cursor, err := DecodeFlatsCursor(next)
+	assert.Nil(t, err)
+	assert.Equal(t, mockFlatInfo[0].ID, cursor.ID)
+
+	// the errors writing the items stop the iteration
+	var calls int
+	_, apiErr = gwt.StreamFlats(context.Background(), FlatsQuery{Limit: 2}, func(fir FlatInfoResponse) error {
+		calls++
+		return errors.New("broken pipe")
+	})
+	assert.NotNil(t, apiErr)
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, "error writing flat_info: broken pipe", apiErr.Message())
+}
+
+func TestStreamFlatsDbError(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockStorage := NewMockStorage(mockCtrl)
+	gwt := NewGateway(mockStorage, config.Default().Flats)
+
+	mockStorage.
+		EXPECT().
+		iterate(gomock.Any(), gomock.Any(), gomock.Any()).
+		Return(apierrors.NewInternalServerError("database error")).
+		Times(1)
+
+	_, apiErr := gwt.StreamFlats(context.Background(), FlatsQuery{Limit: 10}, func(FlatInfoResponse) error {
+		return nil
+	})
+	assert.NotNil(t, apiErr)
+	assert.Equal(t, "error getting flat_info from db", apiErr.Message())
+}
+
+func TestGetFlatOk(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockStorage := NewMockStorage(mockCtrl)
+	gwt := NewGateway(mockStorage, config.Default().Flats)
+
+	mockFlatInfo := getMockFlatInfo()[0]
+	mockStorage.
+		EXPECT().
+		get(gomock.Any(), mockFlatInfo.ID).
+		Return(mockFlatInfo, nil).
+		Times(1)
+
+	flat, apiErr := gwt.GetFlat(context.Background(), mockFlatInfo.ID)
+	assert.Nil(t, apiErr)
+	assert.Equal(t, mockFlatInfo.ID, flat.ID)
+	assert.Equal(t, FlatTypeArray, flat.Type)
+	assert.Equal(t, mockFlatInfo.ProcessedAt, flat.ProcessedAt)
+}
+
+func TestGetFlatErrors(t *testing.T) {
+	testCases := []struct {
+		Name    string
+		DbErr   apierrors.RestErr
+		Status  int
+		Message string
+	}{
+		{"not_found", apierrors.NewNotFoundError("flat_info 1234 not found"), http.StatusNotFound, "flat_info 1234 not found"},
+		{"db_error", apierrors.NewInternalServerError("database error"), http.StatusInternalServerError, "error getting flat_info from db"},
+		{"db_timeout", apierrors.NewGatewayTimeoutError("the database took too long to respond"), http.StatusGatewayTimeout, "the database took too long to respond"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+
+			mockStorage := NewMockStorage(mockCtrl)
+			gwt := NewGateway(mockStorage, config.Default().Flats)
+
+			mockStorage.
+				EXPECT().
+				get(gomock.Any(), "1234").
+				Return(FlatInfo{}, tc.DbErr).
+				Times(1)
+
+			_, apiErr := gwt.GetFlat(context.Background(), "1234")
+			assert.NotNil(t, apiErr)
+			assert.Equal(t, tc.Status, apiErr.Status())
+			assert.Equal(t, tc.Message, apiErr.Message())
+		})
+	}
+}
+
+func TestGetFlatByHashErrors(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockStorage := NewMockStorage(mockCtrl)
+	gwt := NewGateway(mockStorage, config.Default().Flats)
+
+	gomock.InOrder(
+		mockStorage.EXPECT().getByHash(gomock.Any(), "abc").Return(FlatInfo{}, apierrors.NewNotFoundError("flat_info with hash abc not found")),
+		mockStorage.EXPECT().getByHash(gomock.Any(), "abc").Return(FlatInfo{}, apierrors.NewInternalServerError("database error")),
+	)
+
+	_, apiErr := gwt.GetFlatByHash(context.Background(), "abc")
+	assert.NotNil(t, apiErr)
+	assert.Equal(t, http.StatusNotFound, apiErr.Status())
+	assert.Equal(t, "flat_info with hash abc not found", apiErr.Message())
+
+	_, apiErr = gwt.GetFlatByHash(context.Background(), "abc")
+	assert.NotNil(t, apiErr)
+	assert.Equal(t, http.StatusInternalServerError, apiErr.Status())
+	assert.Equal(t, "error getting flat_info from db", apiErr.Message())
+}
+
+func TestDeleteFlat(t *testing.T) {
+	testCases := []struct {
+		Name    string
+		DbErr   apierrors.RestErr
+		Message string
+	}{
+		{"deleted", nil, ""},
+		{"not_found", apierrors.NewNotFoundError("flat_info 1234 not found"), "flat_info 1234 not found"},
+		{"db_error", apierrors.NewInternalServerError("database error"), "error deleting flat_info from db"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+
+			mockStorage := NewMockStorage(mockCtrl)
+			gwt := NewGateway(mockStorage, config.Default().Flats)
+
+			mockStorage.
+				EXPECT().
+				delete(gomock.Any(), "1234").
+				Return(tc.DbErr).
+				Times(1)
+
+			apiErr := gwt.DeleteFlat(context.Background(), "1234")
+			if tc.DbErr == nil {
+				assert.Nil(t, apiErr)
+				return
+			}
+			assert.NotNil(t, apiErr)
+			assert.Equal(t, tc.DbErr.Status(), apiErr.Status())
+			assert.Equal(t, tc.Message, apiErr.Message())
+		})
+	}
+}
+
 func getMockFlatInfo() []FlatInfo {
 	vs := []VertexSecuence{
 		{
@@ -219,6 +994,15 @@ func buildArrayWithObject() ([]interface{}, error) {
 	return unmarshalDepth(b)
 }
 
+// flatResponse calls FlatStreamResponse with the input encoded as JSON
+func flatResponse(gtw Gateway, input []interface{}, opts FlatOptions) (FlatResponse, apierrors.RestErr) {
+	body, err := json.Marshal(input)
+	if err != nil {
+		return FlatResponse{}, apierrors.NewBadRequestError(err.Error())
+	}
+	return gtw.FlatStreamResponse(context.Background(), bytes.NewReader(body), opts)
+}
+
 func unmarshalDepth(b []byte) ([]interface{}, error) {
 	var res []interface{}
 	err := json.Unmarshal(b, &res)
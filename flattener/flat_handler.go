@@ -1,38 +1,231 @@
 package flattener
 
 import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/mendezdev/tgo_flattener/apierrors"
+	"github.com/mendezdev/tgo_flattener/config"
 )
 
 type Handler interface {
 	Post(c *gin.Context)
+	PostBatch(c *gin.Context)
+	PostDocument(c *gin.Context)
+	PostUnflatten(c *gin.Context)
 	GetAll(c *gin.Context)
+	Get(c *gin.Context)
+	GetByHash(c *gin.Context)
+	Delete(c *gin.Context)
+	GetJob(c *gin.Context)
+	GetDeliveries(c *gin.Context)
 }
 
 type handler struct {
-	gtw Gateway
+	gtw       Gateway
+	jobs      Jobs
+	callbacks Callbacks
+	cfg       config.Flats
 }
 
-func NewHandler(flatGateway Gateway) Handler {
+// NewHandler returns the Handler of the flats, callbacks is nil when they are disabled
+func NewHandler(flatGateway Gateway, jobs Jobs, callbacks Callbacks, cfg config.Flats) Handler {
 	return &handler{
-		gtw: flatGateway,
+		gtw:       flatGateway,
+		jobs:      jobs,
+		callbacks: callbacks,
+		cfg:       cfg,
 	}
 }
 
 // Post will flat the request array
-// only is available to receive arrays of simple mixed values
+// only is available to receive arrays of simple mixed values.
+// The numbers are decoded as json.Number to be saved and returned without losing precision.
+// The body is flatted while it is read, so the arrays deeper than the max depth,
+// with too many elements or too large are rejected before reading the whole body.
+// The query params are:
+// objects: what to do with the objects inside the array, reject, leaf or flatten;
+// depth: the number of levels to flat, all of them by default;
+// with_shape: true to return the shape needed by POST /flats/unflatten;
+// with_paths: true to return the path of every value in the original array;
+// with_stats: true to return the statistics of the array;
+// callback_url: an http or https url where the response is POSTed when the array is saved,
+// its host must be allowed by the Callbacks and it can not be a private address;
+// When the same array was already saved with the same options, the response has
+// the id of that record and deduplicated in true.
+// With an Idempotency-Key header, the retries with the same key get the same response with
+// the Idempotent-Replayed header, and a conflict if the body or the options are different.
+// With Accept: application/x-ndjson the flatted values are written one per line while the
+// saved graph is walked, and the last line is a FlatStreamTrailer with the id and the max depth.
+// With async=true the body is only read and the array is flatted in background,
+// the response is a 202 with the job to follow in GET /jobs/:id. The Idempotency-Key
+// is not supported with async=true.
+// The replayed responses of an Idempotency-Key are not sent again to the callback_url
 func (h *handler) Post(c *gin.Context) {
-	var unflatted []interface{}
-	if err := c.ShouldBindJSON(&unflatted); err != nil {
+	opts, optsErr := newFlatOptions(c)
+	if optsErr != nil {
+		c.JSON(optsErr.Status(), optsErr)
+		return
+	}
+	if opts.CallbackURL != "" {
+		if h.callbacks == nil {
+			apiErr := callbacksDisabledError()
+			c.JSON(apiErr.Status(), apiErr)
+			return
+		}
+		if apiErr := h.callbacks.CheckURL(opts.CallbackURL); apiErr != nil {
+			c.JSON(apiErr.Status(), apiErr)
+			return
+		}
+	}
+
+	async, asyncErr := boolQueryParam(c, "async")
+	if asyncErr != nil {
+		c.JSON(asyncErr.Status(), asyncErr)
+		return
+	}
+	if async {
+		h.postAsync(c, opts)
+		return
+	}
+
+	if acceptsNDJSON(c) {
+		h.postNDJSON(c, opts)
+		return
+	}
+
+	flatResponse, err := h.gtw.FlatStreamResponse(c.Request.Context(), c.Request.Body, opts)
+	if err != nil {
+		c.JSON(err.Status(), err)
+		return
+	}
+	if flatResponse.Replayed {
+		c.Header(idempotentReplayedHeader, "true")
+	} else if opts.CallbackURL != "" {
+		h.callbacks.Notify(c.Request.Context(), opts.CallbackURL, flatResponse)
+	}
+	c.JSON(http.StatusOK, flatResponse)
+}
+
+// postNDJSON writes every flatted value as soon as it is built, so the flatted array
+// is only kept in memory when the callback_url needs the whole FlatResponse
+func (h *handler) postNDJSON(c *gin.Context, opts FlatOptions) {
+	flatResponse, values, err := h.gtw.FlatStreamValues(c.Request.Context(), c.Request.Body, opts)
+	if err != nil {
+		c.JSON(err.Status(), err)
+		return
+	}
+	if flatResponse.Replayed {
+		c.Header(idempotentReplayedHeader, "true")
+	} else if opts.CallbackURL != "" {
+		callbackResponse := flatResponse
+		callbackResponse.Data = make([]interface{}, 0)
+		values(func(val interface{}) error {
+			callbackResponse.Data = append(callbackResponse.Data, val)
+			return nil
+		})
+		h.callbacks.Notify(c.Request.Context(), opts.CallbackURL, callbackResponse)
+	}
+
+	w := newNDJSONWriter(c)
+	if err := values(w.write); err != nil {
+		return
+	}
+	w.write(FlatStreamTrailer{
+		ID:           flatResponse.ID,
+		MaxDepth:     flatResponse.MaxDepth,
+		Shape:        flatResponse.Shape,
+		Paths:        flatResponse.Paths,
+		Stats:        flatResponse.Stats,
+		Deduplicated: flatResponse.Deduplicated,
+	})
+	w.flush()
+}
+
+// postAsync reads the body, with the same size limit of the sync requests, and submits the job
+func (h *handler) postAsync(c *gin.Context, opts FlatOptions) {
+	// every job is a new request, so the retries with the key would queue the array again
+	if opts.IdempotencyKey != "" {
+		apiErr := apierrors.NewBadRequestError(fmt.Sprintf("the %s is not supported with async", idempotencyKeyHeader))
+		c.JSON(apiErr.Status(), apiErr)
+		return
+	}
+	input, err := ioutil.ReadAll(newBodyReader(c.Request.Body, h.cfg.MaxBodySize))
+	if err != nil {
+		apiErr := decodeError(err, h.cfg.MaxBodySize)
+		c.JSON(apiErr.Status(), apiErr)
+		return
+	}
+	if !json.Valid(input) {
 		apiErr := apierrors.NewBadRequestError("error parsing body")
-		c.JSON(http.StatusBadRequest, apiErr)
+		c.JSON(apiErr.Status(), apiErr)
+		return
+	}
+
+	job, submitErr := h.jobs.Submit(c.Request.Context(), input, opts)
+	if submitErr != nil {
+		c.JSON(submitErr.Status(), submitErr)
+		return
+	}
+
+	c.Header("Location", "/jobs/"+job.ID)
+	c.JSON(http.StatusAccepted, job)
+}
+
+// PostBatch will flat every array of the request array like Post and save them together.
+// The query params are the same of Post and they are used for all the arrays.
+// The response has the result or the error of every array in the same order,
+// so the arrays with errors do not stop the other ones
+func (h *handler) PostBatch(c *gin.Context) {
+	opts, optsErr := newFlatOptions(c)
+	if optsErr != nil {
+		c.JSON(optsErr.Status(), optsErr)
+		return
+	}
+	if opts.IdempotencyKey != "" {
+		apiErr := apierrors.NewBadRequestError(fmt.Sprintf("the %s is not supported in a batch", idempotencyKeyHeader))
+		c.JSON(apiErr.Status(), apiErr)
+		return
+	}
+	if opts.CallbackURL != "" {
+		apiErr := apierrors.NewBadRequestError("the callback_url is not supported in a batch")
+		c.JSON(apiErr.Status(), apiErr)
+		return
+	}
+
+	// every array is kept as it was sent, it is decoded while it is flatted.
+	// The whole batch has the same size limit of the body of POST /flats
+	var inputs []json.RawMessage
+	if err := json.NewDecoder(newBodyReader(c.Request.Body, h.cfg.MaxBodySize)).Decode(&inputs); err != nil {
+		apiErr := decodeError(err, h.cfg.MaxBodySize)
+		c.JSON(apiErr.Status(), apiErr)
 		return
 	}
 
-	flatResponse, err := h.gtw.FlatResponse(unflatted)
+	batchResponse, err := h.gtw.FlatBatchResponse(c.Request.Context(), inputs, opts)
+	if err != nil {
+		c.JSON(err.Status(), err)
+		return
+	}
+	c.JSON(http.StatusOK, batchResponse)
+}
+
+// PostDocument will flat any JSON document, an object or an array,
+// returning the path of every value as key, e.g: {"a.b[2].c": 1}
+func (h *handler) PostDocument(c *gin.Context) {
+	document, decodeErr := decodeJSON(c.Request.Body, h.cfg.MaxDepth)
+	if decodeErr != nil {
+		c.JSON(decodeErr.Status(), decodeErr)
+		return
+	}
+
+	flatResponse, err := h.gtw.FlatDocumentResponse(c.Request.Context(), document)
 	if err != nil {
 		c.JSON(err.Status(), err)
 		return
@@ -40,10 +233,56 @@ func (h *handler) Post(c *gin.Context) {
 	c.JSON(http.StatusOK, flatResponse)
 }
 
-// GetAll it will return a FlatInfo with a limit.
-// You can see the limit configured in config/config.go file
+// PostUnflatten will rebuild the array with the flatted array and the shape
+// returned by POST /flats?with_shape=true
+func (h *handler) PostUnflatten(c *gin.Context) {
+	var req UnflatRequest
+	decoder := json.NewDecoder(c.Request.Body)
+	decoder.UseNumber()
+	if err := decoder.Decode(&req); err != nil {
+		apiErr := decodeError(err, 0)
+		c.JSON(apiErr.Status(), apiErr)
+		return
+	}
+	if req.Shape == "" {
+		apiErr := apierrors.NewBadRequestError("shape is required")
+		c.JSON(http.StatusBadRequest, apiErr)
+		return
+	}
+
+	unflatResponse, err := h.gtw.Unflatten(req)
+	if err != nil {
+		c.JSON(err.Status(), err)
+		return
+	}
+	c.JSON(http.StatusOK, unflatResponse)
+}
+
+// GetAll it will return a page of FlatInfo with a limit.
+// The max limit is the flats limit of the config.
+// The query params are:
+// limit: the page size;
+// next: the token returned in the previous page;
+// from, to: RFC3339 dates to filter by processed_at, from is inclusive and to is exclusive;
+// min_depth, max_depth: to filter by the max depth of the array;
+// min_leaves, max_leaves: to filter by the number of leaves of the array;
+// has_nulls: to filter the arrays with or without nulls;
+// With Accept: application/x-ndjson the items are written one per line while they are
+// read from the storage and the last line is a FlatsPageTrailer with the next token.
+// If there is an error after the first line, the last line is the error
 func (h *handler) GetAll(c *gin.Context) {
-	flats, err := h.gtw.GetFlats()
+	query, queryErr := newFlatsQuery(c, h.cfg.Limit)
+	if queryErr != nil {
+		c.JSON(queryErr.Status(), queryErr)
+		return
+	}
+
+	if acceptsNDJSON(c) {
+		h.streamAll(c, query)
+		return
+	}
+
+	flats, err := h.gtw.GetFlats(c.Request.Context(), query)
 	if err != nil {
 		c.JSON(err.Status(), err)
 		return
@@ -51,3 +290,293 @@ func (h *handler) GetAll(c *gin.Context) {
 
 	c.JSON(http.StatusOK, flats)
 }
+
+// streamAll writes the page of GET /flats as NDJSON
+func (h *handler) streamAll(c *gin.Context, query FlatsQuery) {
+	var w *ndjsonWriter
+	next, err := h.gtw.StreamFlats(c.Request.Context(), query, func(fir FlatInfoResponse) error {
+		// the status is sent with the first item, so the errors before it are sent as usual
+		if w == nil {
+			w = newNDJSONWriter(c)
+		}
+		return w.write(fir)
+	})
+
+	if err != nil && w == nil {
+		c.JSON(err.Status(), err)
+		return
+	}
+
+	if w == nil {
+		w = newNDJSONWriter(c)
+	}
+	if err != nil {
+		w.write(err)
+	} else {
+		w.write(FlatsPageTrailer{Next: next})
+	}
+	w.flush()
+}
+
+// Get it will return the FlatInfo with the id in the path
+func (h *handler) Get(c *gin.Context) {
+	flat, err := h.gtw.GetFlat(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		c.JSON(err.Status(), err)
+		return
+	}
+
+	c.JSON(http.StatusOK, flat)
+}
+
+// GetByHash it will return the FlatInfo with the content hash in the path
+func (h *handler) GetByHash(c *gin.Context) {
+	flat, err := h.gtw.GetFlatByHash(c.Request.Context(), c.Param("hash"))
+	if err != nil {
+		c.JSON(err.Status(), err)
+		return
+	}
+
+	c.JSON(http.StatusOK, flat)
+}
+
+// Delete it will delete the FlatInfo with the id in the path
+func (h *handler) Delete(c *gin.Context) {
+	if err := h.gtw.DeleteFlat(c.Request.Context(), c.Param("id")); err != nil {
+		c.JSON(err.Status(), err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// GetJob it will return the state of the async flat with the id in the path
+func (h *handler) GetJob(c *gin.Context) {
+	job, err := h.jobs.Get(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		c.JSON(err.Status(), err)
+		return
+	}
+
+	c.JSON(http.StatusOK, job)
+}
+
+// GetDeliveries it will return the callbacks of the FlatInfo with the id in the path,
+// with all their attempts. It is empty if the FlatInfo has no callbacks or it not exists
+func (h *handler) GetDeliveries(c *gin.Context) {
+	if h.callbacks == nil {
+		apiErr := callbacksDisabledError()
+		c.JSON(apiErr.Status(), apiErr)
+		return
+	}
+
+	deliveries, err := h.callbacks.GetDeliveries(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		c.JSON(err.Status(), err)
+		return
+	}
+
+	c.JSON(http.StatusOK, DeliveriesResponse{Deliveries: deliveries})
+}
+
+// callbacksDisabledError is returned when the callbacks are used but the app has not a callbacks secret
+func callbacksDisabledError() apierrors.RestErr {
+	return apierrors.NewBadRequestError("the callbacks are not enabled in this app")
+}
+
+// the headers of the idempotent requests to POST /flats
+const (
+	idempotencyKeyHeader     = "Idempotency-Key"
+	idempotentReplayedHeader = "Idempotent-Replayed"
+)
+
+// maxIdempotencyKeyLength is the max number of characters of an Idempotency-Key
+const maxIdempotencyKeyLength = 255
+
+// ndjsonContentType is the content type of the responses with one JSON value per line
+const ndjsonContentType = "application/x-ndjson"
+
+// ndjsonFlushLines is the number of lines written before sending them to the client
+const ndjsonFlushLines = 100
+
+// acceptsNDJSON returns true if the client prefers NDJSON over JSON in the Accept header
+func acceptsNDJSON(c *gin.Context) bool {
+	return c.NegotiateFormat(gin.MIMEJSON, ndjsonContentType) == ndjsonContentType
+}
+
+// ndjsonWriter writes a JSON value per line in the response,
+// they are sent to the client every ndjsonFlushLines
+type ndjsonWriter struct {
+	c       *gin.Context
+	encoder *json.Encoder
+	lines   int
+}
+
+// newNDJSONWriter sends the status and the headers of the response
+func newNDJSONWriter(c *gin.Context) *ndjsonWriter {
+	c.Header("Content-Type", ndjsonContentType)
+	c.Status(http.StatusOK)
+	c.Writer.WriteHeaderNow()
+	return &ndjsonWriter{c: c, encoder: json.NewEncoder(c.Writer)}
+}
+
+func (w *ndjsonWriter) write(val interface{}) error {
+	if err := w.encoder.Encode(val); err != nil {
+		return err
+	}
+	w.lines++
+	if w.lines%ndjsonFlushLines == 0 {
+		w.flush()
+	}
+	return nil
+}
+
+func (w *ndjsonWriter) flush() {
+	w.c.Writer.Flush()
+}
+
+// newFlatOptions parse the query params and the Idempotency-Key of POST /flats
+func newFlatOptions(c *gin.Context) (FlatOptions, apierrors.RestErr) {
+	opts := FlatOptions{Objects: ObjectsReject}
+
+	switch mode := ObjectMode(c.Query("objects")); mode {
+	case "":
+	case ObjectsReject, ObjectsLeaf, ObjectsFlatten:
+		opts.Objects = mode
+	default:
+		return opts, apierrors.NewBadRequestError("objects must be reject, leaf or flatten")
+	}
+
+	var err apierrors.RestErr
+	if opts.Depth, err = depthQueryParam(c, "depth"); err != nil {
+		return opts, err
+	}
+	if opts.WithShape, err = boolQueryParam(c, "with_shape"); err != nil {
+		return opts, err
+	}
+	if opts.WithPaths, err = boolQueryParam(c, "with_paths"); err != nil {
+		return opts, err
+	}
+	if opts.WithStats, err = boolQueryParam(c, "with_stats"); err != nil {
+		return opts, err
+	}
+
+	if callbackURL := c.Query("callback_url"); callbackURL != "" {
+		parsed, parseErr := url.Parse(callbackURL)
+		if parseErr != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return opts, apierrors.NewBadRequestError("callback_url must be an absolute http or https url")
+		}
+		opts.CallbackURL = callbackURL
+	}
+
+	opts.IdempotencyKey = c.GetHeader(idempotencyKeyHeader)
+	if len(opts.IdempotencyKey) > maxIdempotencyKeyLength {
+		return opts, apierrors.NewBadRequestError(fmt.Sprintf("the %s can not be longer than %d characters", idempotencyKeyHeader, maxIdempotencyKeyLength))
+	}
+
+	return opts, nil
+}
+
+// newFlatsQuery parse the query params of GET /flats.
+// The limit can not be greater than maxLimit
+func newFlatsQuery(c *gin.Context, maxLimit int64) (FlatsQuery, apierrors.RestErr) {
+	query := FlatsQuery{Limit: maxLimit}
+
+	if limit := c.Query("limit"); limit != "" {
+		parsed, err := strconv.ParseInt(limit, 10, 64)
+		if err != nil || parsed <= 0 {
+			return query, apierrors.NewBadRequestError("limit must be a positive number")
+		}
+		if parsed < maxLimit {
+			query.Limit = parsed
+		}
+	}
+
+	if next := c.Query("next"); next != "" {
+		cursor, err := DecodeFlatsCursor(next)
+		if err != nil {
+			return query, apierrors.NewBadRequestError("invalid next cursor")
+		}
+		query.Cursor = cursor
+	}
+
+	var err apierrors.RestErr
+	if query.From, err = timeQueryParam(c, "from"); err != nil {
+		return query, err
+	}
+	if query.To, err = timeQueryParam(c, "to"); err != nil {
+		return query, err
+	}
+	if query.MinDepth, err = depthQueryParam(c, "min_depth"); err != nil {
+		return query, err
+	}
+	if query.MaxDepth, err = depthQueryParam(c, "max_depth"); err != nil {
+		return query, err
+	}
+	if query.MinLeaves, err = depthQueryParam(c, "min_leaves"); err != nil {
+		return query, err
+	}
+	if query.MaxLeaves, err = depthQueryParam(c, "max_leaves"); err != nil {
+		return query, err
+	}
+	if query.HasNulls, err = optionalBoolQueryParam(c, "has_nulls"); err != nil {
+		return query, err
+	}
+
+	return query, nil
+}
+
+// boolQueryParam returns false if the param is not in the query
+func boolQueryParam(c *gin.Context, param string) (bool, apierrors.RestErr) {
+	value := c.Query(param)
+	if value == "" {
+		return false, nil
+	}
+
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, apierrors.NewBadRequestError(fmt.Sprintf("%s must be true or false", param))
+	}
+	return parsed, nil
+}
+
+// optionalBoolQueryParam returns nil if the param is not in the query
+func optionalBoolQueryParam(c *gin.Context, param string) (*bool, apierrors.RestErr) {
+	if c.Query(param) == "" {
+		return nil, nil
+	}
+
+	parsed, err := boolQueryParam(c, param)
+	if err != nil {
+		return nil, err
+	}
+	return &parsed, nil
+}
+
+// timeQueryParam returns nil if the param is not in the query
+func timeQueryParam(c *gin.Context, param string) (*time.Time, apierrors.RestErr) {
+	value := c.Query(param)
+	if value == "" {
+		return nil, nil
+	}
+
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return nil, apierrors.NewBadRequestError(fmt.Sprintf("%s must be a RFC3339 date", param))
+	}
+	return &parsed, nil
+}
+
+// depthQueryParam returns nil if the param is not in the query
+func depthQueryParam(c *gin.Context, param string) (*int, apierrors.RestErr) {
+	value := c.Query(param)
+	if value == "" {
+		return nil, nil
+	}
+
+	parsed, err := strconv.Atoi(value)
+	if err != nil || parsed < 0 {
+		return nil, apierrors.NewBadRequestError(fmt.Sprintf("%s must be a number greater or equal than zero", param))
+	}
+	return &parsed, nil
+}
@@ -1,7 +1,9 @@
 package flattener
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"strings"
@@ -11,6 +13,7 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/golang/mock/gomock"
 	"github.com/mendezdev/tgo_flattener/apierrors"
+	"github.com/mendezdev/tgo_flattener/config"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -19,7 +22,7 @@ func TestPostFlatsOK(t *testing.T) {
 	defer mockCtrl.Finish()
 
 	mockGtw := NewMockGateway(mockCtrl)
-	h := NewHandler(mockGtw)
+	h := NewHandler(mockGtw, nil, nil, config.Default().Flats)
 
 	mockedRequest := mockFlatRequest()
 	mockedResponse := mockFlatResponse()
@@ -29,7 +32,7 @@ func TestPostFlatsOK(t *testing.T) {
 
 	mockGtw.
 		EXPECT().
-		FlatResponse(gomock.Any()).Return(mockedResponse, nil).
+		FlatStreamResponse(gomock.Any(), gomock.Any(), gomock.Any()).Return(mockedResponse, nil).
 		Times(1)
 
 	nr := httptest.NewRecorder()
@@ -45,63 +48,740 @@ func TestPostFlatsOK(t *testing.T) {
 	assert.Equal(t, mockedResponse, fr)
 }
 
-func TestPostFlatBadRequest(t *testing.T) {
+func TestPostFlatsNDJSON(t *testing.T) {
 	mockCtrl := gomock.NewController(t)
 	defer mockCtrl.Finish()
 
 	mockGtw := NewMockGateway(mockCtrl)
-	h := NewHandler(mockGtw)
+	h := NewHandler(mockGtw, nil, nil, config.Default().Flats)
+
+	mockedResponse := mockFlatResponse()
+	mockedResponse.Shape = "[***]"
+	data := mockedResponse.Data
+	mockedResponse.Data = nil
+	values := func(fn func(val interface{}) error) error {
+		for _, val := range data {
+			if err := fn(val); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	mockGtw.
+		EXPECT().
+		FlatStreamValues(gomock.Any(), gomock.Any(), gomock.Any()).Return(mockedResponse, FlatValues(values), nil).
+		Times(1)
+
+	nr := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(nr)
+	c.Request, _ = http.NewRequest(http.MethodPost, "/flats", strings.NewReader(`["test1","test2","test3"]`))
+	c.Request.Header.Set("Accept", "application/x-ndjson")
+	h.Post(c)
+
+	assert.Equal(t, http.StatusOK, nr.Code)
+	assert.Equal(t, "application/x-ndjson", nr.Header().Get("Content-Type"))
+	expected := `"test1"
+"test2"
+"test3"
+{"id":"1234qwerty","max_depth":0,"shape":"[***]"}
+`
+	assert.Equal(t, expected, nr.Body.String())
+}
+
+func TestPostFlatsNDJSONCallback(t *testing.T) {
+	receiver := newCallbackReceiver(t)
+	storage := NewMemoryStorage()
+	callbacks := NewCallbackDispatcher(storage, testCallbacksConfig())
+	callbacks.Start()
+	defer callbacks.Stop()
+	h := NewHandler(NewGateway(storage, config.Default().Flats), nil, callbacks, config.Default().Flats)
+
+	nr := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(nr)
+	c.Request, _ = http.NewRequest(http.MethodPost, "/flats?depth=1&callback_url="+receiver.URL, strings.NewReader(`[1,[2,[3]]]`))
+	c.Request.Header.Set("Accept", "application/x-ndjson")
+	h.Post(c)
+
+	assert.Equal(t, http.StatusOK, nr.Code)
+	lines := strings.Split(strings.TrimSuffix(nr.Body.String(), "\n"), "\n")
+	assert.Equal(t, []string{"1", "2", "[3]"}, lines[:3])
+	var trailer FlatStreamTrailer
+	assert.Nil(t, json.Unmarshal([]byte(lines[3]), &trailer))
+
+	// the callback has the whole flatted array
+	deliveries := waitDeliveries(t, callbacks, trailer.ID, 1)
+	assert.Equal(t, 1, len(deliveries))
+	assert.Equal(t, DeliveryDelivered, deliveries[0].Status)
+	requests := receiver.requests()
+	assert.Equal(t, 1, len(requests))
+	expected := fmt.Sprintf(`{"id":%q,"max_depth":2,"flatted_data":[1,2,[3]]}`, trailer.ID)
+	assert.JSONEq(t, expected, string(requests[0].Body))
+}
+
+func TestPostFlatsKeepsNumbersPrecision(t *testing.T) {
+	h := NewHandler(NewGateway(NewMemoryStorage(), config.Default().Flats), nil, nil, config.Default().Flats)
+
+	body := `[12345678901234567890,1.5e300,[]]`
+	nr := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(nr)
+	c.Request, _ = http.NewRequest(http.MethodPost, "/flats", strings.NewReader(body))
+	h.Post(c)
+
+	assert.Equal(t, http.StatusOK, c.Writer.Status())
+	assert.Contains(t, nr.Body.String(), `[12345678901234567890,1.5e300]`)
+}
+
+func TestPostFlatBadRequest(t *testing.T) {
+	h := NewHandler(NewGateway(NewMemoryStorage(), config.Default().Flats), nil, nil, config.Default().Flats)
+
+	for _, body := range []string{`{"superkey":"supervalue"}`, `[1,2`, `"value"`, ``} {
+		nr := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(nr)
+		c.Request, _ = http.NewRequest("POST", "/flats", strings.NewReader(body))
+		h.Post(c)
+
+		assert.Equal(t, http.StatusBadRequest, c.Writer.Status())
+		assert.Contains(t, nr.Body.String(), "error parsing body")
+	}
+}
+
+func TestPostFlatObjectsDepth(t *testing.T) {
+	// the objects are counted in the depth limit while the body is read,
+	// before the json decoder fails with its own limit of 10000 levels
+	depth := 20000
+	object := strings.Repeat(`{"a":`, depth) + "1" + strings.Repeat("}", depth)
+	h := NewHandler(NewGateway(NewMemoryStorage(), config.Default().Flats), nil, nil, config.Default().Flats)
+
+	testCases := []struct {
+		Name string
+		URL  string
+		Body string
+		Post func(c *gin.Context)
+	}{
+		{"leaf", "/flats?objects=leaf", "[" + object + "]", h.Post},
+		{"flatten", "/flats?objects=flatten", "[" + object + "]", h.Post},
+		{"document", "/flats/documents", object, h.PostDocument},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			nr := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(nr)
+			c.Request, _ = http.NewRequest(http.MethodPost, tc.URL, strings.NewReader(tc.Body))
+			tc.Post(c)
+
+			assert.Equal(t, http.StatusBadRequest, c.Writer.Status())
+			assert.Contains(t, nr.Body.String(), "the array exceeds the max depth allowed of 1000")
+		})
+	}
+}
+
+func TestPostFlatLimits(t *testing.T) {
+	// the body is rejected while it is read, before the whole array is built
+	depth := 100000
+	testCases := []struct {
+		Name    string
+		Config  config.Flats
+		Body    string
+		Status  int
+		Message string
+	}{
+		{"depth", config.Default().Flats, strings.Repeat("[", depth) + strings.Repeat("]", depth), http.StatusBadRequest, "the array exceeds the max depth allowed of 1000"},
+		{"elements", config.Flats{Limit: 100, MaxElements: 5}, `[1,2,3,[4,5]]`, http.StatusRequestEntityTooLarge, "the array exceeds the max elements allowed of 5"},
+		{"body_size", config.Flats{Limit: 100, MaxBodySize: 1 << 20}, "[" + strings.Repeat(" ", 1<<20) + "]", http.StatusRequestEntityTooLarge, "the body can not be greater than 1048576 bytes"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			h := NewHandler(NewGateway(NewMemoryStorage(), tc.Config), nil, nil, tc.Config)
+
+			nr := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(nr)
+			c.Request, _ = http.NewRequest(http.MethodPost, "/flats", strings.NewReader(tc.Body))
+			h.Post(c)
+
+			assert.Equal(t, tc.Status, c.Writer.Status())
+			assert.Contains(t, nr.Body.String(), tc.Message)
+		})
+	}
+}
+
+func TestPostFlatIdempotencyKey(t *testing.T) {
+	h := NewHandler(NewGateway(NewMemoryStorage(), config.Default().Flats), nil, nil, config.Default().Flats)
+
+	post := func(key string, body string) *httptest.ResponseRecorder {
+		nr := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(nr)
+		c.Request, _ = http.NewRequest(http.MethodPost, "/flats", strings.NewReader(body))
+		c.Request.Header.Set("Idempotency-Key", key)
+		h.Post(c)
+		return nr
+	}
+
+	first := post("job-1", `[1,[2]]`)
+	assert.Equal(t, http.StatusOK, first.Code)
+	assert.Empty(t, first.Header().Get("Idempotent-Replayed"))
+
+	replay := post("job-1", `[1,[2]]`)
+	assert.Equal(t, http.StatusOK, replay.Code)
+	assert.Equal(t, "true", replay.Header().Get("Idempotent-Replayed"))
+	assert.JSONEq(t, first.Body.String(), replay.Body.String())
+
+	conflict := post("job-1", `[1,[3]]`)
+	assert.Equal(t, http.StatusConflict, conflict.Code)
+	assert.Contains(t, conflict.Body.String(), "the Idempotency-Key job-1 was already used with a different request")
+
+	// the same body with other options that change the response is a different request too
+	for _, query := range []string{"with_shape=true", "with_paths=true", "with_stats=true"} {
+		nr := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(nr)
+		c.Request, _ = http.NewRequest(http.MethodPost, "/flats?"+query, strings.NewReader(`[1,[2]]`))
+		c.Request.Header.Set("Idempotency-Key", "job-1")
+		h.Post(c)
+		assert.Equal(t, http.StatusConflict, nr.Code, query)
+		assert.Empty(t, nr.Header().Get("Idempotent-Replayed"), query)
+	}
+
+	tooLong := post(strings.Repeat("k", 256), `[1,[2]]`)
+	assert.Equal(t, http.StatusBadRequest, tooLong.Code)
+	assert.Contains(t, tooLong.Body.String(), "the Idempotency-Key can not be longer than 255 characters")
+}
+
+func TestPostFlatBatch(t *testing.T) {
+	h := NewHandler(NewGateway(NewMemoryStorage(), config.Default().Flats), nil, nil, config.Default().Flats)
+
+	nr := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(nr)
+	c.Request, _ = http.NewRequest(http.MethodPost, "/flats/batch?with_stats=true", strings.NewReader(`[[1,[2]],"value",[[3]]]`))
+	h.PostBatch(c)
+
+	assert.Equal(t, http.StatusOK, c.Writer.Status())
+	var response struct {
+		Items []struct {
+			Status int                    `json:"status"`
+			Result map[string]interface{} `json:"result"`
+			Error  map[string]interface{} `json:"error"`
+		} `json:"items"`
+	}
+	assert.Nil(t, json.Unmarshal(nr.Body.Bytes(), &response))
+	assert.Len(t, response.Items, 3)
+	assert.Equal(t, http.StatusOK, response.Items[0].Status)
+	assert.Equal(t, []interface{}{float64(1), float64(2)}, response.Items[0].Result["flatted_data"])
+	assert.NotNil(t, response.Items[0].Result["stats"])
+	assert.Nil(t, response.Items[0].Error)
+	assert.Equal(t, http.StatusBadRequest, response.Items[1].Status)
+	assert.Equal(t, "error parsing body", response.Items[1].Error["message"])
+	assert.Nil(t, response.Items[1].Result)
+	assert.Equal(t, http.StatusOK, response.Items[2].Status)
+	assert.Equal(t, []interface{}{float64(3)}, response.Items[2].Result["flatted_data"])
+
+	testCases := []struct {
+		Name    string
+		Body    string
+		Key     string
+		Message string
+	}{
+		{"not_array", `{"a":[1]}`, "", "error parsing body"},
+		{"empty", `[]`, "", "the batch can not be empty"},
+		{"idempotency_key", `[[1]]`, "job-1", "the Idempotency-Key is not supported in a batch"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			nr := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(nr)
+			c.Request, _ = http.NewRequest(http.MethodPost, "/flats/batch", strings.NewReader(tc.Body))
+			if tc.Key != "" {
+				c.Request.Header.Set("Idempotency-Key", tc.Key)
+			}
+			h.PostBatch(c)
+
+			assert.Equal(t, http.StatusBadRequest, c.Writer.Status())
+			assert.Contains(t, nr.Body.String(), tc.Message)
+		})
+	}
+
+	// the whole batch is limited by the max body size
+	cfg := config.Default().Flats
+	cfg.MaxBodySize = 10
+	limited := NewHandler(NewGateway(NewMemoryStorage(), cfg), nil, nil, cfg)
+	nr = httptest.NewRecorder()
+	c, _ = gin.CreateTestContext(nr)
+	c.Request, _ = http.NewRequest(http.MethodPost, "/flats/batch", strings.NewReader(`[[1],[2],[3]]`))
+	limited.PostBatch(c)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, c.Writer.Status())
+	assert.Contains(t, nr.Body.String(), "the body can not be greater than 10 bytes")
+}
 
-	mockedRequest := make(map[string]string)
-	mockedRequest["superkey"] = "supervalue"
+func TestPostFlatCallback(t *testing.T) {
+	receiver := newCallbackReceiver(t)
+	storage := NewMemoryStorage()
+	callbacks := NewCallbackDispatcher(storage, testCallbacksConfig())
+	callbacks.Start()
+	defer callbacks.Stop()
+	h := NewHandler(NewGateway(storage, config.Default().Flats), nil, callbacks, config.Default().Flats)
+
+	post := func(url string, key string) *httptest.ResponseRecorder {
+		nr := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(nr)
+		c.Request, _ = http.NewRequest(http.MethodPost, url, strings.NewReader(`[1,[2,[3]]]`))
+		c.Request.Header.Set("Idempotency-Key", key)
+		h.Post(c)
+		return nr
+	}
+
+	// the replayed response of the Idempotency-Key is not sent again
+	url := "/flats?with_stats=true&callback_url=" + receiver.URL
+	first := post(url, "callback-1")
+	assert.Equal(t, http.StatusOK, first.Code)
+	replayed := post(url, "callback-1")
+	assert.Equal(t, http.StatusOK, replayed.Code)
+	assert.Equal(t, "true", replayed.Header().Get("Idempotent-Replayed"))
+
+	var fr FlatResponse
+	assert.Nil(t, json.Unmarshal(first.Body.Bytes(), &fr))
+	deliveries := waitDeliveries(t, callbacks, fr.ID, 1)
+	assert.Equal(t, 1, len(deliveries))
+	assert.Equal(t, DeliveryDelivered, deliveries[0].Status)
+
+	requests := receiver.requests()
+	assert.Equal(t, 1, len(requests))
+	assert.JSONEq(t, first.Body.String(), string(requests[0].Body))
+
+	nr := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(nr)
+	c.Params = gin.Params{{Key: "id", Value: fr.ID}}
+	c.Request, _ = http.NewRequest(http.MethodGet, "/flats/"+fr.ID+"/deliveries", nil)
+	h.GetDeliveries(c)
+	assert.Equal(t, http.StatusOK, c.Writer.Status())
+	var deliveriesResponse DeliveriesResponse
+	assert.Nil(t, json.Unmarshal(nr.Body.Bytes(), &deliveriesResponse))
+	assert.Equal(t, 1, len(deliveriesResponse.Deliveries))
+	assert.Equal(t, deliveries[0].ID, deliveriesResponse.Deliveries[0].ID)
+	assert.Equal(t, 1, len(deliveriesResponse.Deliveries[0].Attempts))
+
+	disabled := NewHandler(NewGateway(NewMemoryStorage(), config.Default().Flats), nil, nil, config.Default().Flats)
+	restrictedCfg := testCallbacksConfig()
+	restrictedCfg.AllowPrivate = false
+	restricted := NewHandler(NewGateway(NewMemoryStorage(), config.Default().Flats), nil, NewCallbackDispatcher(storage, restrictedCfg), config.Default().Flats)
+	restrictedCfg.AllowedHosts = []string{"hooks.example.com"}
+	allowlisted := NewHandler(NewGateway(NewMemoryStorage(), config.Default().Flats), nil, NewCallbackDispatcher(storage, restrictedCfg), config.Default().Flats)
+	testCases := []struct {
+		Name    string
+		Handler Handler
+		URL     string
+		Message string
+	}{
+		{"relative_url", h, "/flats?callback_url=/hook", "callback_url must be an absolute http or https url"},
+		{"invalid_scheme", h, "/flats?callback_url=ftp://localhost/hook", "callback_url must be an absolute http or https url"},
+		{"invalid_url", h, "/flats?callback_url=http://%5B::1", "callback_url must be an absolute http or https url"},
+		{"batch", h, "/flats/batch?callback_url=http://localhost/hook", "the callback_url is not supported in a batch"},
+		{"disabled", disabled, "/flats?callback_url=http://localhost/hook", "the callbacks are not enabled in this app"},
+		{"private_address", restricted, "/flats?callback_url=http://169.254.169.254/latest/meta-data", "the callback_url can not be a private address"},
+		{"private_address_async", restricted, "/flats?async=true&callback_url=http://127.0.0.1:8080/hook", "the callback_url can not be a private address"},
+		{"host_not_allowed", allowlisted, "/flats?callback_url=https://other.example.com/hook", "the host other.example.com of the callback_url is not allowed"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			nr := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(nr)
+			c.Request, _ = http.NewRequest(http.MethodPost, "/flats", strings.NewReader(`[[1]]`))
+			c.Request.URL.RawQuery = tc.URL[strings.Index(tc.URL, "?")+1:]
+			if strings.HasPrefix(tc.URL, "/flats/batch") {
+				tc.Handler.PostBatch(c)
+			} else {
+				tc.Handler.Post(c)
+			}
+
+			assert.Equal(t, http.StatusBadRequest, c.Writer.Status())
+			assert.Contains(t, nr.Body.String(), tc.Message)
+		})
+	}
+
+	nr = httptest.NewRecorder()
+	c, _ = gin.CreateTestContext(nr)
+	c.Params = gin.Params{{Key: "id", Value: fr.ID}}
+	c.Request, _ = http.NewRequest(http.MethodGet, "/flats/"+fr.ID+"/deliveries", nil)
+	disabled.GetDeliveries(c)
+	assert.Equal(t, http.StatusBadRequest, c.Writer.Status())
+	assert.Contains(t, nr.Body.String(), "the callbacks are not enabled in this app")
+}
+
+func TestPostFlatAsync(t *testing.T) {
+	cfg := config.Default().Flats
+	cfg.MaxBodySize = 100
+	storage := NewMemoryStorage()
+	gtw := NewGateway(storage, cfg)
+	jobs := NewJobQueue(storage, gtw, nil, config.Default().Jobs)
+	jobs.Start()
+	defer jobs.Stop()
+	h := NewHandler(gtw, jobs, nil, cfg)
+
+	nr := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(nr)
+	c.Request, _ = http.NewRequest(http.MethodPost, "/flats?async=true&depth=1", strings.NewReader(`[1,[2,[3]]]`))
+	h.Post(c)
+
+	assert.Equal(t, http.StatusAccepted, c.Writer.Status())
+	var submitted JobResponse
+	assert.Nil(t, json.Unmarshal(nr.Body.Bytes(), &submitted))
+	assert.Equal(t, JobPending, submitted.Status)
+	assert.Equal(t, "/jobs/"+submitted.ID, nr.Header().Get("Location"))
+
+	var job JobResponse
+	for i := 0; i < 200 && job.Status != JobDone; i++ {
+		nr = httptest.NewRecorder()
+		c, _ = gin.CreateTestContext(nr)
+		c.Params = gin.Params{{Key: "id", Value: submitted.ID}}
+		c.Request, _ = http.NewRequest(http.MethodGet, "/jobs/"+submitted.ID, nil)
+		h.GetJob(c)
+		assert.Equal(t, http.StatusOK, c.Writer.Status())
+		assert.Nil(t, json.Unmarshal(nr.Body.Bytes(), &job))
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, JobDone, job.Status)
 
-	jsonMockedRequest, err := json.Marshal(mockedRequest)
+	// the options are the ones of the request
+	flat, err := gtw.GetFlat(context.Background(), job.FlatID)
 	assert.Nil(t, err)
-	assert.NotNil(t, jsonMockedRequest)
+	assert.Equal(t, []interface{}{json.Number("1"), json.Number("2"), []interface{}{json.Number("3")}}, flat.Flatted)
+
+	testCases := []struct {
+		Name    string
+		URL     string
+		Body    string
+		Status  int
+		Message string
+	}{
+		{"invalid_async", "/flats?async=maybe", `[1]`, http.StatusBadRequest, "async must be true or false"},
+		{"invalid_json", "/flats?async=true", `[1,`, http.StatusBadRequest, "error parsing body"},
+		{"body_size", "/flats?async=true", "[" + strings.Repeat("1,", 100) + "1]", http.StatusRequestEntityTooLarge, "the body can not be greater than 100 bytes"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			nr := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(nr)
+			c.Request, _ = http.NewRequest(http.MethodPost, tc.URL, strings.NewReader(tc.Body))
+			h.Post(c)
+
+			assert.Equal(t, tc.Status, c.Writer.Status())
+			assert.Contains(t, nr.Body.String(), tc.Message)
+		})
+	}
+
+	// the retries with an Idempotency-Key would submit a job every time
+	nr = httptest.NewRecorder()
+	c, _ = gin.CreateTestContext(nr)
+	c.Request, _ = http.NewRequest(http.MethodPost, "/flats?async=true", strings.NewReader(`[1,[2,[3]]]`))
+	c.Request.Header.Set("Idempotency-Key", "job-1")
+	h.Post(c)
+	assert.Equal(t, http.StatusBadRequest, c.Writer.Status())
+	assert.Contains(t, nr.Body.String(), "the Idempotency-Key is not supported with async")
+
+	nr = httptest.NewRecorder()
+	c, _ = gin.CreateTestContext(nr)
+	c.Params = gin.Params{{Key: "id", Value: "1234"}}
+	c.Request, _ = http.NewRequest(http.MethodGet, "/jobs/1234", nil)
+	h.GetJob(c)
+	assert.Equal(t, http.StatusNotFound, c.Writer.Status())
+	assert.Contains(t, nr.Body.String(), "job 1234 not found")
+}
+
+func TestPostFlatsQueryParams(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockGtw := NewMockGateway(mockCtrl)
+	h := NewHandler(mockGtw, nil, nil, config.Default().Flats)
+
+	depth := 2
+	testCases := []struct {
+		Query     string
+		Mode      ObjectMode
+		Depth     *int
+		WithShape bool
+		WithPaths bool
+	}{
+		{"", ObjectsReject, nil, false, false},
+		{"?objects=reject", ObjectsReject, nil, false, false},
+		{"?objects=leaf", ObjectsLeaf, nil, false, false},
+		{"?objects=flatten", ObjectsFlatten, nil, false, false},
+		{"?objects=leaf&with_shape=true", ObjectsLeaf, nil, true, false},
+		{"?depth=2&with_shape=true", ObjectsReject, &depth, true, false},
+		{"?with_paths=1", ObjectsReject, nil, false, true},
+	}
+
+	for _, tc := range testCases {
+		mockGtw.
+			EXPECT().
+			FlatStreamResponse(gomock.Any(), gomock.Any(), FlatOptions{Objects: tc.Mode, Depth: tc.Depth, WithShape: tc.WithShape, WithPaths: tc.WithPaths}).Return(mockFlatResponse(), nil).
+			Times(1)
+
+		nr := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(nr)
+		c.Request, _ = http.NewRequest(http.MethodPost, "/flats"+tc.Query, strings.NewReader(`[{"a":1}]`))
+		h.Post(c)
+
+		assert.Equal(t, http.StatusOK, c.Writer.Status())
+	}
+
+	for query, message := range map[string]string{
+		"?objects=other":   "objects must be reject, leaf or flatten",
+		"?with_shape=nope": "with_shape must be true or false",
+		"?depth=-1":        "depth must be a number greater or equal than zero",
+		"?with_paths=yes":  "with_paths must be true or false",
+		"?with_stats=all":  "with_stats must be true or false",
+	} {
+		nr := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(nr)
+		c.Request, _ = http.NewRequest(http.MethodPost, "/flats"+query, strings.NewReader(`[{"a":1}]`))
+		h.Post(c)
+
+		assert.Equal(t, http.StatusBadRequest, c.Writer.Status())
+		assert.Contains(t, nr.Body.String(), message)
+	}
+}
+
+func TestPostFlatDocument(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockGtw := NewMockGateway(mockCtrl)
+	h := NewHandler(mockGtw, nil, nil, config.Default().Flats)
 
 	mockGtw.
 		EXPECT().
-		FlatResponse(gomock.Any()).
-		Times(0)
+		FlatDocumentResponse(gomock.Any(), map[string]interface{}{"a": []interface{}{json.Number("12345678901234567890")}}).
+		Return(FlatDocumentResponse{ID: "1234", Data: map[string]interface{}{"a[0]": json.Number("12345678901234567890")}}, nil).
+		Times(1)
 
 	nr := httptest.NewRecorder()
 	c, _ := gin.CreateTestContext(nr)
-	c.Request, _ = http.NewRequest("POST", "/flats", strings.NewReader(string(jsonMockedRequest)))
-	h.Post(c)
+	c.Request, _ = http.NewRequest(http.MethodPost, "/flats/documents", strings.NewReader(`{"a":[12345678901234567890]}`))
+	h.PostDocument(c)
+
+	assert.Equal(t, http.StatusOK, c.Writer.Status())
+	assert.JSONEq(t, `{"id":"1234","max_depth":0,"flatted_data":{"a[0]":12345678901234567890}}`, nr.Body.String())
+
+	nr = httptest.NewRecorder()
+	c, _ = gin.CreateTestContext(nr)
+	c.Request, _ = http.NewRequest(http.MethodPost, "/flats/documents", strings.NewReader(`{"a":`))
+	h.PostDocument(c)
 
 	assert.Equal(t, http.StatusBadRequest, c.Writer.Status())
 	assert.Contains(t, nr.Body.String(), "error parsing body")
 }
 
+func TestPostDocumentKeyPaths(t *testing.T) {
+	h := NewHandler(NewGateway(NewMemoryStorage(), config.Default().Flats), nil, nil, config.Default().Flats)
+
+	// every value is kept, the key with a dot does not collide with the nested one
+	nr := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(nr)
+	c.Request, _ = http.NewRequest(http.MethodPost, "/flats/documents", strings.NewReader(`{"a.b":1,"a":{"b":2}}`))
+	h.PostDocument(c)
+
+	assert.Equal(t, http.StatusOK, c.Writer.Status())
+	var response FlatDocumentResponse
+	assert.Nil(t, json.Unmarshal(nr.Body.Bytes(), &response))
+	assert.Equal(t, map[string]interface{}{`["a.b"]`: float64(1), "a.b": float64(2)}, response.Data)
+}
+
+func TestPostUnflatten(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockGtw := NewMockGateway(mockCtrl)
+	h := NewHandler(mockGtw, nil, nil, config.Default().Flats)
+
+	req := UnflatRequest{Flatted: []interface{}{json.Number("1"), "a"}, Shape: "[*[*]]"}
+	mockGtw.
+		EXPECT().
+		Unflatten(req).
+		Return(UnflatResponse{Unflatted: []interface{}{json.Number("1"), []interface{}{"a"}}}, nil).
+		Times(1)
+
+	nr := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(nr)
+	c.Request, _ = http.NewRequest(http.MethodPost, "/flats/unflatten", strings.NewReader(`{"flatted":[1,"a"],"shape":"[*[*]]"}`))
+	h.PostUnflatten(c)
+
+	assert.Equal(t, http.StatusOK, c.Writer.Status())
+	assert.JSONEq(t, `{"unflatted":[1,["a"]]}`, nr.Body.String())
+
+	for body, message := range map[string]string{
+		`{"flatted":[1]`:  "error parsing body",
+		`{"flatted":[1]}`: "shape is required",
+	} {
+		nr := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(nr)
+		c.Request, _ = http.NewRequest(http.MethodPost, "/flats/unflatten", strings.NewReader(body))
+		h.PostUnflatten(c)
+
+		assert.Equal(t, http.StatusBadRequest, c.Writer.Status())
+		assert.Contains(t, nr.Body.String(), message)
+	}
+}
+
 func TestGetFlatsOK(t *testing.T) {
 	mockCtrl := gomock.NewController(t)
 	defer mockCtrl.Finish()
 
 	mockGtw := NewMockGateway(mockCtrl)
-	h := NewHandler(mockGtw)
+	h := NewHandler(mockGtw, nil, nil, config.Default().Flats)
 
-	mockedResponse := mockFlatInfoResponse()
-	jsonResponse, err := json.Marshal(mockedResponse)
-	assert.Nil(t, err)
-	assert.NotNil(t, jsonResponse)
+	mockedResponse := FlatsPage{Items: mockFlatInfoResponse(), Next: "next_token"}
 
 	mockGtw.
 		EXPECT().
-		GetFlats().
+		GetFlats(gomock.Any(), FlatsQuery{Limit: config.Default().Flats.Limit}).
 		Return(mockedResponse, nil).
 		Times(1)
 
 	nr := httptest.NewRecorder()
 	c, _ := gin.CreateTestContext(nr)
-	c.Request, _ = http.NewRequest(http.MethodGet, "/flats", strings.NewReader(string(jsonResponse)))
+	c.Request, _ = http.NewRequest(http.MethodGet, "/flats", nil)
 	h.GetAll(c)
 
-	var response []FlatInfoResponse
+	var response FlatsPage
 	jsonErr := json.Unmarshal(nr.Body.Bytes(), &response)
 	assert.Nil(t, jsonErr)
 	assert.Equal(t, http.StatusOK, c.Writer.Status())
 	assert.NotNil(t, response)
-	assert.Len(t, response, 1)
+	assert.Len(t, response.Items, 1)
+	assert.Equal(t, "next_token", response.Next)
+}
+
+func TestGetFlatsNDJSON(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockGtw := NewMockGateway(mockCtrl)
+	h := NewHandler(mockGtw, nil, nil, config.Default().Flats)
+
+	testCases := []struct {
+		Name   string
+		Items  int
+		Err    apierrors.RestErr
+		Status int
+		Lines  []string
+	}{
+		{"page", 2, nil, http.StatusOK, []string{`"id":"1234qwerty"`, `"id":"1234qwerty"`, `{"next":"next_token"}`}},
+		{"empty", 0, nil, http.StatusOK, []string{`{"next":"next_token"}`}},
+		{"error_before_items", 0, apierrors.NewGatewayTimeoutError("timeout"), http.StatusGatewayTimeout, []string{`"message":"timeout"`}},
+		{"error_after_items", 1, apierrors.NewGatewayTimeoutError("timeout"), http.StatusOK, []string{`"id":"1234qwerty"`, `"message":"timeout"`}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			mockGtw.
+				EXPECT().
+				StreamFlats(gomock.Any(), FlatsQuery{Limit: config.Default().Flats.Limit}, gomock.Any()).
+				DoAndReturn(func(_ context.Context, _ FlatsQuery, fn func(FlatInfoResponse) error) (string, apierrors.RestErr) {
+					for i := 0; i < tc.Items; i++ {
+						assert.Nil(t, fn(mockFlatInfoResponse()[0]))
+					}
+					if tc.Err != nil {
+						return "", tc.Err
+					}
+					return "next_token", nil
+				}).
+				Times(1)
+
+			nr := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(nr)
+			c.Request, _ = http.NewRequest(http.MethodGet, "/flats", nil)
+			c.Request.Header.Set("Accept", "application/x-ndjson")
+			h.GetAll(c)
+
+			assert.Equal(t, tc.Status, nr.Code)
+			lines := strings.Split(strings.TrimSpace(nr.Body.String()), "\n")
+			assert.Len(t, lines, len(tc.Lines))
+			for i, line := range lines {
+				assert.Contains(t, line, tc.Lines[i])
+			}
+		})
+	}
+}
+
+func TestGetFlatsQueryParams(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockGtw := NewMockGateway(mockCtrl)
+	h := NewHandler(mockGtw, nil, nil, config.Default().Flats)
+
+	from := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2021, 7, 1, 0, 0, 0, 0, time.UTC)
+	minDepth, maxDepth := 1, 3
+	minLeaves, maxLeaves := 2, 20
+	hasNulls := false
+	cursor := FlatsCursor{ProcessedAt: from, ID: "60b5a1727c09e9d6a3cefec4"}
+	expectedQuery := FlatsQuery{
+		Limit:     10,
+		Cursor:    &cursor,
+		From:      &from,
+		To:        &to,
+		MinDepth:  &minDepth,
+		MaxDepth:  &maxDepth,
+		MinLeaves: &minLeaves,
+		MaxLeaves: &maxLeaves,
+		HasNulls:  &hasNulls,
+	}
+
+	mockGtw.
+		EXPECT().
+		GetFlats(gomock.Any(), expectedQuery).
+		Return(FlatsPage{}, nil).
+		Times(1)
+
+	url := "/flats?limit=10&from=2021-06-01T00:00:00Z&to=2021-07-01T00:00:00Z&min_depth=1&max_depth=3&min_leaves=2&max_leaves=20&has_nulls=false&next=" + cursor.Encode()
+	nr := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(nr)
+	c.Request, _ = http.NewRequest(http.MethodGet, url, nil)
+	h.GetAll(c)
+
+	assert.Equal(t, http.StatusOK, c.Writer.Status())
+}
+
+func TestGetFlatsQueryParamsBadRequest(t *testing.T) {
+	testCases := []struct {
+		Name    string
+		Query   string
+		Message string
+	}{
+		{"invalid_limit", "limit=zero", "limit must be a positive number"},
+		{"negative_limit", "limit=-1", "limit must be a positive number"},
+		{"invalid_next", "next=%21%21", "invalid next cursor"},
+		{"invalid_from", "from=yesterday", "from must be a RFC3339 date"},
+		{"invalid_to", "to=2021-06-01", "to must be a RFC3339 date"},
+		{"invalid_min_depth", "min_depth=-1", "min_depth must be a number greater or equal than zero"},
+		{"invalid_max_depth", "max_depth=deep", "max_depth must be a number greater or equal than zero"},
+		{"invalid_min_leaves", "min_leaves=-2", "min_leaves must be a number greater or equal than zero"},
+		{"invalid_max_leaves", "max_leaves=all", "max_leaves must be a number greater or equal than zero"},
+		{"invalid_has_nulls", "has_nulls=maybe", "has_nulls must be true or false"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+
+			mockGtw := NewMockGateway(mockCtrl)
+			h := NewHandler(mockGtw, nil, nil, config.Default().Flats)
+
+			mockGtw.
+				EXPECT().
+				GetFlats(gomock.Any(), gomock.Any()).
+				Times(0)
+
+			nr := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(nr)
+			c.Request, _ = http.NewRequest(http.MethodGet, "/flats?"+tc.Query, nil)
+			h.GetAll(c)
+
+			assert.Equal(t, http.StatusBadRequest, c.Writer.Status())
+			assert.Contains(t, nr.Body.String(), tc.Message)
+		})
+	}
 }
 
 func TestGetFlatsError(t *testing.T) {
@@ -109,13 +789,13 @@ func TestGetFlatsError(t *testing.T) {
 	defer mockCtrl.Finish()
 
 	mockGtw := NewMockGateway(mockCtrl)
-	h := NewHandler(mockGtw)
+	h := NewHandler(mockGtw, nil, nil, config.Default().Flats)
 
 	msgErr := "error getting flats from database"
 	mockGtw.
 		EXPECT().
-		GetFlats().
-		Return(nil, apierrors.NewInternalServerError(msgErr)).
+		GetFlats(gomock.Any(), gomock.Any()).
+		Return(FlatsPage{}, apierrors.NewInternalServerError(msgErr)).
 		Times(1)
 
 	nr := httptest.NewRecorder()
@@ -127,12 +807,149 @@ func TestGetFlatsError(t *testing.T) {
 	assert.Contains(t, nr.Body.String(), msgErr)
 }
 
+func TestGetFlatOK(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockGtw := NewMockGateway(mockCtrl)
+	h := NewHandler(mockGtw, nil, nil, config.Default().Flats)
+
+	mockedResponse := mockFlatInfoResponse()[0]
+	mockGtw.
+		EXPECT().
+		GetFlat(gomock.Any(), mockedResponse.ID).
+		Return(mockedResponse, nil).
+		Times(1)
+
+	nr := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(nr)
+	c.Params = gin.Params{{Key: "id", Value: mockedResponse.ID}}
+	c.Request, _ = http.NewRequest(http.MethodGet, "/flats/"+mockedResponse.ID, nil)
+	h.Get(c)
+
+	var response FlatInfoResponse
+	jsonErr := json.Unmarshal(nr.Body.Bytes(), &response)
+	assert.Nil(t, jsonErr)
+	assert.Equal(t, http.StatusOK, c.Writer.Status())
+	assert.Equal(t, mockedResponse.ID, response.ID)
+	assert.Len(t, response.Flatted, 3)
+}
+
+func TestGetFlatNotFound(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockGtw := NewMockGateway(mockCtrl)
+	h := NewHandler(mockGtw, nil, nil, config.Default().Flats)
+
+	msgErr := "flat_info 1234 not found"
+	mockGtw.
+		EXPECT().
+		GetFlat(gomock.Any(), "1234").
+		Return(FlatInfoResponse{}, apierrors.NewNotFoundError(msgErr)).
+		Times(1)
+
+	nr := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(nr)
+	c.Params = gin.Params{{Key: "id", Value: "1234"}}
+	c.Request, _ = http.NewRequest(http.MethodGet, "/flats/1234", nil)
+	h.Get(c)
+
+	assert.Equal(t, http.StatusNotFound, c.Writer.Status())
+	assert.Contains(t, nr.Body.String(), msgErr)
+}
+
+func TestGetFlatByHash(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockGtw := NewMockGateway(mockCtrl)
+	h := NewHandler(mockGtw, nil, nil, config.Default().Flats)
+
+	mockedResponse := mockFlatInfoResponse()[0]
+	mockedResponse.Hash = "5d41402abc4b2a76b9719d911017c592"
+	gomock.InOrder(
+		mockGtw.EXPECT().GetFlatByHash(gomock.Any(), mockedResponse.Hash).Return(mockedResponse, nil),
+		mockGtw.EXPECT().GetFlatByHash(gomock.Any(), "1234").Return(FlatInfoResponse{}, apierrors.NewNotFoundError("flat_info with hash 1234 not found")),
+	)
+
+	nr := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(nr)
+	c.Params = gin.Params{{Key: "hash", Value: mockedResponse.Hash}}
+	c.Request, _ = http.NewRequest(http.MethodGet, "/flats/by-hash/"+mockedResponse.Hash, nil)
+	h.GetByHash(c)
+
+	var response FlatInfoResponse
+	jsonErr := json.Unmarshal(nr.Body.Bytes(), &response)
+	assert.Nil(t, jsonErr)
+	assert.Equal(t, http.StatusOK, c.Writer.Status())
+	assert.Equal(t, mockedResponse.ID, response.ID)
+	assert.Equal(t, mockedResponse.Hash, response.Hash)
+
+	nr = httptest.NewRecorder()
+	c, _ = gin.CreateTestContext(nr)
+	c.Params = gin.Params{{Key: "hash", Value: "1234"}}
+	c.Request, _ = http.NewRequest(http.MethodGet, "/flats/by-hash/1234", nil)
+	h.GetByHash(c)
+
+	assert.Equal(t, http.StatusNotFound, c.Writer.Status())
+	assert.Contains(t, nr.Body.String(), "flat_info with hash 1234 not found")
+}
+
+func TestDeleteFlatOK(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockGtw := NewMockGateway(mockCtrl)
+	h := NewHandler(mockGtw, nil, nil, config.Default().Flats)
+
+	mockGtw.
+		EXPECT().
+		DeleteFlat(gomock.Any(), "1234").
+		Return(nil).
+		Times(1)
+
+	nr := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(nr)
+	c.Params = gin.Params{{Key: "id", Value: "1234"}}
+	c.Request, _ = http.NewRequest(http.MethodDelete, "/flats/1234", nil)
+	h.Delete(c)
+
+	assert.Equal(t, http.StatusNoContent, c.Writer.Status())
+	assert.Empty(t, nr.Body.String())
+}
+
+func TestDeleteFlatNotFound(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockGtw := NewMockGateway(mockCtrl)
+	h := NewHandler(mockGtw, nil, nil, config.Default().Flats)
+
+	msgErr := "flat_info 1234 not found"
+	mockGtw.
+		EXPECT().
+		DeleteFlat(gomock.Any(), "1234").
+		Return(apierrors.NewNotFoundError(msgErr)).
+		Times(1)
+
+	nr := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(nr)
+	c.Params = gin.Params{{Key: "id", Value: "1234"}}
+	c.Request, _ = http.NewRequest(http.MethodDelete, "/flats/1234", nil)
+	h.Delete(c)
+
+	assert.Equal(t, http.StatusNotFound, c.Writer.Status())
+	assert.Contains(t, nr.Body.String(), msgErr)
+}
+
 func mockFlatRequest() []interface{} {
 	return []interface{}{"test1", "test2", "test3"}
 }
 
 func mockFlatResponse() FlatResponse {
 	return FlatResponse{
+		ID:       "1234qwerty",
 		MaxDepth: 0,
 		Data:     []interface{}{"test1", "test2", "test3"},
 	}
@@ -0,0 +1,214 @@
+package flattener
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mendezdev/tgo_flattener/apierrors"
+	"github.com/mendezdev/tgo_flattener/config"
+)
+
+// JobStatus is the state of an async flat
+type JobStatus string
+
+const (
+	// JobPending is waiting in the queue for a worker
+	JobPending JobStatus = "pending"
+	// JobRunning is being flatted by a worker
+	JobRunning JobStatus = "running"
+	// JobDone was flatted and saved, the Job has the id of the FlatInfo
+	JobDone JobStatus = "done"
+	// JobFailed could not be flatted or saved, the Job has the error
+	JobFailed JobStatus = "failed"
+)
+
+// Job is the state of an async flat of POST /flats saved in the db.
+// FlatID is only set when it is done and Error when it failed
+type Job struct {
+	ID        string    `bson:"_id,omitempty"`
+	Status    JobStatus `bson:"status"`
+	FlatID    string    `bson:"flat_id,omitempty"`
+	Error     *JobError `bson:"error,omitempty"`
+	CreatedAt time.Time `bson:"created_at"`
+	UpdatedAt time.Time `bson:"updated_at"`
+}
+
+// JobError is the error that POST /flats would return for the array of a failed Job
+type JobError struct {
+	Status  int    `json:"status" bson:"status"`
+	Message string `json:"message" bson:"message"`
+}
+
+// JobResponse represents the client response for POST /flats?async=true and GET /jobs/:id.
+// FlatURL is the path to get the FlatInfo when the Job is done
+type JobResponse struct {
+	ID        string    `json:"id"`
+	Status    JobStatus `json:"status"`
+	FlatID    string    `json:"flat_id,omitempty"`
+	FlatURL   string    `json:"flat_url,omitempty"`
+	Error     *JobError `json:"error,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Jobs flats the arrays of the async requests in background
+type Jobs interface {
+	// Submit saves a pending Job to flat the input with the options and queues it.
+	// It returns a service unavailable error if the queue is full
+	Submit(ctx context.Context, input []byte, opts FlatOptions) (JobResponse, apierrors.RestErr)
+
+	// Get returns the Job with the given id or a not found error if it not exists
+	Get(ctx context.Context, id string) (JobResponse, apierrors.RestErr)
+}
+
+// queuedJob is a Job waiting for a worker with the array to flat
+type queuedJob struct {
+	job   Job
+	input []byte
+	opts  FlatOptions
+}
+
+// JobQueue is the Jobs that keeps the pending jobs in memory and runs them with a pool
+// of workers. The arrays are flatted and saved by the Gateway like the sync requests,
+// and then sent to the callback url of the options, if any, by the Callbacks
+type JobQueue struct {
+	storage   Storage
+	gtw       Gateway
+	callbacks Callbacks
+	workers   int
+	queue     chan queuedJob
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewJobQueue returns the JobQueue, callbacks is nil when they are disabled
+func NewJobQueue(s Storage, gtw Gateway, callbacks Callbacks, cfg config.Jobs) *JobQueue {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &JobQueue{
+		storage:   s,
+		gtw:       gtw,
+		callbacks: callbacks,
+		workers:   cfg.Workers,
+		queue:     make(chan queuedJob, cfg.QueueSize),
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+}
+
+// Start runs the workers until Stop is called
+func (q *JobQueue) Start() {
+	q.wg.Add(q.workers)
+	for w := 0; w < q.workers; w++ {
+		go func() {
+			defer q.wg.Done()
+			for {
+				select {
+				case <-q.ctx.Done():
+					return
+				case qj := <-q.queue:
+					q.run(qj)
+				}
+			}
+		}()
+	}
+}
+
+// Stop waits for the running jobs and marks the pending ones as failed, they are only
+// in memory. It must be called after Start and it is safe to call it more than once
+func (q *JobQueue) Stop() {
+	q.cancel()
+	q.wg.Wait()
+
+	for {
+		select {
+		case qj := <-q.queue:
+			q.finish(qj.job, "", apierrors.NewServiceUnavailableError("the app stopped before running the job"))
+		default:
+			return
+		}
+	}
+}
+
+func (q *JobQueue) Submit(ctx context.Context, input []byte, opts FlatOptions) (JobResponse, apierrors.RestErr) {
+	now := time.Now().UTC()
+	job := Job{Status: JobPending, CreatedAt: now, UpdatedAt: now}
+
+	id, err := q.storage.createJob(ctx, job)
+	if err != nil {
+		return JobResponse{}, storageError(err, "error saving the job")
+	}
+	job.ID = id
+
+	select {
+	case q.queue <- queuedJob{job: job, input: input, opts: opts}:
+		return newJobResponse(job), nil
+	default:
+		apiErr := apierrors.NewServiceUnavailableError("the job queue is full, try again later")
+		q.finish(job, "", apiErr)
+		return JobResponse{}, apiErr
+	}
+}
+
+func (q *JobQueue) Get(ctx context.Context, id string) (JobResponse, apierrors.RestErr) {
+	job, err := q.storage.getJob(ctx, id)
+	if err != nil {
+		return JobResponse{}, storageError(err, "error getting job from db")
+	}
+	return newJobResponse(job), nil
+}
+
+// run flats the array of the job. The job is not interrupted by Stop,
+// so it is run without the ctx of the queue
+func (q *JobQueue) run(qj queuedJob) {
+	job := qj.job
+	job.Status = JobRunning
+	job.UpdatedAt = time.Now().UTC()
+	q.update(job)
+
+	fr, err := q.gtw.FlatStreamResponse(context.Background(), bytes.NewReader(qj.input), qj.opts)
+	q.finish(job, fr.ID, err)
+
+	if err == nil && !fr.Replayed && qj.opts.CallbackURL != "" && q.callbacks != nil {
+		q.callbacks.Notify(context.Background(), qj.opts.CallbackURL, fr)
+	}
+}
+
+// finish saves the job as done with the flat id or as failed with the error
+func (q *JobQueue) finish(job Job, flatID string, err apierrors.RestErr) {
+	job.UpdatedAt = time.Now().UTC()
+	if err != nil {
+		job.Status = JobFailed
+		job.Error = &JobError{Status: err.Status(), Message: err.Message()}
+	} else {
+		job.Status = JobDone
+		job.FlatID = flatID
+	}
+	q.update(job)
+}
+
+// update saves the state of the job, the errors are only printed because there is no client waiting
+func (q *JobQueue) update(job Job) {
+	if err := q.storage.updateJob(context.Background(), job); err != nil {
+		fmt.Printf("error updating job %s to %s: %s\n", job.ID, job.Status, err.Message())
+	}
+}
+
+func newJobResponse(job Job) JobResponse {
+	jr := JobResponse{
+		ID:        job.ID,
+		Status:    job.Status,
+		FlatID:    job.FlatID,
+		Error:     job.Error,
+		CreatedAt: job.CreatedAt,
+		UpdatedAt: job.UpdatedAt,
+	}
+	if job.FlatID != "" {
+		jr.FlatURL = "/flats/" + job.FlatID
+	}
+	return jr
+}
@@ -0,0 +1,123 @@
+package flattener
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mendezdev/tgo_flattener/config"
+	"github.com/stretchr/testify/assert"
+)
+
+// waitJob returns the job when it is done or failed, or the last state after a while
+func waitJob(t *testing.T, jobs Jobs, id string) JobResponse {
+	var job JobResponse
+	for i := 0; i < 200; i++ {
+		var err error
+		job, err = jobs.Get(context.Background(), id)
+		assert.Nil(t, err)
+		if job.Status == JobDone || job.Status == JobFailed {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return job
+}
+
+func TestJobQueueRunsJobs(t *testing.T) {
+	storage := NewMemoryStorage()
+	gtw := NewGateway(storage, config.Default().Flats)
+	queue := NewJobQueue(storage, gtw, nil, config.Jobs{Workers: 2, QueueSize: 10})
+	queue.Start()
+	defer queue.Stop()
+
+	submitted, err := queue.Submit(context.Background(), []byte(`[1,[2,[3]]]`), FlatOptions{})
+	assert.Nil(t, err)
+	assert.NotEmpty(t, submitted.ID)
+	assert.Equal(t, JobPending, submitted.Status)
+
+	job := waitJob(t, queue, submitted.ID)
+	assert.Equal(t, JobDone, job.Status)
+	assert.Nil(t, job.Error)
+	assert.Equal(t, "/flats/"+job.FlatID, job.FlatURL)
+	assert.False(t, job.UpdatedAt.Before(job.CreatedAt))
+
+	flat, getErr := gtw.GetFlat(context.Background(), job.FlatID)
+	assert.Nil(t, getErr)
+	assert.Equal(t, []interface{}{json.Number("1"), json.Number("2"), json.Number("3")}, flat.Flatted)
+
+	// the errors of the array are saved in the job
+	submitted, err = queue.Submit(context.Background(), []byte(`[{"a":1}]`), FlatOptions{})
+	assert.Nil(t, err)
+	job = waitJob(t, queue, submitted.ID)
+	assert.Equal(t, JobFailed, job.Status)
+	assert.Empty(t, job.FlatURL)
+	assert.Equal(t, &JobError{Status: http.StatusBadRequest, Message: "object is not a valid value inside an array"}, job.Error)
+
+	_, err = queue.Get(context.Background(), "000000000000000000000000")
+	assert.NotNil(t, err)
+	assert.Equal(t, http.StatusNotFound, err.Status())
+}
+
+func TestJobQueueSendsCallbacks(t *testing.T) {
+	receiver := newCallbackReceiver(t)
+	storage := NewMemoryStorage()
+	callbacks := NewCallbackDispatcher(storage, testCallbacksConfig())
+	callbacks.Start()
+	defer callbacks.Stop()
+	gtw := NewGateway(storage, config.Default().Flats)
+	queue := NewJobQueue(storage, gtw, callbacks, config.Jobs{Workers: 1, QueueSize: 10})
+	queue.Start()
+	defer queue.Stop()
+
+	submitted, err := queue.Submit(context.Background(), []byte(`[1,[2]]`), FlatOptions{CallbackURL: receiver.URL})
+	assert.Nil(t, err)
+	job := waitJob(t, queue, submitted.ID)
+	assert.Equal(t, JobDone, job.Status)
+
+	deliveries := waitDeliveries(t, callbacks, job.FlatID, 1)
+	assert.Equal(t, 1, len(deliveries))
+	assert.Equal(t, DeliveryDelivered, deliveries[0].Status)
+	requests := receiver.requests()
+	assert.Equal(t, 1, len(requests))
+	assertSignedCallback(t, requests[0], deliveries[0].ID, FlatResponse{
+		ID:       job.FlatID,
+		MaxDepth: 1,
+		Data:     []interface{}{json.Number("1"), json.Number("2")},
+	})
+
+	// the failed jobs have no callback
+	submitted, err = queue.Submit(context.Background(), []byte(`[{"a":1}]`), FlatOptions{CallbackURL: receiver.URL})
+	assert.Nil(t, err)
+	assert.Equal(t, JobFailed, waitJob(t, queue, submitted.ID).Status)
+	assert.Equal(t, 1, len(receiver.requests()))
+}
+
+func TestJobQueueFullAndStop(t *testing.T) {
+	storage := NewMemoryStorage()
+	queue := NewJobQueue(storage, NewGateway(storage, config.Default().Flats), nil, config.Jobs{Workers: 1, QueueSize: 1})
+
+	// without workers the first job waits in the queue
+	pending, err := queue.Submit(context.Background(), []byte(`[1]`), FlatOptions{})
+	assert.Nil(t, err)
+
+	_, err = queue.Submit(context.Background(), []byte(`[2]`), FlatOptions{})
+	assert.NotNil(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, err.Status())
+	assert.Equal(t, "the job queue is full, try again later", err.Message())
+
+	queue.Start()
+	queue.Stop()
+	queue.Stop()
+
+	// the pending job is run or failed by the stop, it is never left pending
+	job, getErr := queue.Get(context.Background(), pending.ID)
+	assert.Nil(t, getErr)
+	if job.Status == JobFailed {
+		assert.Equal(t, &JobError{Status: http.StatusServiceUnavailable, Message: "the app stopped before running the job"}, job.Error)
+	} else {
+		assert.Equal(t, JobDone, job.Status)
+	}
+}
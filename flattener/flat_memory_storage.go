@@ -0,0 +1,419 @@
+package flattener
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mendezdev/tgo_flattener/apierrors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// memoryStorage keeps the flats in memory, it is useful to run the app
+// and the tests without a db. The ids are generated like in mongo.
+// The operations are not interrupted, the ctx is only checked before starting them.
+// The hashes map has the id of the flat with every hash, like the unique index in mongo,
+// and the keys map the id of the last flat with every idempotency key
+type memoryStorage struct {
+	mu         sync.RWMutex
+	flats      map[string]FlatInfo
+	hashes     map[string]string
+	keys       map[string]string
+	jobs       map[string]Job
+	deliveries map[string]Delivery
+}
+
+func NewMemoryStorage() Storage {
+	return &memoryStorage{
+		flats:      map[string]FlatInfo{},
+		hashes:     map[string]string{},
+		keys:       map[string]string{},
+		jobs:       map[string]Job{},
+		deliveries: map[string]Delivery{},
+	}
+}
+
+func (s *memoryStorage) create(ctx context.Context, fi FlatInfo) (string, apierrors.RestErr) {
+	if err := contextError(ctx); err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.hashes[fi.Hash]; ok && fi.Hash != "" {
+		return "", duplicatedHashError(fi.Hash)
+	}
+
+	fi.ID = primitive.NewObjectID().Hex()
+	fi.Graph = nil
+	s.flats[fi.ID] = fi
+	if fi.Hash != "" {
+		s.hashes[fi.Hash] = fi.ID
+	}
+	for _, ik := range fi.IdempotencyKeys {
+		s.keys[ik.Key] = fi.ID
+	}
+
+	return fi.ID, nil
+}
+
+func (s *memoryStorage) createMany(ctx context.Context, fis []FlatInfo) ([]string, []apierrors.RestErr) {
+	ids := make([]string, len(fis))
+	errs := make([]apierrors.RestErr, len(fis))
+	for i, fi := range fis {
+		ids[i], errs[i] = s.create(ctx, fi)
+	}
+	return ids, errs
+}
+
+func (s *memoryStorage) get(ctx context.Context, id string) (FlatInfo, apierrors.RestErr) {
+	if err := contextError(ctx); err != nil {
+		return FlatInfo{}, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	fi, ok := s.flats[id]
+	if !ok {
+		return FlatInfo{}, apierrors.NewNotFoundError(fmt.Sprintf("flat_info %s not found", id))
+	}
+
+	return fi, nil
+}
+
+func (s *memoryStorage) getByHash(ctx context.Context, hash string) (FlatInfo, apierrors.RestErr) {
+	if err := contextError(ctx); err != nil {
+		return FlatInfo{}, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	id, ok := s.hashes[hash]
+	if !ok {
+		return FlatInfo{}, hashNotFoundError(hash)
+	}
+
+	return s.flats[id], nil
+}
+
+func (s *memoryStorage) getByIdempotencyKey(ctx context.Context, key string) (FlatInfo, apierrors.RestErr) {
+	if err := contextError(ctx); err != nil {
+		return FlatInfo{}, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	fi := s.flats[s.keys[key]]
+	if _, ok := fi.idempotencyKey(key, time.Now().UTC()); !ok {
+		return FlatInfo{}, idempotencyKeyNotFoundError(key)
+	}
+
+	return fi, nil
+}
+
+func (s *memoryStorage) addIdempotencyKey(ctx context.Context, id string, key IdempotencyKey) apierrors.RestErr {
+	if err := contextError(ctx); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fi, ok := s.flats[id]
+	if !ok {
+		return apierrors.NewNotFoundError(fmt.Sprintf("flat_info %s not found", id))
+	}
+
+	// a new slice, the old one can be shared with a FlatInfo already returned
+	now := time.Now().UTC()
+	keys := make([]IdempotencyKey, 0, len(fi.IdempotencyKeys)+1)
+	for _, ik := range fi.IdempotencyKeys {
+		if ik.ExpiresAt.After(now) {
+			keys = append(keys, ik)
+		} else if s.keys[ik.Key] == id {
+			delete(s.keys, ik.Key)
+		}
+	}
+	fi.IdempotencyKeys = append(keys, key)
+	s.flats[id] = fi
+	s.keys[key.Key] = id
+
+	return nil
+}
+
+func (s *memoryStorage) getAll(ctx context.Context, query FlatsQuery) ([]FlatInfo, apierrors.RestErr) {
+	if err := contextError(ctx); err != nil {
+		return nil, err
+	}
+
+	if query.Cursor != nil {
+		if _, err := primitive.ObjectIDFromHex(query.Cursor.ID); err != nil {
+			return nil, apierrors.NewBadRequestError("invalid next cursor")
+		}
+	}
+
+	s.mu.RLock()
+	res := make([]FlatInfo, 0)
+	for _, fi := range s.flats {
+		if matchFlatsQuery(fi, query) {
+			res = append(res, fi)
+		}
+	}
+	s.mu.RUnlock()
+
+	sortNewestFirst(res)
+	if query.Limit > 0 && int64(len(res)) > query.Limit {
+		res = res[:query.Limit]
+	}
+
+	return res, nil
+}
+
+// iterate calls fn out of the lock, so fn can use the storage
+func (s *memoryStorage) iterate(ctx context.Context, query FlatsQuery, fn func(FlatInfo) apierrors.RestErr) apierrors.RestErr {
+	flats, err := s.getAll(ctx, query)
+	if err != nil {
+		return err
+	}
+
+	for _, fi := range flats {
+		if err := contextError(ctx); err != nil {
+			return err
+		}
+		if err := fn(fi); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *memoryStorage) delete(ctx context.Context, id string) apierrors.RestErr {
+	if err := contextError(ctx); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.flats[id]; !ok {
+		return apierrors.NewNotFoundError(fmt.Sprintf("flat_info %s not found", id))
+	}
+	s.remove(id)
+
+	return nil
+}
+
+func (s *memoryStorage) purge(ctx context.Context, policy RetentionPolicy) (int64, apierrors.RestErr) {
+	if err := contextError(ctx); err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var deleted int64
+	if policy.MaxAge > 0 {
+		before := time.Now().UTC().Add(-policy.MaxAge)
+		for id, fi := range s.flats {
+			if fi.ProcessedAt.Before(before) {
+				s.remove(id)
+				deleted++
+			}
+		}
+	}
+
+	if policy.MaxCount > 0 && int64(len(s.flats)) > policy.MaxCount {
+		flats := make([]FlatInfo, 0, len(s.flats))
+		for _, fi := range s.flats {
+			flats = append(flats, fi)
+		}
+		sortNewestFirst(flats)
+		for _, fi := range flats[policy.MaxCount:] {
+			s.remove(fi.ID)
+			deleted++
+		}
+	}
+
+	return deleted, nil
+}
+
+func (s *memoryStorage) createJob(ctx context.Context, job Job) (string, apierrors.RestErr) {
+	if err := contextError(ctx); err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job.ID = primitive.NewObjectID().Hex()
+	s.jobs[job.ID] = job
+
+	return job.ID, nil
+}
+
+func (s *memoryStorage) getJob(ctx context.Context, id string) (Job, apierrors.RestErr) {
+	if err := contextError(ctx); err != nil {
+		return Job{}, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	job, ok := s.jobs[id]
+	if !ok {
+		return Job{}, jobNotFoundError(id)
+	}
+
+	return job, nil
+}
+
+func (s *memoryStorage) updateJob(ctx context.Context, job Job) apierrors.RestErr {
+	if err := contextError(ctx); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	saved, ok := s.jobs[job.ID]
+	if !ok {
+		return jobNotFoundError(job.ID)
+	}
+	saved.Status = job.Status
+	saved.FlatID = job.FlatID
+	saved.Error = job.Error
+	saved.UpdatedAt = job.UpdatedAt
+	s.jobs[job.ID] = saved
+
+	return nil
+}
+
+func (s *memoryStorage) createDelivery(ctx context.Context, delivery Delivery) (string, apierrors.RestErr) {
+	if err := contextError(ctx); err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delivery.ID = primitive.NewObjectID().Hex()
+	s.deliveries[delivery.ID] = delivery
+
+	return delivery.ID, nil
+}
+
+func (s *memoryStorage) getDeliveries(ctx context.Context, flatID string) ([]Delivery, apierrors.RestErr) {
+	if err := contextError(ctx); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	res := make([]Delivery, 0)
+	for _, delivery := range s.deliveries {
+		if delivery.FlatID == flatID {
+			res = append(res, delivery)
+		}
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(res, func(i, j int) bool {
+		if !res[i].CreatedAt.Equal(res[j].CreatedAt) {
+			return res[i].CreatedAt.Before(res[j].CreatedAt)
+		}
+		return res[i].ID < res[j].ID
+	})
+
+	return res, nil
+}
+
+func (s *memoryStorage) updateDelivery(ctx context.Context, delivery Delivery) apierrors.RestErr {
+	if err := contextError(ctx); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	saved, ok := s.deliveries[delivery.ID]
+	if !ok {
+		return deliveryNotFoundError(delivery.ID)
+	}
+	saved.Status = delivery.Status
+	saved.Attempts = append([]DeliveryAttempt(nil), delivery.Attempts...)
+	saved.Error = delivery.Error
+	saved.UpdatedAt = delivery.UpdatedAt
+	s.deliveries[delivery.ID] = saved
+
+	return nil
+}
+
+// remove deletes the flat, its hash and its idempotency keys, the lock must be held by the caller
+func (s *memoryStorage) remove(id string) {
+	if hash := s.flats[id].Hash; hash != "" {
+		delete(s.hashes, hash)
+	}
+	for _, ik := range s.flats[id].IdempotencyKeys {
+		if s.keys[ik.Key] == id {
+			delete(s.keys, ik.Key)
+		}
+	}
+	delete(s.flats, id)
+}
+
+// HealthCheck only fails if the ctx is done, the memory is always available
+func (s *memoryStorage) HealthCheck(ctx context.Context) error {
+	return ctx.Err()
+}
+
+// matchFlatsQuery applies the same filters that the mongo storage
+func matchFlatsQuery(fi FlatInfo, query FlatsQuery) bool {
+	if query.From != nil && fi.ProcessedAt.Before(*query.From) {
+		return false
+	}
+	if query.To != nil && !fi.ProcessedAt.Before(*query.To) {
+		return false
+	}
+	if query.MinDepth != nil && fi.MaxDepth < *query.MinDepth {
+		return false
+	}
+	if query.MaxDepth != nil && fi.MaxDepth > *query.MaxDepth {
+		return false
+	}
+	if (query.MinLeaves != nil || query.MaxLeaves != nil || query.HasNulls != nil) && fi.Stats == nil {
+		return false
+	}
+	if query.MinLeaves != nil && fi.Stats.Leaves < *query.MinLeaves {
+		return false
+	}
+	if query.MaxLeaves != nil && fi.Stats.Leaves > *query.MaxLeaves {
+		return false
+	}
+	if query.HasNulls != nil && *query.HasNulls != (fi.Stats.Nulls > 0) {
+		return false
+	}
+	if query.Cursor != nil {
+		c := query.Cursor
+		if fi.ProcessedAt.After(c.ProcessedAt) || (fi.ProcessedAt.Equal(c.ProcessedAt) && fi.ID >= c.ID) {
+			return false
+		}
+	}
+	return true
+}
+
+// sortNewestFirst sorts by processed_at and id like the mongo storage.
+// The ids are hex ObjectIDs, so comparing the strings is the same as comparing the ObjectIDs
+func sortNewestFirst(flats []FlatInfo) {
+	sort.Slice(flats, func(i, j int) bool {
+		if !flats[i].ProcessedAt.Equal(flats[j].ProcessedAt) {
+			return flats[i].ProcessedAt.After(flats[j].ProcessedAt)
+		}
+		return flats[i].ID > flats[j].ID
+	})
+}
@@ -0,0 +1,54 @@
+package flattener
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryStorageConcurrentAccess(t *testing.T) {
+	storage := NewMemoryStorage()
+
+	var wg sync.WaitGroup
+	ids := make(chan string, 50)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			id, err := storage.create(context.Background(), buildFlatInfo(time.Now().UTC()))
+			assert.Nil(t, err)
+			ids <- id
+
+			_, getErr := storage.getAll(context.Background(), FlatsQuery{Limit: 10})
+			assert.Nil(t, getErr)
+		}()
+	}
+	wg.Wait()
+	close(ids)
+
+	unique := map[string]bool{}
+	for id := range ids {
+		unique[id] = true
+	}
+	assert.Len(t, unique, 50)
+}
+
+func TestMemoryStorageContextDone(t *testing.T) {
+	storage := NewMemoryStorage()
+
+	canceledCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := storage.create(canceledCtx, buildFlatInfo(time.Now().UTC()))
+	assert.NotNil(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, err.Status())
+
+	expiredCtx, cancelExpired := context.WithTimeout(context.Background(), -time.Second)
+	defer cancelExpired()
+	_, err = storage.getAll(expiredCtx, FlatsQuery{})
+	assert.NotNil(t, err)
+	assert.Equal(t, http.StatusGatewayTimeout, err.Status())
+}
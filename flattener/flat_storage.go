@@ -2,7 +2,9 @@ package flattener
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"time"
 
 	"github.com/mendezdev/tgo_flattener/apierrors"
 	"github.com/mendezdev/tgo_flattener/config"
@@ -10,71 +12,641 @@ import (
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
 )
 
 //go:generate mockgen -destination=mock_storage.go -package=flattener -source=flat_storage.go Storage
 
 const (
-	FlatCollection = "flats"
-	DbName         = "flattenerdb"
-	DbNameTest     = "flattenerdbtest"
+	FlatCollection     = "flats"
+	JobCollection      = "jobs"
+	DeliveryCollection = "deliveries"
+	DbNameTest         = "flattenerdbtest"
 )
 
-// Storage will execute all de CRUD operations flat_info related
+// duplicateKeyCode is the mongo error code of a duplicated value in a unique index
+const duplicateKeyCode = 11000
+
+// Storage will execute all de CRUD operations flat_info related.
+// When the ctx is done before the operation finish, it returns a 504 or 503 error
 type Storage interface {
-	create(FlatInfo) apierrors.RestErr
-	getAll() ([]FlatInfo, apierrors.RestErr)
+	// create saves the FlatInfo and returns the generated ID.
+	// It returns a conflict error if there is a FlatInfo with the same Hash
+	create(context.Context, FlatInfo) (string, apierrors.RestErr)
+	// createMany saves the FlatInfos like create but in one operation. It returns the ID
+	// or the error of every FlatInfo in the same order, so one error does not stop the others
+	createMany(context.Context, []FlatInfo) ([]string, []apierrors.RestErr)
+	// get returns a not found error if the ID not exists or is malformed
+	get(ctx context.Context, id string) (FlatInfo, apierrors.RestErr)
+	// getByHash returns a not found error if there is no FlatInfo with the hash
+	getByHash(ctx context.Context, hash string) (FlatInfo, apierrors.RestErr)
+	// getByIdempotencyKey returns a not found error if there is no FlatInfo with the key
+	// or it is expired
+	getByIdempotencyKey(ctx context.Context, key string) (FlatInfo, apierrors.RestErr)
+	// addIdempotencyKey adds the key to the FlatInfo with the ID and removes its expired keys.
+	// It returns a not found error if the ID not exists or is malformed
+	addIdempotencyKey(ctx context.Context, id string, key IdempotencyKey) apierrors.RestErr
+	// getAll returns the flats filtered by the FlatsQuery sorted from the newest to the oldest.
+	// A zero limit returns all of them
+	getAll(context.Context, FlatsQuery) ([]FlatInfo, apierrors.RestErr)
+	// iterate is like getAll but calls fn with every flat as soon as it is read,
+	// without keeping all of them in memory. It stops with the first error of fn
+	iterate(ctx context.Context, query FlatsQuery, fn func(FlatInfo) apierrors.RestErr) apierrors.RestErr
+	// delete returns a not found error if the ID not exists or is malformed
+	delete(ctx context.Context, id string) apierrors.RestErr
+	// purge deletes the flats out of the RetentionPolicy and returns how many were deleted
+	purge(context.Context, RetentionPolicy) (int64, apierrors.RestErr)
+	// createJob saves the Job and returns the generated ID
+	createJob(context.Context, Job) (string, apierrors.RestErr)
+	// getJob returns a not found error if the ID not exists or is malformed
+	getJob(ctx context.Context, id string) (Job, apierrors.RestErr)
+	// updateJob saves the status, the flat id, the error and the update time of the Job.
+	// It returns a not found error if the ID not exists or is malformed
+	updateJob(context.Context, Job) apierrors.RestErr
+	// createDelivery saves the Delivery and returns the generated ID
+	createDelivery(context.Context, Delivery) (string, apierrors.RestErr)
+	// getDeliveries returns the deliveries of the flat with the ID from the oldest to the newest
+	getDeliveries(ctx context.Context, flatID string) ([]Delivery, apierrors.RestErr)
+	// updateDelivery saves the status, the attempts, the error and the update time of the Delivery.
+	// It returns a not found error if the ID not exists or is malformed
+	updateDelivery(context.Context, Delivery) apierrors.RestErr
+	// HealthCheck returns an error if the storage can not be used
+	HealthCheck(ctx context.Context) error
 }
 
 type storage struct {
-	db     *mongo.Client
-	dbName string
+	db      *mongo.Client
+	dbName  string
+	timeout time.Duration
 }
 
-func NewStorage(db *mongo.Client) Storage {
+// NewStorage returns the mongo Storage, every operation can not take more than the config timeout
+func NewStorage(db *mongo.Client, cfg config.Storage) Storage {
 	return &storage{
 		db,
-		DbName,
+		cfg.Database,
+		cfg.Timeout,
 	}
 }
 
-func NewTestStorage(db *mongo.Client) Storage {
-	return &storage{
-		db,
-		DbNameTest,
+func (s *storage) create(ctx context.Context, fi FlatInfo) (string, apierrors.RestErr) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	collection := s.db.Database(s.dbName).Collection(FlatCollection)
+	insertResult, err := collection.InsertOne(ctx, fi)
+
+	if err != nil {
+		if isDuplicateKeyError(err) {
+			return "", duplicatedHashError(fi.Hash)
+		}
+		return "", dbError(ctx, err, "database error creating flat_info")
+	}
+
+	insertedID, ok := insertResult.InsertedID.(primitive.ObjectID)
+	if !ok {
+		return "", apierrors.NewInternalServerError("database error getting the id of the created flat_info")
+	}
+
+	return insertedID.Hex(), nil
+}
+
+func (s *storage) createMany(ctx context.Context, fis []FlatInfo) ([]string, []apierrors.RestErr) {
+	ids := make([]string, len(fis))
+	errs := make([]apierrors.RestErr, len(fis))
+	if len(fis) == 0 {
+		return ids, errs
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	docs := make([]interface{}, len(fis))
+	for i, fi := range fis {
+		docs[i] = fi
+	}
+
+	// the documents are inserted unordered, so the ones after an error are inserted too
+	collection := s.db.Database(s.dbName).Collection(FlatCollection)
+	insertResult, err := collection.InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+	if err != nil {
+		var bulkErr mongo.BulkWriteException
+		if !errors.As(err, &bulkErr) || bulkErr.WriteConcernError != nil {
+			for i := range errs {
+				errs[i] = dbError(ctx, err, "database error creating flat_info")
+			}
+			return ids, errs
+		}
+		for _, writeErr := range bulkErr.WriteErrors {
+			if writeErr.Code == duplicateKeyCode {
+				errs[writeErr.Index] = duplicatedHashError(fis[writeErr.Index].Hash)
+			} else {
+				errs[writeErr.Index] = dbError(ctx, writeErr, "database error creating flat_info")
+			}
+		}
+	}
+
+	for i, id := range insertResult.InsertedIDs {
+		if errs[i] != nil {
+			continue
+		}
+		insertedID, ok := id.(primitive.ObjectID)
+		if !ok {
+			errs[i] = apierrors.NewInternalServerError("database error getting the id of the created flat_info")
+			continue
+		}
+		ids[i] = insertedID.Hex()
+	}
+
+	return ids, errs
+}
+
+func (s *storage) get(ctx context.Context, id string) (FlatInfo, apierrors.RestErr) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	var fi FlatInfo
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return fi, apierrors.NewNotFoundError(fmt.Sprintf("flat_info %s not found", id))
+	}
+
+	collection := s.db.Database(s.dbName).Collection(FlatCollection)
+	if err := collection.FindOne(ctx, bson.M{"_id": objectID}).Decode(&fi); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return fi, apierrors.NewNotFoundError(fmt.Sprintf("flat_info %s not found", id))
+		}
+		return fi, dbError(ctx, err, "database error getting flat_info")
+	}
+
+	return fi, nil
+}
+
+func (s *storage) getByHash(ctx context.Context, hash string) (FlatInfo, apierrors.RestErr) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	var fi FlatInfo
+	collection := s.db.Database(s.dbName).Collection(FlatCollection)
+	if err := collection.FindOne(ctx, bson.M{"hash": hash}).Decode(&fi); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return fi, hashNotFoundError(hash)
+		}
+		return fi, dbError(ctx, err, "database error getting flat_info by hash")
 	}
+
+	return fi, nil
 }
 
-func (s *storage) create(fi FlatInfo) apierrors.RestErr {
+func (s *storage) getByIdempotencyKey(ctx context.Context, key string) (FlatInfo, apierrors.RestErr) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	var fi FlatInfo
 	collection := s.db.Database(s.dbName).Collection(FlatCollection)
-	insertResult, err := collection.InsertOne(context.TODO(), fi)
+	filter := bson.M{"idempotency_keys": bson.M{"$elemMatch": bson.M{
+		"key":        key,
+		"expires_at": bson.M{"$gt": time.Now().UTC()},
+	}}}
+	if err := collection.FindOne(ctx, filter).Decode(&fi); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return fi, idempotencyKeyNotFoundError(key)
+		}
+		return fi, dbError(ctx, err, "database error getting flat_info by idempotency key")
+	}
+
+	return fi, nil
+}
 
+func (s *storage) addIdempotencyKey(ctx context.Context, id string, key IdempotencyKey) apierrors.RestErr {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	objectID, err := primitive.ObjectIDFromHex(id)
 	if err != nil {
-		return apierrors.NewInternalServerError(fmt.Sprintf("database error creating flat_info: %s", err.Error()))
+		return apierrors.NewNotFoundError(fmt.Sprintf("flat_info %s not found", id))
+	}
+
+	// the same field can not be pulled and pushed in one update
+	collection := s.db.Database(s.dbName).Collection(FlatCollection)
+	filter := bson.M{"_id": objectID}
+	expired := bson.M{"$pull": bson.M{"idempotency_keys": bson.M{"expires_at": bson.M{"$lte": time.Now().UTC()}}}}
+	if _, err := collection.UpdateOne(ctx, filter, expired); err != nil {
+		return dbError(ctx, err, "database error removing the expired idempotency keys")
 	}
 
-	if insertedID, ok := insertResult.InsertedID.(primitive.ObjectID); ok {
-		fi.ID = insertedID.Hex()
+	updateResult, err := collection.UpdateOne(ctx, filter, bson.M{"$push": bson.M{"idempotency_keys": key}})
+	if err != nil {
+		return dbError(ctx, err, "database error adding the idempotency key")
+	}
+	if updateResult.MatchedCount == 0 {
+		return apierrors.NewNotFoundError(fmt.Sprintf("flat_info %s not found", id))
 	}
 
 	return nil
 }
 
-func (s *storage) getAll() ([]FlatInfo, apierrors.RestErr) {
+func (s *storage) getAll(ctx context.Context, query FlatsQuery) ([]FlatInfo, apierrors.RestErr) {
+	res := make([]FlatInfo, 0)
+	err := s.iterate(ctx, query, func(fi FlatInfo) apierrors.RestErr {
+		res = append(res, fi)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+func (s *storage) iterate(ctx context.Context, query FlatsQuery, fn func(FlatInfo) apierrors.RestErr) apierrors.RestErr {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
 	collection := s.db.Database(s.dbName).Collection(FlatCollection)
-	ctx := context.TODO()
+
+	filter, filterErr := buildFlatsFilter(query)
+	if filterErr != nil {
+		return filterErr
+	}
 
 	findOptions := options.Find()
-	findOptions.SetSort(bson.D{{"processed_at", -1}}).SetLimit(config.FlatsLimit)
-	cursor, err := collection.Find(ctx, bson.D{}, findOptions)
+	findOptions.SetSort(bson.D{{Key: "processed_at", Value: -1}, {Key: "_id", Value: -1}})
+	if query.Limit > 0 {
+		findOptions.SetLimit(query.Limit)
+	}
+	cursor, err := collection.Find(ctx, filter, findOptions)
 	if err != nil {
-		return nil, apierrors.NewInternalServerError(fmt.Sprintf("database error getting all flat_info: %s", err.Error()))
+		return dbError(ctx, err, "database error getting all flat_info")
 	}
+	defer cursor.Close(ctx)
 
-	var res []FlatInfo
-	if cursorErr := cursor.All(ctx, &res); cursorErr != nil {
-		return nil, apierrors.NewInternalServerError(fmt.Sprintf("database error iterating cursor of all flat_info: %s", err.Error()))
+	for cursor.Next(ctx) {
+		var fi FlatInfo
+		if err := cursor.Decode(&fi); err != nil {
+			return dbError(ctx, err, "database error decoding flat_info")
+		}
+		if err := fn(fi); err != nil {
+			return err
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return dbError(ctx, err, "database error iterating cursor of all flat_info")
 	}
 
-	return res, nil
+	return nil
+}
+
+func (s *storage) delete(ctx context.Context, id string) apierrors.RestErr {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return apierrors.NewNotFoundError(fmt.Sprintf("flat_info %s not found", id))
+	}
+
+	collection := s.db.Database(s.dbName).Collection(FlatCollection)
+	deleteResult, err := collection.DeleteOne(ctx, bson.M{"_id": objectID})
+	if err != nil {
+		return dbError(ctx, err, "database error deleting flat_info")
+	}
+	if deleteResult.DeletedCount == 0 {
+		return apierrors.NewNotFoundError(fmt.Sprintf("flat_info %s not found", id))
+	}
+
+	return nil
+}
+
+func (s *storage) purge(ctx context.Context, policy RetentionPolicy) (int64, apierrors.RestErr) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	collection := s.db.Database(s.dbName).Collection(FlatCollection)
+
+	var deleted int64
+	if policy.MaxAge > 0 {
+		filter := bson.M{"processed_at": bson.M{"$lt": time.Now().UTC().Add(-policy.MaxAge)}}
+		deleteResult, err := collection.DeleteMany(ctx, filter)
+		if err != nil {
+			return deleted, dbError(ctx, err, "database error purging flat_info by age")
+		}
+		deleted += deleteResult.DeletedCount
+	}
+
+	if policy.MaxCount > 0 {
+		// the last flat to keep is used as cursor, so the filter gets all the older ones
+		findOptions := options.FindOne()
+		findOptions.SetSort(bson.D{{Key: "processed_at", Value: -1}, {Key: "_id", Value: -1}}).SetSkip(policy.MaxCount - 1)
+
+		var last FlatInfo
+		if err := collection.FindOne(ctx, bson.M{}, findOptions).Decode(&last); err != nil {
+			if err == mongo.ErrNoDocuments {
+				return deleted, nil
+			}
+			return deleted, dbError(ctx, err, "database error purging flat_info by count")
+		}
+
+		filter, filterErr := buildFlatsFilter(FlatsQuery{Cursor: &FlatsCursor{ProcessedAt: last.ProcessedAt, ID: last.ID}})
+		if filterErr != nil {
+			return deleted, filterErr
+		}
+		deleteResult, err := collection.DeleteMany(ctx, filter)
+		if err != nil {
+			return deleted, dbError(ctx, err, "database error purging flat_info by count")
+		}
+		deleted += deleteResult.DeletedCount
+	}
+
+	return deleted, nil
+}
+
+func (s *storage) createJob(ctx context.Context, job Job) (string, apierrors.RestErr) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	collection := s.db.Database(s.dbName).Collection(JobCollection)
+	insertResult, err := collection.InsertOne(ctx, job)
+	if err != nil {
+		return "", dbError(ctx, err, "database error creating job")
+	}
+
+	insertedID, ok := insertResult.InsertedID.(primitive.ObjectID)
+	if !ok {
+		return "", apierrors.NewInternalServerError("database error getting the id of the created job")
+	}
+
+	return insertedID.Hex(), nil
+}
+
+func (s *storage) getJob(ctx context.Context, id string) (Job, apierrors.RestErr) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	var job Job
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return job, jobNotFoundError(id)
+	}
+
+	collection := s.db.Database(s.dbName).Collection(JobCollection)
+	if err := collection.FindOne(ctx, bson.M{"_id": objectID}).Decode(&job); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return job, jobNotFoundError(id)
+		}
+		return job, dbError(ctx, err, "database error getting job")
+	}
+
+	return job, nil
+}
+
+func (s *storage) updateJob(ctx context.Context, job Job) apierrors.RestErr {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	objectID, err := primitive.ObjectIDFromHex(job.ID)
+	if err != nil {
+		return jobNotFoundError(job.ID)
+	}
+
+	collection := s.db.Database(s.dbName).Collection(JobCollection)
+	update := bson.M{"$set": bson.M{
+		"status":     job.Status,
+		"flat_id":    job.FlatID,
+		"error":      job.Error,
+		"updated_at": job.UpdatedAt,
+	}}
+	updateResult, err := collection.UpdateOne(ctx, bson.M{"_id": objectID}, update)
+	if err != nil {
+		return dbError(ctx, err, "database error updating job")
+	}
+	if updateResult.MatchedCount == 0 {
+		return jobNotFoundError(job.ID)
+	}
+
+	return nil
+}
+
+func (s *storage) createDelivery(ctx context.Context, delivery Delivery) (string, apierrors.RestErr) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	collection := s.db.Database(s.dbName).Collection(DeliveryCollection)
+	insertResult, err := collection.InsertOne(ctx, delivery)
+	if err != nil {
+		return "", dbError(ctx, err, "database error creating delivery")
+	}
+
+	insertedID, ok := insertResult.InsertedID.(primitive.ObjectID)
+	if !ok {
+		return "", apierrors.NewInternalServerError("database error getting the id of the created delivery")
+	}
+
+	return insertedID.Hex(), nil
+}
+
+func (s *storage) getDeliveries(ctx context.Context, flatID string) ([]Delivery, apierrors.RestErr) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	collection := s.db.Database(s.dbName).Collection(DeliveryCollection)
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}, {Key: "_id", Value: 1}})
+	cursor, err := collection.Find(ctx, bson.M{"flat_id": flatID}, opts)
+	if err != nil {
+		return nil, dbError(ctx, err, "database error getting deliveries")
+	}
+	defer cursor.Close(ctx)
+
+	deliveries := make([]Delivery, 0)
+	if err := cursor.All(ctx, &deliveries); err != nil {
+		return nil, dbError(ctx, err, "database error decoding deliveries")
+	}
+
+	return deliveries, nil
+}
+
+func (s *storage) updateDelivery(ctx context.Context, delivery Delivery) apierrors.RestErr {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	objectID, err := primitive.ObjectIDFromHex(delivery.ID)
+	if err != nil {
+		return deliveryNotFoundError(delivery.ID)
+	}
+
+	collection := s.db.Database(s.dbName).Collection(DeliveryCollection)
+	update := bson.M{"$set": bson.M{
+		"status":     delivery.Status,
+		"attempts":   delivery.Attempts,
+		"error":      delivery.Error,
+		"updated_at": delivery.UpdatedAt,
+	}}
+	updateResult, err := collection.UpdateOne(ctx, bson.M{"_id": objectID}, update)
+	if err != nil {
+		return dbError(ctx, err, "database error updating delivery")
+	}
+	if updateResult.MatchedCount == 0 {
+		return deliveryNotFoundError(delivery.ID)
+	}
+
+	return nil
+}
+
+func (s *storage) HealthCheck(ctx context.Context) error {
+	return s.db.Ping(ctx, readpref.Primary())
+}
+
+// CreateIndexes creates the indexes of the flats collection if they not exist.
+// The hash is unique, the flats saved before it was added have not a hash,
+// so the index is sparse to skip them. The idempotency keys are indexed to find them,
+// and the flat id of the deliveries too
+func CreateIndexes(ctx context.Context, db *mongo.Client, cfg config.Storage) error {
+	ctx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+	defer cancel()
+
+	collection := db.Database(cfg.Database).Collection(FlatCollection)
+	_, err := collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "hash", Value: 1}},
+			Options: options.Index().SetUnique(true).SetSparse(true),
+		},
+		{
+			Keys:    bson.D{{Key: "idempotency_keys.key", Value: 1}},
+			Options: options.Index().SetSparse(true),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("error creating the indexes of %s: %w", FlatCollection, err)
+	}
+
+	collection = db.Database(cfg.Database).Collection(DeliveryCollection)
+	_, err = collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "flat_id", Value: 1}, {Key: "created_at", Value: 1}},
+	})
+	if err != nil {
+		return fmt.Errorf("error creating the indexes of %s: %w", DeliveryCollection, err)
+	}
+	return nil
+}
+
+// isDuplicateKeyError returns true if the insert failed because of a unique index
+func isDuplicateKeyError(err error) bool {
+	var writeErr mongo.WriteException
+	if !errors.As(err, &writeErr) {
+		return false
+	}
+	for _, e := range writeErr.WriteErrors {
+		if e.Code == duplicateKeyCode {
+			return true
+		}
+	}
+	return false
+}
+
+// duplicatedHashError is returned by create when there is a FlatInfo with the same hash
+func duplicatedHashError(hash string) apierrors.RestErr {
+	return apierrors.NewConflictError(fmt.Sprintf("flat_info with hash %s already exists", hash))
+}
+
+// hashNotFoundError is returned by getByHash when there is no FlatInfo with the hash
+func hashNotFoundError(hash string) apierrors.RestErr {
+	return apierrors.NewNotFoundError(fmt.Sprintf("flat_info with hash %s not found", hash))
+}
+
+// idempotencyKeyNotFoundError is returned by getByIdempotencyKey when there is no FlatInfo with the key
+func idempotencyKeyNotFoundError(key string) apierrors.RestErr {
+	return apierrors.NewNotFoundError(fmt.Sprintf("flat_info with idempotency key %s not found", key))
+}
+
+// jobNotFoundError is returned when there is no Job with the id
+func jobNotFoundError(id string) apierrors.RestErr {
+	return apierrors.NewNotFoundError(fmt.Sprintf("job %s not found", id))
+}
+
+// deliveryNotFoundError is returned when there is no Delivery with the id
+func deliveryNotFoundError(id string) apierrors.RestErr {
+	return apierrors.NewNotFoundError(fmt.Sprintf("delivery %s not found", id))
+}
+
+// dbError returns a timeout error if the ctx is done, because the db operation
+// was interrupted by it. Otherwise returns an internal server error with the db error
+func dbError(ctx context.Context, err error, message string) apierrors.RestErr {
+	if ctxErr := contextError(ctx); ctxErr != nil {
+		return ctxErr
+	}
+	return apierrors.NewInternalServerError(fmt.Sprintf("%s: %s", message, err.Error()))
+}
+
+// contextError returns nil if the ctx is not done
+func contextError(ctx context.Context) apierrors.RestErr {
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		return apierrors.NewGatewayTimeoutError("the database took too long to respond")
+	case context.Canceled:
+		return apierrors.NewServiceUnavailableError("the request was canceled before the database respond")
+	}
+	return nil
+}
+
+// buildFlatsFilter returns the mongo filter for the FlatsQuery.
+// The cursor gets the flats processed before it, or processed at the same time with a lower id
+func buildFlatsFilter(query FlatsQuery) (bson.M, apierrors.RestErr) {
+	conditions := bson.A{}
+
+	processedAt := bson.M{}
+	if query.From != nil {
+		processedAt["$gte"] = *query.From
+	}
+	if query.To != nil {
+		processedAt["$lt"] = *query.To
+	}
+	if len(processedAt) > 0 {
+		conditions = append(conditions, bson.M{"processed_at": processedAt})
+	}
+
+	maxDepth := bson.M{}
+	if query.MinDepth != nil {
+		maxDepth["$gte"] = *query.MinDepth
+	}
+	if query.MaxDepth != nil {
+		maxDepth["$lte"] = *query.MaxDepth
+	}
+	if len(maxDepth) > 0 {
+		conditions = append(conditions, bson.M{"max_depth": maxDepth})
+	}
+
+	leaves := bson.M{}
+	if query.MinLeaves != nil {
+		leaves["$gte"] = *query.MinLeaves
+	}
+	if query.MaxLeaves != nil {
+		leaves["$lte"] = *query.MaxLeaves
+	}
+	if len(leaves) > 0 {
+		conditions = append(conditions, bson.M{"stats.leaves": leaves})
+	}
+
+	if query.HasNulls != nil {
+		if *query.HasNulls {
+			conditions = append(conditions, bson.M{"stats.nulls": bson.M{"$gt": 0}})
+		} else {
+			conditions = append(conditions, bson.M{"stats.nulls": 0})
+		}
+	}
+
+	if query.Cursor != nil {
+		cursorID, err := primitive.ObjectIDFromHex(query.Cursor.ID)
+		if err != nil {
+			return nil, apierrors.NewBadRequestError("invalid next cursor")
+		}
+		conditions = append(conditions, bson.M{"$or": bson.A{
+			bson.M{"processed_at": bson.M{"$lt": query.Cursor.ProcessedAt}},
+			bson.M{"processed_at": query.Cursor.ProcessedAt, "_id": bson.M{"$lt": cursorID}},
+		}})
+	}
+
+	if len(conditions) == 0 {
+		return bson.M{}, nil
+	}
+	return bson.M{"$and": conditions}, nil
 }
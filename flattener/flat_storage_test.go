@@ -2,44 +2,485 @@ package flattener
 
 import (
 	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/mendezdev/tgo_flattener/apierrors"
 	"github.com/mendezdev/tgo_flattener/config"
 	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+// testFlatsLimit is the page size used in the tests
+const testFlatsLimit = int64(100)
+
+// the environment variables of the mongo tests, see the README
+const (
+	testMongoURIEnv      = "FLATTENER_TEST_MONGO_URI"
+	testMongoRequiredEnv = "FLATTENER_TEST_MONGO_REQUIRED"
+)
+
+// testMongo is the client of the mongo tests, it is connected once for all of them.
+// err is set if there is no db running
+var testMongo struct {
+	once   sync.Once
+	client *mongo.Client
+	err    error
+}
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	if testMongo.client != nil {
+		testMongo.client.Disconnect(context.Background())
+	}
+	os.Exit(code)
+}
+
+// testMongoClient connects to the uri of FLATTENER_TEST_MONGO_URI or to the default port
+func testMongoClient() (*mongo.Client, error) {
+	testMongo.once.Do(func() {
+		uri := os.Getenv(testMongoURIEnv)
+		if uri == "" {
+			uri = "mongodb://localhost:27017"
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+
+		opts := options.Client().ApplyURI(uri).SetServerSelectionTimeout(2 * time.Second)
+		client, err := mongo.Connect(ctx, opts)
+		if err == nil {
+			if err = client.Ping(ctx, nil); err != nil {
+				client.Disconnect(ctx)
+			}
+		}
+		if err != nil {
+			testMongo.err = err
+			return
+		}
+		testMongo.client = client
+	})
+	return testMongo.client, testMongo.err
+}
+
+// forEachStorage runs the same test for every Storage implementation.
+// The mongo one is skipped if there is no db running, unless FLATTENER_TEST_MONGO_REQUIRED is true
+func forEachStorage(t *testing.T, test func(t *testing.T, storage Storage)) {
+	t.Run("memory", func(t *testing.T) {
+		test(t, NewMemoryStorage())
+	})
+
+	t.Run("mongo", func(t *testing.T) {
+		client, err := testMongoClient()
+		if err != nil {
+			if os.Getenv(testMongoRequiredEnv) == "true" {
+				t.Fatalf("mongodb is not available: %s", err.Error())
+			}
+			t.Skipf("mongodb is not available: %s", err.Error())
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+
+		cfg := config.Storage{Database: DbNameTest, Timeout: 10 * time.Second}
+		assert.Nil(t, CreateIndexes(ctx, client, cfg))
+		test(t, NewStorage(client, cfg))
+
+		for _, collection := range []string{FlatCollection, JobCollection, DeliveryCollection} {
+			dropErr := client.Database(DbNameTest).Collection(collection).Drop(context.Background())
+			assert.Nil(t, dropErr)
+		}
+	})
+}
+
 func TestGetAllFlats(t *testing.T) {
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
+	forEachStorage(t, func(t *testing.T, storage Storage) {
+		qtyNewDocuments, createErr := createFlatsInfo(storage)
+		assert.Nil(t, createErr)
 
-	client, err := mongo.Connect(ctx, options.Client().ApplyURI("mongodb://localhost:27017"))
-	assert.Nil(t, err)
-	assert.NotNil(t, client)
-	defer client.Disconnect(ctx)
+		flats, getErr := storage.getAll(context.Background(), FlatsQuery{Limit: testFlatsLimit})
+		assert.Nil(t, getErr)
+		assert.NotNil(t, flats)
+		assert.Equal(t, testFlatsLimit, int64(len(flats)))
 
-	storage := NewTestStorage(client)
-	qtyNewDocuments, createErr := createFlatsInfo(storage)
-	assert.Nil(t, createErr)
+		allFlats, getErr := storage.getAll(context.Background(), FlatsQuery{})
+		assert.Nil(t, getErr)
+		assert.Len(t, allFlats, 140)
 
-	flats, getErr := storage.getAll()
-	assert.Nil(t, getErr)
-	assert.NotNil(t, flats)
-	assert.Equal(t, config.FlatsLimit, int64(len(flats)))
+		now := time.Now().UTC()
+		var counter int
+		for _, f := range flats {
+			if f.ProcessedAt.After(now) {
+				counter++
+			}
+		}
+		assert.Equal(t, qtyNewDocuments, counter)
 
-	now := time.Now().UTC()
-	var counter int
-	for _, f := range flats {
-		if f.ProcessedAt.After(now) {
-			counter++
+		// the next page starts after the last one without repeating records
+		last := flats[len(flats)-1]
+		nextPage, getErr := storage.getAll(context.Background(), FlatsQuery{
+			Limit:  testFlatsLimit,
+			Cursor: &FlatsCursor{ProcessedAt: last.ProcessedAt, ID: last.ID},
+		})
+		assert.Nil(t, getErr)
+		assert.Len(t, nextPage, 140-int(testFlatsLimit))
+		for _, f := range nextPage {
+			assert.False(t, f.ProcessedAt.After(last.ProcessedAt))
+			assert.NotEqual(t, last.ID, f.ID)
 		}
-	}
-	assert.Equal(t, qtyNewDocuments, counter)
 
-	dropErr := client.Database(DbNameTest).Collection(FlatCollection).Drop(context.Background())
-	assert.Nil(t, dropErr)
+		// filtering only the new records
+		from := now
+		newFlats, getErr := storage.getAll(context.Background(), FlatsQuery{Limit: testFlatsLimit, From: &from})
+		assert.Nil(t, getErr)
+		assert.Len(t, newFlats, qtyNewDocuments)
+	})
+}
+
+func TestIterateFlats(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, storage Storage) {
+		_, createErr := createFlatsInfo(storage)
+		assert.Nil(t, createErr)
+
+		flats, getErr := storage.getAll(context.Background(), FlatsQuery{Limit: testFlatsLimit})
+		assert.Nil(t, getErr)
+
+		// the same flats in the same order
+		iterated := make([]FlatInfo, 0)
+		iterateErr := storage.iterate(context.Background(), FlatsQuery{Limit: testFlatsLimit}, func(fi FlatInfo) apierrors.RestErr {
+			iterated = append(iterated, fi)
+			return nil
+		})
+		assert.Nil(t, iterateErr)
+		assert.Equal(t, len(flats), len(iterated))
+		for i := range flats {
+			assert.Equal(t, flats[i].ID, iterated[i].ID)
+		}
+
+		// it stops with the first error
+		var calls int
+		iterateErr = storage.iterate(context.Background(), FlatsQuery{}, func(fi FlatInfo) apierrors.RestErr {
+			calls++
+			return apierrors.NewInternalServerError("stop")
+		})
+		assert.NotNil(t, iterateErr)
+		assert.Equal(t, "stop", iterateErr.Message())
+		assert.Equal(t, 1, calls)
+	})
+}
+
+func TestCreateAndGetFlat(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, storage Storage) {
+		id, createErr := storage.create(context.Background(), buildFlatInfo(time.Now().UTC()))
+		assert.Nil(t, createErr)
+		assert.NotEmpty(t, id)
+
+		fi, getErr := storage.get(context.Background(), id)
+		assert.Nil(t, getErr)
+		assert.Equal(t, id, fi.ID)
+		assert.Len(t, fi.VertexSecuence, 4)
+
+		_, getErr = storage.get(context.Background(), "000000000000000000000000")
+		assert.NotNil(t, getErr)
+		assert.Equal(t, http.StatusNotFound, getErr.Status())
+
+		_, getErr = storage.get(context.Background(), "malformed")
+		assert.NotNil(t, getErr)
+		assert.Equal(t, http.StatusNotFound, getErr.Status())
+	})
+}
+
+func TestCreateAndGetDocument(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, storage Storage) {
+		input := map[string]interface{}{"a": []interface{}{"x", map[string]interface{}{"b": true}}}
+		fi, apiErr := FlatDocument(input, FlatOptions{})
+		assert.Nil(t, apiErr)
+
+		id, createErr := storage.create(context.Background(), fi)
+		assert.Nil(t, createErr)
+
+		saved, getErr := storage.get(context.Background(), id)
+		assert.Nil(t, getErr)
+		assert.Equal(t, FlatTypeDocument, saved.Type)
+		assert.Equal(t, FormatCompact, saved.FormatVersion)
+		assert.Equal(t, fi.Compact, saved.Compact)
+	})
+}
+
+func TestCreateDuplicatedHash(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, storage Storage) {
+		fi, apiErr := FlatArray([]interface{}{1, []interface{}{"a"}}, FlatOptions{})
+		assert.Nil(t, apiErr)
+
+		id, createErr := storage.create(context.Background(), fi)
+		assert.Nil(t, createErr)
+
+		_, createErr = storage.create(context.Background(), fi)
+		assert.NotNil(t, createErr)
+		assert.Equal(t, http.StatusConflict, createErr.Status())
+
+		saved, getErr := storage.getByHash(context.Background(), fi.Hash)
+		assert.Nil(t, getErr)
+		assert.Equal(t, id, saved.ID)
+		assert.Equal(t, fi.Hash, saved.Hash)
+
+		// the flats without hash are never duplicated
+		for i := 0; i < 2; i++ {
+			_, createErr = storage.create(context.Background(), buildFlatInfo(time.Now().UTC()))
+			assert.Nil(t, createErr)
+		}
+
+		// the hash can be used again after deleting the flat
+		assert.Nil(t, storage.delete(context.Background(), id))
+		_, getErr = storage.getByHash(context.Background(), fi.Hash)
+		assert.NotNil(t, getErr)
+		assert.Equal(t, http.StatusNotFound, getErr.Status())
+		assert.Equal(t, fmt.Sprintf("flat_info with hash %s not found", fi.Hash), getErr.Message())
+
+		_, createErr = storage.create(context.Background(), fi)
+		assert.Nil(t, createErr)
+	})
+}
+
+func TestCreateManyFlats(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, storage Storage) {
+		saved, apiErr := FlatArray([]interface{}{"saved"}, FlatOptions{})
+		assert.Nil(t, apiErr)
+		savedID, createErr := storage.create(context.Background(), saved)
+		assert.Nil(t, createErr)
+
+		fi, apiErr := FlatArray([]interface{}{"new"}, FlatOptions{})
+		assert.Nil(t, apiErr)
+		legacy := buildFlatInfo(time.Now().UTC())
+
+		ids, errs := storage.createMany(context.Background(), []FlatInfo{fi, saved, legacy, fi})
+		assert.Len(t, ids, 4)
+		assert.Len(t, errs, 4)
+
+		// the errors do not stop the other flats
+		for _, i := range []int{0, 2} {
+			assert.Nil(t, errs[i])
+			got, getErr := storage.get(context.Background(), ids[i])
+			assert.Nil(t, getErr)
+			assert.Equal(t, ids[i], got.ID)
+		}
+		for _, i := range []int{1, 3} {
+			assert.NotNil(t, errs[i])
+			assert.Equal(t, http.StatusConflict, errs[i].Status())
+			assert.Empty(t, ids[i])
+		}
+		assert.NotEqual(t, savedID, ids[0])
+
+		ids, errs = storage.createMany(context.Background(), []FlatInfo{})
+		assert.Empty(t, ids)
+		assert.Empty(t, errs)
+	})
+}
+
+func TestIdempotencyKeys(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, storage Storage) {
+		now := time.Now().UTC()
+		fi, apiErr := FlatArray([]interface{}{1, 2}, FlatOptions{})
+		assert.Nil(t, apiErr)
+		fi.IdempotencyKeys = []IdempotencyKey{
+			{Key: "live", ExpiresAt: now.Add(time.Hour)},
+			{Key: "expired", ExpiresAt: now.Add(-time.Hour)},
+		}
+
+		id, createErr := storage.create(context.Background(), fi)
+		assert.Nil(t, createErr)
+
+		saved, getErr := storage.getByIdempotencyKey(context.Background(), "live")
+		assert.Nil(t, getErr)
+		assert.Equal(t, id, saved.ID)
+
+		for _, key := range []string{"expired", "unknown"} {
+			_, getErr = storage.getByIdempotencyKey(context.Background(), key)
+			assert.NotNil(t, getErr)
+			assert.Equal(t, http.StatusNotFound, getErr.Status())
+			assert.Equal(t, fmt.Sprintf("flat_info with idempotency key %s not found", key), getErr.Message())
+		}
+
+		// adding a key removes the expired ones
+		addErr := storage.addIdempotencyKey(context.Background(), id, IdempotencyKey{Key: "other", ExpiresAt: now.Add(time.Hour), Deduplicated: true})
+		assert.Nil(t, addErr)
+		saved, getErr = storage.getByIdempotencyKey(context.Background(), "other")
+		assert.Nil(t, getErr)
+		assert.Equal(t, id, saved.ID)
+		keys := make([]string, 0)
+		for _, ik := range saved.IdempotencyKeys {
+			keys = append(keys, ik.Key)
+		}
+		assert.Equal(t, []string{"live", "other"}, keys)
+
+		for _, missing := range []string{"000000000000000000000000", "malformed"} {
+			addErr = storage.addIdempotencyKey(context.Background(), missing, IdempotencyKey{Key: "x", ExpiresAt: now.Add(time.Hour)})
+			assert.NotNil(t, addErr)
+			assert.Equal(t, http.StatusNotFound, addErr.Status())
+		}
+
+		assert.Nil(t, storage.delete(context.Background(), id))
+		_, getErr = storage.getByIdempotencyKey(context.Background(), "live")
+		assert.NotNil(t, getErr)
+		assert.Equal(t, http.StatusNotFound, getErr.Status())
+	})
+}
+
+func TestCreateGetAndUpdateJob(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, storage Storage) {
+		now := time.Now().UTC().Truncate(time.Millisecond)
+		id, createErr := storage.createJob(context.Background(), Job{Status: JobPending, CreatedAt: now, UpdatedAt: now})
+		assert.Nil(t, createErr)
+		assert.NotEmpty(t, id)
+
+		job, getErr := storage.getJob(context.Background(), id)
+		assert.Nil(t, getErr)
+		assert.Equal(t, Job{ID: id, Status: JobPending, CreatedAt: now, UpdatedAt: now}, job)
+
+		job.Status = JobFailed
+		job.Error = &JobError{Status: http.StatusBadRequest, Message: "error parsing body"}
+		job.UpdatedAt = now.Add(time.Second)
+		assert.Nil(t, storage.updateJob(context.Background(), job))
+
+		updated, getErr := storage.getJob(context.Background(), id)
+		assert.Nil(t, getErr)
+		assert.Equal(t, job, updated)
+
+		for _, missing := range []string{"000000000000000000000000", "malformed"} {
+			_, getErr = storage.getJob(context.Background(), missing)
+			assert.NotNil(t, getErr)
+			assert.Equal(t, http.StatusNotFound, getErr.Status())
+			assert.Equal(t, fmt.Sprintf("job %s not found", missing), getErr.Message())
+
+			updateErr := storage.updateJob(context.Background(), Job{ID: missing, Status: JobDone})
+			assert.NotNil(t, updateErr)
+			assert.Equal(t, http.StatusNotFound, updateErr.Status())
+		}
+	})
+}
+
+func TestCreateGetAndUpdateDeliveries(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, storage Storage) {
+		now := time.Now().UTC().Truncate(time.Millisecond)
+		flatID := primitive.NewObjectID().Hex()
+		first := Delivery{FlatID: flatID, URL: "http://localhost/first", Status: DeliveryPending, Attempts: []DeliveryAttempt{}, CreatedAt: now, UpdatedAt: now}
+		second := Delivery{FlatID: flatID, URL: "http://localhost/second", Status: DeliveryPending, Attempts: []DeliveryAttempt{}, CreatedAt: now.Add(time.Second), UpdatedAt: now}
+		other := Delivery{FlatID: primitive.NewObjectID().Hex(), URL: "http://localhost/other", Status: DeliveryPending, Attempts: []DeliveryAttempt{}, CreatedAt: now, UpdatedAt: now}
+
+		var err apierrors.RestErr
+		for _, delivery := range []*Delivery{&second, &first, &other} {
+			delivery.ID, err = storage.createDelivery(context.Background(), *delivery)
+			assert.Nil(t, err)
+			assert.NotEmpty(t, delivery.ID)
+		}
+
+		deliveries, err := storage.getDeliveries(context.Background(), flatID)
+		assert.Nil(t, err)
+		assert.Equal(t, []Delivery{first, second}, deliveries)
+
+		first.Status = DeliveryFailed
+		first.Error = "the callback failed after 2 attempts"
+		first.Attempts = []DeliveryAttempt{
+			{At: now, Error: "connection refused"},
+			{At: now.Add(time.Second), StatusCode: http.StatusInternalServerError, Error: "the callback url answered 500"},
+		}
+		first.UpdatedAt = now.Add(2 * time.Second)
+		assert.Nil(t, storage.updateDelivery(context.Background(), first))
+
+		deliveries, err = storage.getDeliveries(context.Background(), flatID)
+		assert.Nil(t, err)
+		assert.Equal(t, []Delivery{first, second}, deliveries)
+
+		deliveries, err = storage.getDeliveries(context.Background(), "malformed")
+		assert.Nil(t, err)
+		assert.Empty(t, deliveries)
+
+		for _, missing := range []string{"000000000000000000000000", "malformed"} {
+			updateErr := storage.updateDelivery(context.Background(), Delivery{ID: missing, Status: DeliveryDelivered})
+			assert.NotNil(t, updateErr)
+			assert.Equal(t, http.StatusNotFound, updateErr.Status())
+			assert.Equal(t, fmt.Sprintf("delivery %s not found", missing), updateErr.Message())
+		}
+	})
+}
+
+func TestGetAllFlatsByStats(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, storage Storage) {
+		inputs := [][]interface{}{
+			{"a"},
+			{"a", nil, []interface{}{"b"}},
+			{"a", "b", "c", "d"},
+		}
+		for _, input := range inputs {
+			fi, apiErr := FlatArray(input, FlatOptions{})
+			assert.Nil(t, apiErr)
+			_, createErr := storage.create(context.Background(), fi)
+			assert.Nil(t, createErr)
+		}
+
+		// saved without stats, it never matches the stats filters
+		_, createErr := storage.create(context.Background(), buildFlatInfo(time.Now().UTC()))
+		assert.Nil(t, createErr)
+
+		two, three := 2, 3
+		hasNulls, noNulls := true, false
+		testCases := []struct {
+			Name  string
+			Query FlatsQuery
+			Len   int
+		}{
+			{"min_leaves", FlatsQuery{MinLeaves: &three}, 2},
+			{"max_leaves", FlatsQuery{MaxLeaves: &two}, 1},
+			{"leaves_range", FlatsQuery{MinLeaves: &two, MaxLeaves: &three}, 1},
+			{"has_nulls", FlatsQuery{HasNulls: &hasNulls}, 1},
+			{"has_no_nulls", FlatsQuery{HasNulls: &noNulls}, 2},
+		}
+
+		for _, tc := range testCases {
+			t.Run(tc.Name, func(t *testing.T) {
+				flats, getErr := storage.getAll(context.Background(), tc.Query)
+				assert.Nil(t, getErr)
+				assert.Len(t, flats, tc.Len)
+				for _, f := range flats {
+					assert.NotNil(t, f.Stats)
+				}
+			})
+		}
+	})
+}
+
+func TestDeleteAndPurgeFlats(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, storage Storage) {
+		id, createErr := storage.create(context.Background(), buildFlatInfo(time.Now().UTC()))
+		assert.Nil(t, createErr)
+
+		assert.Nil(t, storage.delete(context.Background(), id))
+		deleteErr := storage.delete(context.Background(), id)
+		assert.NotNil(t, deleteErr)
+		assert.Equal(t, http.StatusNotFound, deleteErr.Status())
+
+		qtyNewDocuments, createManyErr := createFlatsInfo(storage)
+		assert.Nil(t, createManyErr)
+
+		// the old ones are 50 and they were processed a moment ago
+		deleted, purgeErr := storage.purge(context.Background(), RetentionPolicy{MaxAge: time.Nanosecond})
+		assert.Nil(t, purgeErr)
+		assert.Equal(t, int64(50), deleted)
+
+		deleted, purgeErr = storage.purge(context.Background(), RetentionPolicy{MaxCount: 10})
+		assert.Nil(t, purgeErr)
+		assert.Equal(t, int64(qtyNewDocuments-10), deleted)
+
+		flats, getErr := storage.getAll(context.Background(), FlatsQuery{Limit: testFlatsLimit})
+		assert.Nil(t, getErr)
+		assert.Len(t, flats, 10)
+	})
 }
 
 // this creates a 140 records:
@@ -53,7 +494,7 @@ func createFlatsInfo(s Storage) (qtyNewDocuments int, err error) {
 
 	for i := 0; i < qtyOldDocuments; i++ {
 		fi := buildFlatInfo(oldProcessedTime)
-		err := s.create(fi)
+		_, err := s.create(context.Background(), fi)
 		if err != nil {
 			return qtyNewDocuments, err
 		}
@@ -61,7 +502,7 @@ func createFlatsInfo(s Storage) (qtyNewDocuments int, err error) {
 
 	for i := 0; i < qtyNewDocuments; i++ {
 		fi := buildFlatInfo(newProcessedTime)
-		err := s.create(fi)
+		_, err := s.create(context.Background(), fi)
 		if err != nil {
 			return qtyNewDocuments, err
 		}
@@ -72,10 +513,10 @@ func createFlatsInfo(s Storage) (qtyNewDocuments int, err error) {
 // is the same flat_info only for test purposes
 func buildFlatInfo(processedAt time.Time) FlatInfo {
 	vtxSecuences := make([]VertexSecuence, 0)
-	vtx0 := VertexSecuence{0, DataInfo{}, []int{1}}
-	vtx1 := VertexSecuence{1, DataInfo{}, []int{2, 3}}
-	vtx2 := VertexSecuence{2, DataInfo{"string", "value2"}, []int{}}
-	vtx3 := VertexSecuence{3, DataInfo{"string", "value2"}, []int{}}
+	vtx0 := VertexSecuence{Key: 0, DataInfo: DataInfo{}, Edges: []int{1}}
+	vtx1 := VertexSecuence{Key: 1, DataInfo: DataInfo{}, Edges: []int{2, 3}}
+	vtx2 := VertexSecuence{Key: 2, DataInfo: DataInfo{"string", "value2"}, Edges: []int{}}
+	vtx3 := VertexSecuence{Key: 3, DataInfo: DataInfo{"string", "value2"}, Edges: []int{}}
 	vtxSecuences = append(vtxSecuences, vtx0, vtx1, vtx2, vtx3)
 	return FlatInfo{
 		MaxDepth:       0,
@@ -0,0 +1,81 @@
+package flattener
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// RetentionPolicy sets which flats are deleted by the Sweeper.
+// MaxAge deletes the flats processed before that time and MaxCount
+// keeps only that number of the newest flats. The zero values disable each rule
+type RetentionPolicy struct {
+	MaxAge   time.Duration
+	MaxCount int64
+}
+
+// Enabled returns true if the policy has at least one rule
+func (rp RetentionPolicy) Enabled() bool {
+	return rp.MaxAge > 0 || rp.MaxCount > 0
+}
+
+// Sweeper deletes periodically the flats out of the RetentionPolicy
+type Sweeper struct {
+	storage  Storage
+	policy   RetentionPolicy
+	interval time.Duration
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func NewSweeper(s Storage, policy RetentionPolicy, interval time.Duration) *Sweeper {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Sweeper{
+		storage:  s,
+		policy:   policy,
+		interval: interval,
+		ctx:      ctx,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+}
+
+// Start runs the first sweep right away and then one every interval
+// until Stop is called
+func (sw *Sweeper) Start() {
+	go func() {
+		defer close(sw.done)
+
+		ticker := time.NewTicker(sw.interval)
+		defer ticker.Stop()
+
+		for {
+			sw.sweep()
+			select {
+			case <-sw.ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Stop cancels the running sweep and waits until it finish. It must be called
+// after Start and it is safe to call it more than once
+func (sw *Sweeper) Stop() {
+	sw.cancel()
+	<-sw.done
+}
+
+func (sw *Sweeper) sweep() {
+	deleted, err := sw.storage.purge(sw.ctx, sw.policy)
+	if err != nil {
+		fmt.Printf("error purging flats: %s\n", err.Message())
+		return
+	}
+	if deleted > 0 {
+		fmt.Printf("%d flats purged\n", deleted)
+	}
+}
@@ -0,0 +1,63 @@
+package flattener
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/mendezdev/tgo_flattener/apierrors"
+)
+
+func TestSweeperPurgesUntilStop(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockStorage := NewMockStorage(mockCtrl)
+	policy := RetentionPolicy{MaxCount: 10}
+
+	purged := make(chan struct{}, 10)
+	mockStorage.
+		EXPECT().
+		purge(gomock.Any(), policy).
+		DoAndReturn(func(context.Context, RetentionPolicy) (int64, apierrors.RestErr) {
+			purged <- struct{}{}
+			return 1, nil
+		}).
+		MinTimes(2)
+
+	sweeper := NewSweeper(mockStorage, policy, time.Millisecond)
+	sweeper.Start()
+
+	<-purged
+	<-purged
+	sweeper.Stop()
+
+	// stopping again does not block
+	sweeper.Stop()
+}
+
+func TestSweeperKeepsRunningAfterError(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockStorage := NewMockStorage(mockCtrl)
+	policy := RetentionPolicy{MaxAge: time.Hour}
+
+	purged := make(chan struct{}, 10)
+	mockStorage.
+		EXPECT().
+		purge(gomock.Any(), policy).
+		DoAndReturn(func(context.Context, RetentionPolicy) (int64, apierrors.RestErr) {
+			purged <- struct{}{}
+			return 0, apierrors.NewInternalServerError("database error")
+		}).
+		MinTimes(2)
+
+	sweeper := NewSweeper(mockStorage, policy, time.Millisecond)
+	sweeper.Start()
+
+	<-purged
+	<-purged
+	sweeper.Stop()
+}
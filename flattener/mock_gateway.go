@@ -5,6 +5,9 @@
 package flattener
 
 import (
+	context "context"
+	json "encoding/json"
+	io "io"
 	reflect "reflect"
 
 	gomock "github.com/golang/mock/gomock"
@@ -34,32 +37,152 @@ func (m *MockGateway) EXPECT() *MockGatewayMockRecorder {
 	return m.recorder
 }
 
-// FlatResponse mocks base method.
-func (m *MockGateway) FlatResponse(arg0 []interface{}) (FlatResponse, apierrors.RestErr) {
+// DeleteFlat mocks base method.
+func (m *MockGateway) DeleteFlat(ctx context.Context, id string) apierrors.RestErr {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "FlatResponse", arg0)
+	ret := m.ctrl.Call(m, "DeleteFlat", ctx, id)
+	ret0, _ := ret[0].(apierrors.RestErr)
+	return ret0
+}
+
+// DeleteFlat indicates an expected call of DeleteFlat.
+func (mr *MockGatewayMockRecorder) DeleteFlat(ctx, id interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteFlat", reflect.TypeOf((*MockGateway)(nil).DeleteFlat), ctx, id)
+}
+
+// FlatBatchResponse mocks base method.
+func (m *MockGateway) FlatBatchResponse(arg0 context.Context, arg1 []json.RawMessage, arg2 FlatOptions) (FlatBatchResponse, apierrors.RestErr) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "FlatBatchResponse", arg0, arg1, arg2)
+	ret0, _ := ret[0].(FlatBatchResponse)
+	ret1, _ := ret[1].(apierrors.RestErr)
+	return ret0, ret1
+}
+
+// FlatBatchResponse indicates an expected call of FlatBatchResponse.
+func (mr *MockGatewayMockRecorder) FlatBatchResponse(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FlatBatchResponse", reflect.TypeOf((*MockGateway)(nil).FlatBatchResponse), arg0, arg1, arg2)
+}
+
+// FlatDocumentResponse mocks base method.
+func (m *MockGateway) FlatDocumentResponse(ctx context.Context, input interface{}) (FlatDocumentResponse, apierrors.RestErr) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "FlatDocumentResponse", ctx, input)
+	ret0, _ := ret[0].(FlatDocumentResponse)
+	ret1, _ := ret[1].(apierrors.RestErr)
+	return ret0, ret1
+}
+
+// FlatDocumentResponse indicates an expected call of FlatDocumentResponse.
+func (mr *MockGatewayMockRecorder) FlatDocumentResponse(ctx, input interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FlatDocumentResponse", reflect.TypeOf((*MockGateway)(nil).FlatDocumentResponse), ctx, input)
+}
+
+// FlatStreamResponse mocks base method.
+func (m *MockGateway) FlatStreamResponse(arg0 context.Context, arg1 io.Reader, arg2 FlatOptions) (FlatResponse, apierrors.RestErr) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "FlatStreamResponse", arg0, arg1, arg2)
 	ret0, _ := ret[0].(FlatResponse)
 	ret1, _ := ret[1].(apierrors.RestErr)
 	return ret0, ret1
 }
 
-// FlatResponse indicates an expected call of FlatResponse.
-func (mr *MockGatewayMockRecorder) FlatResponse(arg0 interface{}) *gomock.Call {
+// FlatStreamResponse indicates an expected call of FlatStreamResponse.
+func (mr *MockGatewayMockRecorder) FlatStreamResponse(arg0, arg1, arg2 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FlatResponse", reflect.TypeOf((*MockGateway)(nil).FlatResponse), arg0)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FlatStreamResponse", reflect.TypeOf((*MockGateway)(nil).FlatStreamResponse), arg0, arg1, arg2)
+}
+
+// FlatStreamValues mocks base method.
+func (m *MockGateway) FlatStreamValues(arg0 context.Context, arg1 io.Reader, arg2 FlatOptions) (FlatResponse, FlatValues, apierrors.RestErr) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "FlatStreamValues", arg0, arg1, arg2)
+	ret0, _ := ret[0].(FlatResponse)
+	ret1, _ := ret[1].(FlatValues)
+	ret2, _ := ret[2].(apierrors.RestErr)
+	return ret0, ret1, ret2
+}
+
+// FlatStreamValues indicates an expected call of FlatStreamValues.
+func (mr *MockGatewayMockRecorder) FlatStreamValues(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FlatStreamValues", reflect.TypeOf((*MockGateway)(nil).FlatStreamValues), arg0, arg1, arg2)
+}
+
+// GetFlat mocks base method.
+func (m *MockGateway) GetFlat(ctx context.Context, id string) (FlatInfoResponse, apierrors.RestErr) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetFlat", ctx, id)
+	ret0, _ := ret[0].(FlatInfoResponse)
+	ret1, _ := ret[1].(apierrors.RestErr)
+	return ret0, ret1
+}
+
+// GetFlat indicates an expected call of GetFlat.
+func (mr *MockGatewayMockRecorder) GetFlat(ctx, id interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetFlat", reflect.TypeOf((*MockGateway)(nil).GetFlat), ctx, id)
+}
+
+// GetFlatByHash mocks base method.
+func (m *MockGateway) GetFlatByHash(ctx context.Context, hash string) (FlatInfoResponse, apierrors.RestErr) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetFlatByHash", ctx, hash)
+	ret0, _ := ret[0].(FlatInfoResponse)
+	ret1, _ := ret[1].(apierrors.RestErr)
+	return ret0, ret1
+}
+
+// GetFlatByHash indicates an expected call of GetFlatByHash.
+func (mr *MockGatewayMockRecorder) GetFlatByHash(ctx, hash interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetFlatByHash", reflect.TypeOf((*MockGateway)(nil).GetFlatByHash), ctx, hash)
 }
 
 // GetFlats mocks base method.
-func (m *MockGateway) GetFlats() ([]FlatInfoResponse, apierrors.RestErr) {
+func (m *MockGateway) GetFlats(arg0 context.Context, arg1 FlatsQuery) (FlatsPage, apierrors.RestErr) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "GetFlats")
-	ret0, _ := ret[0].([]FlatInfoResponse)
+	ret := m.ctrl.Call(m, "GetFlats", arg0, arg1)
+	ret0, _ := ret[0].(FlatsPage)
 	ret1, _ := ret[1].(apierrors.RestErr)
 	return ret0, ret1
 }
 
 // GetFlats indicates an expected call of GetFlats.
-func (mr *MockGatewayMockRecorder) GetFlats() *gomock.Call {
+func (mr *MockGatewayMockRecorder) GetFlats(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetFlats", reflect.TypeOf((*MockGateway)(nil).GetFlats), arg0, arg1)
+}
+
+// StreamFlats mocks base method.
+func (m *MockGateway) StreamFlats(ctx context.Context, query FlatsQuery, fn func(FlatInfoResponse) error) (string, apierrors.RestErr) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "StreamFlats", ctx, query, fn)
+	ret0, _ := ret[0].(string)
+	ret1, _ := ret[1].(apierrors.RestErr)
+	return ret0, ret1
+}
+
+// StreamFlats indicates an expected call of StreamFlats.
+func (mr *MockGatewayMockRecorder) StreamFlats(ctx, query, fn interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "StreamFlats", reflect.TypeOf((*MockGateway)(nil).StreamFlats), ctx, query, fn)
+}
+
+// Unflatten mocks base method.
+func (m *MockGateway) Unflatten(arg0 UnflatRequest) (UnflatResponse, apierrors.RestErr) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Unflatten", arg0)
+	ret0, _ := ret[0].(UnflatResponse)
+	ret1, _ := ret[1].(apierrors.RestErr)
+	return ret0, ret1
+}
+
+// Unflatten indicates an expected call of Unflatten.
+func (mr *MockGatewayMockRecorder) Unflatten(arg0 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetFlats", reflect.TypeOf((*MockGateway)(nil).GetFlats))
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Unflatten", reflect.TypeOf((*MockGateway)(nil).Unflatten), arg0)
 }
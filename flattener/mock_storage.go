@@ -5,6 +5,7 @@
 package flattener
 
 import (
+	context "context"
 	reflect "reflect"
 
 	gomock "github.com/golang/mock/gomock"
@@ -34,31 +35,251 @@ func (m *MockStorage) EXPECT() *MockStorageMockRecorder {
 	return m.recorder
 }
 
-// create mocks base method.
-func (m *MockStorage) create(arg0 FlatInfo) apierrors.RestErr {
+// HealthCheck mocks base method.
+func (m *MockStorage) HealthCheck(ctx context.Context) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "HealthCheck", ctx)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// HealthCheck indicates an expected call of HealthCheck.
+func (mr *MockStorageMockRecorder) HealthCheck(ctx interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "HealthCheck", reflect.TypeOf((*MockStorage)(nil).HealthCheck), ctx)
+}
+
+// addIdempotencyKey mocks base method.
+func (m *MockStorage) addIdempotencyKey(ctx context.Context, id string, key IdempotencyKey) apierrors.RestErr {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "create", arg0)
+	ret := m.ctrl.Call(m, "addIdempotencyKey", ctx, id, key)
 	ret0, _ := ret[0].(apierrors.RestErr)
 	return ret0
 }
 
+// addIdempotencyKey indicates an expected call of addIdempotencyKey.
+func (mr *MockStorageMockRecorder) addIdempotencyKey(ctx, id, key interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "addIdempotencyKey", reflect.TypeOf((*MockStorage)(nil).addIdempotencyKey), ctx, id, key)
+}
+
+// create mocks base method.
+func (m *MockStorage) create(arg0 context.Context, arg1 FlatInfo) (string, apierrors.RestErr) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "create", arg0, arg1)
+	ret0, _ := ret[0].(string)
+	ret1, _ := ret[1].(apierrors.RestErr)
+	return ret0, ret1
+}
+
 // create indicates an expected call of create.
-func (mr *MockStorageMockRecorder) create(arg0 interface{}) *gomock.Call {
+func (mr *MockStorageMockRecorder) create(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "create", reflect.TypeOf((*MockStorage)(nil).create), arg0, arg1)
+}
+
+// createDelivery mocks base method.
+func (m *MockStorage) createDelivery(arg0 context.Context, arg1 Delivery) (string, apierrors.RestErr) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "createDelivery", arg0, arg1)
+	ret0, _ := ret[0].(string)
+	ret1, _ := ret[1].(apierrors.RestErr)
+	return ret0, ret1
+}
+
+// createDelivery indicates an expected call of createDelivery.
+func (mr *MockStorageMockRecorder) createDelivery(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "createDelivery", reflect.TypeOf((*MockStorage)(nil).createDelivery), arg0, arg1)
+}
+
+// createJob mocks base method.
+func (m *MockStorage) createJob(arg0 context.Context, arg1 Job) (string, apierrors.RestErr) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "createJob", arg0, arg1)
+	ret0, _ := ret[0].(string)
+	ret1, _ := ret[1].(apierrors.RestErr)
+	return ret0, ret1
+}
+
+// createJob indicates an expected call of createJob.
+func (mr *MockStorageMockRecorder) createJob(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "createJob", reflect.TypeOf((*MockStorage)(nil).createJob), arg0, arg1)
+}
+
+// createMany mocks base method.
+func (m *MockStorage) createMany(arg0 context.Context, arg1 []FlatInfo) ([]string, []apierrors.RestErr) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "createMany", arg0, arg1)
+	ret0, _ := ret[0].([]string)
+	ret1, _ := ret[1].([]apierrors.RestErr)
+	return ret0, ret1
+}
+
+// createMany indicates an expected call of createMany.
+func (mr *MockStorageMockRecorder) createMany(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "createMany", reflect.TypeOf((*MockStorage)(nil).createMany), arg0, arg1)
+}
+
+// delete mocks base method.
+func (m *MockStorage) delete(ctx context.Context, id string) apierrors.RestErr {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "delete", ctx, id)
+	ret0, _ := ret[0].(apierrors.RestErr)
+	return ret0
+}
+
+// delete indicates an expected call of delete.
+func (mr *MockStorageMockRecorder) delete(ctx, id interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "create", reflect.TypeOf((*MockStorage)(nil).create), arg0)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "delete", reflect.TypeOf((*MockStorage)(nil).delete), ctx, id)
+}
+
+// get mocks base method.
+func (m *MockStorage) get(ctx context.Context, id string) (FlatInfo, apierrors.RestErr) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "get", ctx, id)
+	ret0, _ := ret[0].(FlatInfo)
+	ret1, _ := ret[1].(apierrors.RestErr)
+	return ret0, ret1
+}
+
+// get indicates an expected call of get.
+func (mr *MockStorageMockRecorder) get(ctx, id interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "get", reflect.TypeOf((*MockStorage)(nil).get), ctx, id)
 }
 
 // getAll mocks base method.
-func (m *MockStorage) getAll() ([]FlatInfo, apierrors.RestErr) {
+func (m *MockStorage) getAll(arg0 context.Context, arg1 FlatsQuery) ([]FlatInfo, apierrors.RestErr) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "getAll")
+	ret := m.ctrl.Call(m, "getAll", arg0, arg1)
 	ret0, _ := ret[0].([]FlatInfo)
 	ret1, _ := ret[1].(apierrors.RestErr)
 	return ret0, ret1
 }
 
 // getAll indicates an expected call of getAll.
-func (mr *MockStorageMockRecorder) getAll() *gomock.Call {
+func (mr *MockStorageMockRecorder) getAll(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "getAll", reflect.TypeOf((*MockStorage)(nil).getAll), arg0, arg1)
+}
+
+// getByHash mocks base method.
+func (m *MockStorage) getByHash(ctx context.Context, hash string) (FlatInfo, apierrors.RestErr) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "getByHash", ctx, hash)
+	ret0, _ := ret[0].(FlatInfo)
+	ret1, _ := ret[1].(apierrors.RestErr)
+	return ret0, ret1
+}
+
+// getByHash indicates an expected call of getByHash.
+func (mr *MockStorageMockRecorder) getByHash(ctx, hash interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "getByHash", reflect.TypeOf((*MockStorage)(nil).getByHash), ctx, hash)
+}
+
+// getByIdempotencyKey mocks base method.
+func (m *MockStorage) getByIdempotencyKey(ctx context.Context, key string) (FlatInfo, apierrors.RestErr) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "getByIdempotencyKey", ctx, key)
+	ret0, _ := ret[0].(FlatInfo)
+	ret1, _ := ret[1].(apierrors.RestErr)
+	return ret0, ret1
+}
+
+// getByIdempotencyKey indicates an expected call of getByIdempotencyKey.
+func (mr *MockStorageMockRecorder) getByIdempotencyKey(ctx, key interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "getByIdempotencyKey", reflect.TypeOf((*MockStorage)(nil).getByIdempotencyKey), ctx, key)
+}
+
+// getDeliveries mocks base method.
+func (m *MockStorage) getDeliveries(ctx context.Context, flatID string) ([]Delivery, apierrors.RestErr) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "getDeliveries", ctx, flatID)
+	ret0, _ := ret[0].([]Delivery)
+	ret1, _ := ret[1].(apierrors.RestErr)
+	return ret0, ret1
+}
+
+// getDeliveries indicates an expected call of getDeliveries.
+func (mr *MockStorageMockRecorder) getDeliveries(ctx, flatID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "getDeliveries", reflect.TypeOf((*MockStorage)(nil).getDeliveries), ctx, flatID)
+}
+
+// getJob mocks base method.
+func (m *MockStorage) getJob(ctx context.Context, id string) (Job, apierrors.RestErr) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "getJob", ctx, id)
+	ret0, _ := ret[0].(Job)
+	ret1, _ := ret[1].(apierrors.RestErr)
+	return ret0, ret1
+}
+
+// getJob indicates an expected call of getJob.
+func (mr *MockStorageMockRecorder) getJob(ctx, id interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "getJob", reflect.TypeOf((*MockStorage)(nil).getJob), ctx, id)
+}
+
+// iterate mocks base method.
+func (m *MockStorage) iterate(ctx context.Context, query FlatsQuery, fn func(FlatInfo) apierrors.RestErr) apierrors.RestErr {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "iterate", ctx, query, fn)
+	ret0, _ := ret[0].(apierrors.RestErr)
+	return ret0
+}
+
+// iterate indicates an expected call of iterate.
+func (mr *MockStorageMockRecorder) iterate(ctx, query, fn interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "iterate", reflect.TypeOf((*MockStorage)(nil).iterate), ctx, query, fn)
+}
+
+// purge mocks base method.
+func (m *MockStorage) purge(arg0 context.Context, arg1 RetentionPolicy) (int64, apierrors.RestErr) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "purge", arg0, arg1)
+	ret0, _ := ret[0].(int64)
+	ret1, _ := ret[1].(apierrors.RestErr)
+	return ret0, ret1
+}
+
+// purge indicates an expected call of purge.
+func (mr *MockStorageMockRecorder) purge(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "purge", reflect.TypeOf((*MockStorage)(nil).purge), arg0, arg1)
+}
+
+// updateDelivery mocks base method.
+func (m *MockStorage) updateDelivery(arg0 context.Context, arg1 Delivery) apierrors.RestErr {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "updateDelivery", arg0, arg1)
+	ret0, _ := ret[0].(apierrors.RestErr)
+	return ret0
+}
+
+// updateDelivery indicates an expected call of updateDelivery.
+func (mr *MockStorageMockRecorder) updateDelivery(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "updateDelivery", reflect.TypeOf((*MockStorage)(nil).updateDelivery), arg0, arg1)
+}
+
+// updateJob mocks base method.
+func (m *MockStorage) updateJob(arg0 context.Context, arg1 Job) apierrors.RestErr {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "updateJob", arg0, arg1)
+	ret0, _ := ret[0].(apierrors.RestErr)
+	return ret0
+}
+
+// updateJob indicates an expected call of updateJob.
+func (mr *MockStorageMockRecorder) updateJob(arg0, arg1 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "getAll", reflect.TypeOf((*MockStorage)(nil).getAll))
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "updateJob", reflect.TypeOf((*MockStorage)(nil).updateJob), arg0, arg1)
 }
@@ -7,4 +7,5 @@ require (
 	github.com/golang/mock v1.5.0
 	github.com/stretchr/testify v1.4.0
 	go.mongodb.org/mongo-driver v1.4.1
+	gopkg.in/yaml.v2 v2.2.8
 )
@@ -0,0 +1,96 @@
+package health
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	StatusOK          = "ok"
+	StatusUnavailable = "unavailable"
+)
+
+// HealthChecker is implemented by the dependencies that must work
+// for the app to be ready, like the Storage
+type HealthChecker interface {
+	HealthCheck(ctx context.Context) error
+}
+
+// Response represents the client response for /healthz and /readyz
+type Response struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks,omitempty"`
+}
+
+// CheckResult is the status of every dependency
+type CheckResult struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type Handler interface {
+	Liveness(c *gin.Context)
+	Readiness(c *gin.Context)
+}
+
+type handler struct {
+	checkers map[string]HealthChecker
+	timeout  time.Duration
+}
+
+// NewHandler receives the dependencies by name and the max time to wait for all of them
+func NewHandler(checkers map[string]HealthChecker, timeout time.Duration) Handler {
+	return &handler{
+		checkers: checkers,
+		timeout:  timeout,
+	}
+}
+
+// Liveness returns ok while the app can answer requests
+func (h *handler) Liveness(c *gin.Context) {
+	c.JSON(http.StatusOK, Response{Status: StatusOK})
+}
+
+// Readiness checks all the dependencies at the same time,
+// if one of them fails it returns 503 with the status of each one
+func (h *handler) Readiness(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), h.timeout)
+	defer cancel()
+
+	names := make([]string, 0, len(h.checkers))
+	for name := range h.checkers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	results := make([]CheckResult, len(names))
+	var wg sync.WaitGroup
+	for i, name := range names {
+		wg.Add(1)
+		go func(i int, checker HealthChecker) {
+			defer wg.Done()
+			results[i] = CheckResult{Status: StatusOK}
+			if err := checker.HealthCheck(ctx); err != nil {
+				results[i] = CheckResult{Status: StatusUnavailable, Error: err.Error()}
+			}
+		}(i, h.checkers[name])
+	}
+	wg.Wait()
+
+	res := Response{Status: StatusOK, Checks: map[string]CheckResult{}}
+	status := http.StatusOK
+	for i, name := range names {
+		res.Checks[name] = results[i]
+		if results[i].Status != StatusOK {
+			res.Status = StatusUnavailable
+			status = http.StatusServiceUnavailable
+		}
+	}
+
+	c.JSON(status, res)
+}
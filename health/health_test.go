@@ -0,0 +1,88 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+type checkerFunc func(ctx context.Context) error
+
+func (f checkerFunc) HealthCheck(ctx context.Context) error {
+	return f(ctx)
+}
+
+func TestLiveness(t *testing.T) {
+	h := NewHandler(nil, time.Second)
+
+	nr := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(nr)
+	c.Request, _ = http.NewRequest(http.MethodGet, "/healthz", nil)
+	h.Liveness(c)
+
+	assert.Equal(t, http.StatusOK, c.Writer.Status())
+	assert.JSONEq(t, `{"status":"ok"}`, nr.Body.String())
+}
+
+func TestReadiness(t *testing.T) {
+	ok := checkerFunc(func(context.Context) error { return nil })
+	failing := checkerFunc(func(context.Context) error { return errors.New("connection refused") })
+	slow := checkerFunc(func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	testCases := []struct {
+		Name     string
+		Checkers map[string]HealthChecker
+		Status   int
+		Response Response
+	}{
+		{
+			"ready",
+			map[string]HealthChecker{"storage": ok},
+			http.StatusOK,
+			Response{Status: StatusOK, Checks: map[string]CheckResult{"storage": {Status: StatusOK}}},
+		},
+		{
+			"storage_down",
+			map[string]HealthChecker{"storage": failing, "other": ok},
+			http.StatusServiceUnavailable,
+			Response{Status: StatusUnavailable, Checks: map[string]CheckResult{
+				"storage": {Status: StatusUnavailable, Error: "connection refused"},
+				"other":   {Status: StatusOK},
+			}},
+		},
+		{
+			"storage_timeout",
+			map[string]HealthChecker{"storage": slow},
+			http.StatusServiceUnavailable,
+			Response{Status: StatusUnavailable, Checks: map[string]CheckResult{
+				"storage": {Status: StatusUnavailable, Error: context.DeadlineExceeded.Error()},
+			}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			h := NewHandler(tc.Checkers, 10*time.Millisecond)
+
+			nr := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(nr)
+			c.Request, _ = http.NewRequest(http.MethodGet, "/readyz", nil)
+			h.Readiness(c)
+
+			var response Response
+			assert.Nil(t, json.Unmarshal(nr.Body.Bytes(), &response))
+			assert.Equal(t, tc.Status, c.Writer.Status())
+			assert.Equal(t, tc.Response, response)
+		})
+	}
+}
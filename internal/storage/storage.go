@@ -3,37 +3,29 @@ package storage
 import (
 	"context"
 	"fmt"
-	"time"
 
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.mongodb.org/mongo-driver/mongo/readpref"
 )
 
-func Connect(connString string) *mongo.Client {
-	var err error
-
+// Connect returns a mongodb client already connected, the ctx sets the time to wait for it.
+// The client must be disconnected when it is not used anymore
+func Connect(ctx context.Context, connString string) (*mongo.Client, error) {
 	client, err := mongo.NewClient(options.Client().ApplyURI(connString))
 	if err != nil {
-		fmt.Println("error trying to create new client for mongodb")
-		panic(err)
+		return nil, fmt.Errorf("error trying to create new client for mongodb: %w", err)
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	err = client.Connect(ctx)
-	if err != nil {
-		fmt.Println("error trying to connect to mongodb")
-		panic(err)
+	if err := client.Connect(ctx); err != nil {
+		return nil, fmt.Errorf("error trying to connect to mongodb: %w", err)
 	}
 
-	err = client.Ping(ctx, readpref.Primary())
-	if err != nil {
-		fmt.Println("error trying to Ping to mongodb connection")
-		panic(err)
+	if err := client.Ping(ctx, readpref.Primary()); err != nil {
+		client.Disconnect(context.Background())
+		return nil, fmt.Errorf("error trying to Ping to mongodb connection: %w", err)
 	}
 
 	fmt.Println("mongodb connected!")
-	return client
+	return client, nil
 }
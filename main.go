@@ -1,9 +1,26 @@
 package main
 
 import (
+	"flag"
+	"fmt"
+	"os"
+
 	"github.com/mendezdev/tgo_flattener/app"
+	"github.com/mendezdev/tgo_flattener/config"
 )
 
 func main() {
-	app.StartApplication()
+	path := flag.String("config", os.Getenv("FLATTENER_CONFIG"), "path to a YAML or JSON config file")
+	flag.Parse()
+
+	cfg, err := config.Load(*path)
+	if err != nil {
+		fmt.Printf("error loading the config: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	if err := app.StartApplication(cfg); err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
 }